@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Define JSON body for /admin/replace-node requests
+type Replace_Node_Request struct {
+	Old         string `json:"old"`
+	New         string `json:"new"`
+	FromRepilca string `json:"from-replica,omitempty"`
+}
+
+// PUT /admin/replace-node
+// JSON body {"old": <IP:PORT>, "new": <IP:PORT>}
+// Puts the node <new> in the shard slot of the dead node <old>
+func replaceNode(c echo.Context) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+	var input Replace_Node_Request
+	if err := json.Unmarshal(body, &input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	if input.Old == "" || input.New == "" || input.Old == input.New {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Old and new addresses must be different and non-empty"})
+	}
+
+	// The replacement fetches the updated shard map and its data from the sender
+	if input.New == SOCKET_ADDRESS {
+		if err := joinAsReplacement(input); err != nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"result": "replaced"})
+	}
+
+	if input.FromRepilca == "" {
+		if isPartitioned() {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; shard changes are disabled"})
+		}
+		if shardOfNode(SHARDS, input.Old) == "" {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Old node is not a member of any shard"})
+		}
+		if shardOfNode(SHARDS, input.New) != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "New node is already a member of a shard"})
+		}
+		// A live node would keep writing at the position the replacement takes over
+		if nodeIsUp(input.Old) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Old node is still up; decommission it instead"})
+		}
+		if metadataEnabled() {
+			_, err := updateClusterConfig(func(cfg *Cluster_Config) bool {
+				replaceInShards(cfg.Shards, input.Old, input.New)
+				cfg.View = replaceInList(cfg.View, input.Old, input.New)
+				return true
+			})
+			if err != nil {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Failed to commit node replacement"})
+			}
+		}
+	}
+
+	shardID := replaceNodeLocally(input.Old, input.New)
+
+	if input.FromRepilca == "" {
+		input.FromRepilca = SOCKET_ADDRESS
+		jsonBytes, _ := json.Marshal(input)
+		// Every other node must know about the replacement before it syncs
+		others := make([]string, 0, len(CURRENT_VIEW))
+		for _, address := range CURRENT_VIEW {
+			if address != input.New {
+				others = append(others, address)
+			}
+		}
+		missed := sendAndAckAll("PUT", "admin/replace-node", jsonBytes, others)
+		missed = append(missed, sendAndAckAll("PUT", "admin/replace-node", jsonBytes, []string{input.New})...)
+		if len(missed) > 0 {
+			return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{"error": "The replacement was not applied on every node", "shard-id": shardID, "missed": missed})
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]string{"result": "replaced", "shard-id": shardID})
+}
+
+// Returns true if the node at address answers a heartbeat
+func nodeIsUp(address string) bool {
+	client := peerClient(time.Duration(CONFIG.HeartbeatTimeout))
+	resp, err := client.Get(fmt.Sprintf("http://%s/view", address))
+	if err != nil {
+		return false
+	}
+	drainAndClose(resp.Body)
+	return resp.StatusCode == http.StatusOK
+}
+
+// Swap old for new in the view, the shard map and the vector clock
+// Returns the shard id of the slot that was taken over
+func replaceNodeLocally(old string, new string) string {
+	viewMutex.Lock()
+	CURRENT_VIEW = replaceInList(CURRENT_VIEW, old, new)
+	LAST_AGREED_VIEW = replaceInList(LAST_AGREED_VIEW, old, new)
+	viewMutex.Unlock()
+
+	shardID := replaceInShards(SHARDS, old, new)
+
+	// The new node continues the old node's position in the vector clock so
+	// that the writes it sends next are deliverable on the other replicas
+	vectorClockMutex.Lock()
+	if MY_VECTOR_CLOCK != nil {
+		oldTicks, _ := MY_VECTOR_CLOCK.FindTicks(old)
+		newTicks, _ := MY_VECTOR_CLOCK.FindTicks(new)
+		if oldTicks > newTicks {
+			newTicks = oldTicks
+		}
+		MY_VECTOR_CLOCK.Set(new, newTicks)
+		delete(MY_VECTOR_CLOCK, old)
+	}
+	vectorClockMutex.Unlock()
+	updateMyShardID()
+	return shardID
+}
+
+// Replace old with new in the member list of its shard
+// Returns the shard id, or "" if old is not in any shard
+func replaceInShards(shards map[string][]string, old string, new string) string {
+	shardID := shardOfNode(shards, old)
+	if shardID == "" {
+		return ""
+	}
+	shards[shardID] = replaceInList(shards[shardID], old, new)
+	return shardID
+}
+
+// Replace old with new in a list of addresses, appending new if old is missing
+func replaceInList(list []string, old string, new string) []string {
+	replaced := make([]string, 0, len(list)+1)
+	for _, address := range list {
+		if address == old {
+			address = new
+		}
+		if !contains(replaced, address) {
+			replaced = append(replaced, address)
+		}
+	}
+	if !contains(replaced, new) {
+		replaced = append(replaced, new)
+	}
+	return replaced
+}
+
+// Called on the replacement node: fetch the updated cluster state and the data of the shard
+func joinAsReplacement(input Replace_Node_Request) error {
+	var state Bootstrap_State
+	if err := fetchBootstrapState([]string{input.FromRepilca}, &state); err != nil {
+		return fmt.Errorf("failed to fetch cluster state: %v", err)
+	}
+	viewMutex.Lock()
+	CURRENT_VIEW = state.View
+	LAST_AGREED_VIEW = append([]string{}, state.View...)
+	viewMutex.Unlock()
+	SHARDS = state.Shards
+	shardID := shardOfNode(SHARDS, SOCKET_ADDRESS)
+	if shardID == "" {
+		return fmt.Errorf("replacement is not a member of any shard")
+	}
+	// Sync with the remaining members, then make sure their state has the swap applied
+	if err := syncWithShard(shardID); err != nil {
+		return fmt.Errorf("failed to sync with %s: %v", shardID, err)
+	}
+	replaceNodeLocally(input.Old, input.New)
+	vectorClockMutex.Lock()
+	for _, address := range CURRENT_VIEW {
+		if _, ok := MY_VECTOR_CLOCK.FindTicks(address); !ok {
+			MY_VECTOR_CLOCK.Set(address, 0)
+		}
+	}
+	vectorClockMutex.Unlock()
+	rebuildRouting()
+	fmt.Printf("Replaced %s as a member of %s\n", input.Old, shardID)
+	return nil
+}
+
+// PUT /admin/decommission
+// JSON body {"socket-address": <IP:PORT>}
+// Takes the node <IP:PORT> out of its shard and the view of every node
+func decommissionNode(c echo.Context) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+	var input addNodeRequest
+	if err := json.Unmarshal(body, &input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	shardID := shardOfNode(SHARDS, input.SocketAddress)
+
+	// Another node already checked and recorded the decommission
+	if input.FromRepilca != "" {
+		decommissionNodeLocally(input.SocketAddress)
+		return c.JSON(http.StatusOK, map[string]string{"result": "decommissioned", "shard-id": shardID})
+	}
+
+	if isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; shard changes are disabled"})
+	}
+	if reshardInProgress() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A reshard is already in progress"})
+	}
+	if shardID == "" && !contains(CURRENT_VIEW, input.SocketAddress) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Node is not in the view or any shard"})
+	}
+	// The shard must keep enough members to provide fault tolerance
+	if shardID != "" && len(SHARDS[shardID])-1 < CONFIG.MinNodesPerShard {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Not enough nodes would be left in " + shardID + "; add a node or reshard first"})
+	}
+	// Record the decommission in the metadata service
+	if metadataEnabled() {
+		_, err := updateClusterConfig(func(cfg *Cluster_Config) bool {
+			if from := shardOfNode(cfg.Shards, input.SocketAddress); from != "" {
+				cfg.Shards[from] = removeFromList(cfg.Shards[from], input.SocketAddress)
+			}
+			cfg.View = removeFromList(cfg.View, input.SocketAddress)
+			return true
+		})
+		if err != nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Failed to commit decommission"})
+		}
+	}
+
+	others := make([]string, 0, len(CURRENT_VIEW))
+	for _, address := range CURRENT_VIEW {
+		if address != input.SocketAddress {
+			others = append(others, address)
+		}
+	}
+	decommissionNodeLocally(input.SocketAddress)
+	input.FromRepilca = SOCKET_ADDRESS
+	jsonBytes, _ := json.Marshal(input)
+	// The node itself is told last, once no other node sends it writes
+	broadcastTest("PUT", "admin/decommission", jsonBytes, others)
+	if input.SocketAddress != SOCKET_ADDRESS {
+		broadcastTest("PUT", "admin/decommission", jsonBytes, []string{input.SocketAddress})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"result": "decommissioned", "shard-id": shardID})
+}
+
+// Drop address from the view, the agreed view and the shard map
+// The decommissioned node itself also drops the data of its old shard
+func decommissionNodeLocally(address string) {
+	removeFromView(address)
+	removeFromAgreedView(address)
+	if shardID := shardOfNode(SHARDS, address); shardID != "" {
+		SHARDS[shardID] = removeFromList(SHARDS[shardID], address)
+	}
+	updateMyShardID()
+	if address == SOCKET_ADDRESS {
+		KVSmutex.Lock()
+		KVStore = make(map[string]Value)
+		KVSmutex.Unlock()
+		fmt.Printf("Decommissioned\n")
+	}
+}
+
+// GET /admin/vector-clock
+// Returns the vector clock of this node without the data that /sync sends with it
+func getVectorClock(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"node":         SOCKET_ADDRESS,
+		"shard-id":     MY_SHARD_ID,
+		"vector-clock": json.RawMessage(vectorClockString()),
+	})
+}
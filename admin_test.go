@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// A node that is still up cannot be replaced; once it is down, a new node takes its slot and its data
+func TestReplaceNode(t *testing.T) {
+	cluster := startCluster(t, 3, 1)
+	node, old := cluster.nodes[0], cluster.nodes[2]
+	for i := 0; i < 10; i++ {
+		if status, reply := kvsRequest(t, "PUT", node, fmt.Sprintf("key%d", i), KVS_PUT_Request{Data: "v"}); status != http.StatusCreated {
+			t.Fatalf("PUT returned %d: %v", status, reply)
+		}
+	}
+	waitForReplication(t, cluster.nodes)
+	replacement := cluster.addNode()
+
+	input := Replace_Node_Request{Old: old, New: replacement}
+	if status, reply := nodeRequest(t, "PUT", node, "admin/replace-node", input); status != http.StatusConflict {
+		t.Fatalf("replacing a node that is up returned %d: %v", status, reply)
+	}
+
+	cluster.kill(old)
+	status, reply := nodeRequest(t, "PUT", node, "admin/replace-node", input)
+	if status != http.StatusOK || reply["result"] != "replaced" {
+		t.Fatalf("replace returned %d: %v", status, reply)
+	}
+	for _, address := range []string{cluster.nodes[0], cluster.nodes[1], replacement} {
+		_, reply := nodeRequest(t, "GET", address, "shard/members/shard0", nil)
+		if !containsValue(reply["shard-members"], replacement) || containsValue(reply["shard-members"], old) {
+			t.Errorf("members of shard0 on %s are %v", address, reply["shard-members"])
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if status, reply := kvsRequest(t, "GET", replacement, fmt.Sprintf("key%d", i), KVS_GET_DELETE_Request{}); status != http.StatusOK {
+			t.Errorf("GET key%d from the replacement returned %d: %v", i, status, reply)
+		}
+	}
+	// Writes taken by the replacement reach the other members
+	if status, reply := kvsRequest(t, "PUT", replacement, "after", KVS_PUT_Request{Data: "v"}); status != http.StatusCreated {
+		t.Fatalf("PUT on the replacement returned %d: %v", status, reply)
+	}
+	waitForReplication(t, []string{replacement})
+	if status, reply := kvsRequest(t, "GET", node, "after", KVS_GET_DELETE_Request{}); status != http.StatusOK {
+		t.Errorf("write taken by the replacement is missing on %s: %d %v", node, status, reply)
+	}
+}
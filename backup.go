@@ -0,0 +1,539 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/DistributedClocks/GoVector/govec/vclock"
+	"github.com/labstack/echo/v4"
+)
+
+// Name and version of the backup archive format
+const (
+	backupFormat        = "kvs-backup"
+	backupFormatVersion = 1
+	backupManifestName  = "manifest.json"
+)
+
+// ID of the backup or restore that holds client writes back on this node, if any
+// Protected by reshardMutex, like the reshard fence
+var BACKUP_FENCE string
+
+// Define JSON body for the private backup endpoints
+type Backup_Request struct {
+	BackupID    string `json:"backup-id"`
+	ShardID     string `json:"shard-id,omitempty"`
+	VectorClock string `json:"vector-clock,omitempty"`
+}
+
+// Define JSON body returned by a node for /admin/backup/snapshot
+type Backup_Snapshot struct {
+	Node        string           `json:"node"`
+	ShardID     string           `json:"shard-id"`
+	VectorClock string           `json:"vector-clock"`
+	Entries     map[string]Value `json:"entries"`
+}
+
+// Manifest stored first in every backup archive
+type Backup_Manifest struct {
+	Format        string              `json:"format"`
+	FormatVersion int                 `json:"format-version"`
+	ID            string              `json:"id"`
+	Created       time.Time           `json:"created"`
+	Coordinator   string              `json:"coordinator"`
+	VectorClock   map[string]uint64   `json:"vector-clock"`
+	Partitioner   string              `json:"partitioner"`
+	Shards        map[string][]string `json:"shards"`
+	Keys          int                 `json:"keys"`
+	Files         []Backup_File       `json:"files"`
+}
+
+// A file of a backup archive with the key-value pairs of one shard
+type Backup_File struct {
+	Name    string `json:"name"`
+	ShardID string `json:"shard-id"`
+	Source  string `json:"source"`
+	Keys    int    `json:"keys"`
+	Size    int    `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// One line of a shard file
+type Backup_Entry struct {
+	Key     string      `json:"key"`
+	Data    interface{} `json:"data"`
+	Type    string      `json:"type,omitempty"`
+	Version uint64      `json:"version,omitempty"`
+	Flags   uint32      `json:"flags,omitempty"`
+	Expires int64       `json:"expires,omitempty"`
+}
+
+// POST /admin/backup
+// Writes a causally consistent copy of every shard to an archive in the backup directory
+func backupCluster(c echo.Context) error {
+	if CONFIG.BackupDir == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No backup directory configured"})
+	}
+	if isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; backups are disabled"})
+	}
+	if reshardInProgress() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A reshard is in progress"})
+	}
+	id := fmt.Sprintf("backup-%x", time.Now().UnixNano())
+	viewMutex.Lock()
+	nodes := append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	shards := SHARDS
+
+	cut, snapshots, err := captureCut(id, nodes, shards)
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Backup failed: " + err.Error(), "backup-id": id})
+	}
+	manifest := Backup_Manifest{
+		Format:        backupFormat,
+		FormatVersion: backupFormatVersion,
+		ID:            id,
+		Created:       time.Now().UTC(),
+		Coordinator:   SOCKET_ADDRESS,
+		VectorClock:   cut,
+		Partitioner:   CONFIG.Partitioner,
+		Shards:        shards,
+	}
+	path, err := writeBackupArchive(&manifest, snapshots)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to write backup archive: " + err.Error(), "backup-id": id})
+	}
+	fmt.Printf("Backup %s written to %s with %d keys\n", id, path, manifest.Keys)
+	return c.JSON(http.StatusOK, map[string]interface{}{"result": "backed up", "backup-id": id, "path": path, "keys": manifest.Keys, "vector-clock": cut})
+}
+
+// Hold client writes back on every node, then take a snapshot of one replica of every shard
+// once it has applied every write accepted before that
+// Returns the vector clock of the cut and the snapshot of every shard
+func captureCut(id string, nodes []string, shards map[string][]string) (vclock.VClock, map[string]Backup_Snapshot, error) {
+	start := time.Now()
+	defer releaseWrites(id, nodes)
+	cut, err := holdWrites(id, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshots := make(map[string]Backup_Snapshot)
+	for shardid, members := range shards {
+		snapshot, err := snapshotShard(id, shardid, members, cut)
+		if err != nil {
+			return nil, nil, err
+		}
+		snapshots[shardid] = snapshot
+	}
+	// The fence of a node lifts by itself after backup-timeout, so a slower backup may have missed writes
+	if time.Since(start) >= time.Duration(CONFIG.BackupTimeout) {
+		return nil, nil, fmt.Errorf("writes were held back for longer than backup-timeout")
+	}
+	return cut, snapshots, nil
+}
+
+// Fence client writes on every node
+// Returns the pointwise maximum of their vector clocks, which counts every write accepted before the fence
+func holdWrites(id string, nodes []string) (vclock.VClock, error) {
+	cut := vclock.New()
+	for _, address := range nodes {
+		var reply map[string]string
+		if err := sendBackupRequest(address, "admin/backup/fence", Backup_Request{BackupID: id}, &reply); err != nil {
+			return nil, fmt.Errorf("%s did not hold writes back: %v", address, err)
+		}
+		clock, err := NewVClockFromString(reply["vector-clock"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector clock from %s", address)
+		}
+		cut.Merge(clock)
+	}
+	return cut, nil
+}
+
+// Lift the fence of id on every node; nodes that miss this lift it after backup-timeout
+func releaseWrites(id string, nodes []string) {
+	for _, address := range nodes {
+		if err := sendBackupRequest(address, "admin/backup/release", Backup_Request{BackupID: id}, nil); err != nil {
+			fmt.Printf("Failed to lift the backup fence on %s: %v\n", address, err)
+		}
+	}
+}
+
+// Take a snapshot of a shard at the cut from the first member that can give one
+func snapshotShard(id string, shardid string, members []string, cut vclock.VClock) (Backup_Snapshot, error) {
+	input := Backup_Request{BackupID: id, ShardID: shardid, VectorClock: cut.ReturnVCString()}
+	lastErr := fmt.Errorf("no members")
+	for _, address := range members {
+		var snapshot Backup_Snapshot
+		if err := sendBackupRequest(address, "admin/backup/snapshot", input, &snapshot); err != nil {
+			lastErr = err
+			continue
+		}
+		return snapshot, nil
+	}
+	return Backup_Snapshot{}, fmt.Errorf("no snapshot of %s: %v", shardid, lastErr)
+}
+
+// Send a backup request to a node, including this one, and decode its reply into out
+func sendBackupRequest(address string, endpoint string, input Backup_Request, out interface{}) error {
+	jsonData, _ := json.Marshal(input)
+	request, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/%s", address, endpoint), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := peerClient(time.Duration(CONFIG.BackupTimeout)).Do(request)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// PUT /admin/backup/fence
+// Private endpoint that holds client writes back and returns the vector clock once none are in flight
+func fenceWrites(c echo.Context) error {
+	var input Backup_Request
+	if err := c.Bind(&input); err != nil || input.BackupID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	// Taking the lock waits for the client writes that are being applied
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	if RESHARD_JOB != "" {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Resharding in progress"})
+	}
+	if BACKUP_FENCE != "" && BACKUP_FENCE != input.BackupID {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Another backup or restore is in progress", "backup-id": BACKUP_FENCE})
+	}
+	BACKUP_FENCE = input.BackupID
+	// Let writes through again if the coordinator never lifts the fence
+	time.AfterFunc(time.Duration(CONFIG.BackupTimeout), func() { liftFence(input.BackupID) })
+	return c.JSON(http.StatusOK, map[string]string{"vector-clock": vectorClockString()})
+}
+
+// PUT /admin/backup/release
+// Private endpoint that lets client writes through again
+func releaseFence(c echo.Context) error {
+	var input Backup_Request
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	liftFence(input.BackupID)
+	return c.JSON(http.StatusOK, map[string]string{"result": "released"})
+}
+
+// Lift the fence if it still belongs to id
+func liftFence(id string) {
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	if BACKUP_FENCE == id {
+		BACKUP_FENCE = ""
+	}
+}
+
+// PUT /admin/backup/snapshot
+// Private endpoint that returns this node's key-value pairs once it has applied every write of the cut
+func snapshotForBackup(c echo.Context) error {
+	var input Backup_Request
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	cut, err := NewVClockFromString(input.VectorClock)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid metadata format"})
+	}
+	if MY_SHARD_ID != input.ShardID {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Node is not a member of the shard"})
+	}
+	// Wait for the replication of writes accepted by other nodes before the fence
+	deadline := time.Now().Add(time.Duration(CONFIG.BackupTimeout))
+	for !clockCovers(cut) {
+		if time.Now().After(deadline) {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Replication did not reach the backup cut in time"})
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	reshardMutex.RLock()
+	fenced := BACKUP_FENCE == input.BackupID
+	reshardMutex.RUnlock()
+	if !fenced {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Writes are no longer held back for this backup"})
+	}
+	KVSmutex.Lock()
+	entries := make(map[string]Value, len(KVStore))
+	for key, value := range KVStore {
+		entries[key] = value
+	}
+	KVSmutex.Unlock()
+	return c.JSON(http.StatusOK, Backup_Snapshot{
+		Node:        SOCKET_ADDRESS,
+		ShardID:     MY_SHARD_ID,
+		VectorClock: vectorClockString(),
+		Entries:     entries,
+	})
+}
+
+// Returns true if MY_VECTOR_CLOCK has seen every write counted by target
+func clockCovers(target vclock.VClock) bool {
+	vectorClockMutex.Lock()
+	defer vectorClockMutex.Unlock()
+	for id, ticks := range target {
+		seen, _ := MY_VECTOR_CLOCK.FindTicks(id)
+		if seen < ticks {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the path of the archive of a backup, or an error if the id is not a plain name
+func backupPath(id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid backup id")
+	}
+	return filepath.Join(CONFIG.BackupDir, id+".tar.gz"), nil
+}
+
+// Write the snapshots to a gzipped tar archive named after the backup
+// The manifest comes first and has the number of keys and SHA-256 of every shard file
+func writeBackupArchive(manifest *Backup_Manifest, snapshots map[string]Backup_Snapshot) (string, error) {
+	path, err := backupPath(manifest.ID)
+	if err != nil {
+		return "", err
+	}
+	shardids := make([]string, 0, len(snapshots))
+	for shardid := range snapshots {
+		shardids = append(shardids, shardid)
+	}
+	sort.Strings(shardids)
+
+	// Encode every shard as JSON lines in key order
+	contents := make(map[string][]byte)
+	for _, shardid := range shardids {
+		snapshot := snapshots[shardid]
+		keys := make([]string, 0, len(snapshot.Entries))
+		for key := range snapshot.Entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		for _, key := range keys {
+			value := snapshot.Entries[key]
+			if err := encoder.Encode(Backup_Entry{Key: key, Data: value.Data, Type: value.Type, Version: value.Version, Flags: value.Flags, Expires: value.Expires}); err != nil {
+				return "", err
+			}
+		}
+		sum := sha256.Sum256(buffer.Bytes())
+		file := Backup_File{
+			Name:    "shards/" + shardid + ".jsonl",
+			ShardID: shardid,
+			Source:  snapshot.Node,
+			Keys:    len(keys),
+			Size:    buffer.Len(),
+			SHA256:  hex.EncodeToString(sum[:]),
+		}
+		manifest.Files = append(manifest.Files, file)
+		manifest.Keys += len(keys)
+		contents[file.Name] = buffer.Bytes()
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path + ".tmp")
+	defer out.Close()
+	zipper := gzip.NewWriter(out)
+	archive := tar.NewWriter(zipper)
+	addFile := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: manifest.Created}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+	if err := addFile(backupManifestName, manifestBytes); err != nil {
+		return "", err
+	}
+	for _, file := range manifest.Files {
+		if err := addFile(file.Name, contents[file.Name]); err != nil {
+			return "", err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return "", err
+	}
+	if err := zipper.Close(); err != nil {
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(path+".tmp", path)
+}
+
+// Read a backup archive and check it against its manifest
+// Returns the manifest and every key-value pair in the archive
+func readBackupArchive(path string) (Backup_Manifest, map[string]Value, error) {
+	var manifest Backup_Manifest
+	in, err := os.Open(path)
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer in.Close()
+	zipped, err := gzip.NewReader(in)
+	if err != nil {
+		return manifest, nil, err
+	}
+	archive := tar.NewReader(zipped)
+	contents := make(map[string][]byte)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, err
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return manifest, nil, err
+		}
+		contents[header.Name] = data
+	}
+
+	manifestBytes, ok := contents[backupManifestName]
+	if !ok {
+		return manifest, nil, fmt.Errorf("no %s", backupManifestName)
+	}
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("invalid %s: %v", backupManifestName, err)
+	}
+	if manifest.Format != backupFormat || manifest.FormatVersion != backupFormatVersion {
+		return manifest, nil, fmt.Errorf("unsupported format %s version %d", manifest.Format, manifest.FormatVersion)
+	}
+	entries := make(map[string]Value)
+	for _, file := range manifest.Files {
+		data, ok := contents[file.Name]
+		if !ok {
+			return manifest, nil, fmt.Errorf("%s is missing", file.Name)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != file.SHA256 {
+			return manifest, nil, fmt.Errorf("checksum of %s does not match", file.Name)
+		}
+		keys := 0
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for scanner.Scan() {
+			var entry Backup_Entry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				return manifest, nil, fmt.Errorf("%s line %d: %v", file.Name, keys+1, err)
+			}
+			entries[entry.Key] = Value{Data: entry.Data, Type: entry.Type, Version: entry.Version, Flags: entry.Flags, Expires: entry.Expires}
+			keys++
+		}
+		if keys != file.Keys {
+			return manifest, nil, fmt.Errorf("%s has %d keys instead of %d", file.Name, keys, file.Keys)
+		}
+	}
+	return manifest, entries, nil
+}
+
+// POST /admin/restore
+// JSON body {"backup-id": <ID>}
+// Loads a backup archive from the backup directory into the current shards
+// Keys are placed by the current shard map, so the cluster may have any number of shards
+func restoreCluster(c echo.Context) error {
+	if CONFIG.BackupDir == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No backup directory configured"})
+	}
+	var input Backup_Request
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	path, err := backupPath(input.BackupID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid backup id"})
+	}
+	manifest, entries, err := readBackupArchive(path)
+	if os.IsNotExist(err) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Backup not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid backup archive: " + err.Error()})
+	}
+	if isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; restores are disabled"})
+	}
+	if reshardInProgress() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A reshard is in progress"})
+	}
+	if len(SHARDS) == 0 {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "The cluster has no shards yet"})
+	}
+
+	// Hold writes back so that none of them is overwritten by an older value from the backup
+	id := fmt.Sprintf("restore-%x", time.Now().UnixNano())
+	viewMutex.Lock()
+	nodes := append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	defer releaseWrites(id, nodes)
+	if _, err := holdWrites(id, nodes); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Restore failed: " + err.Error()})
+	}
+
+	// Send every key to all members of the shard that owns it now
+	batches := make(map[string]map[string]Value)
+	for key, value := range entries {
+		shardid := locateShard(key)
+		if batches[shardid] == nil {
+			batches[shardid] = make(map[string]Value)
+		}
+		batches[shardid][key] = value
+	}
+	keyCounts := make(map[string]int)
+	for shardid, batch := range batches {
+		for _, address := range SHARDS[shardid] {
+			if !contains(nodes, address) {
+				continue
+			}
+			if err := sendInBulk(address, batch, ""); err != nil {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Failed to restore " + shardid + " on " + address + ": " + err.Error()})
+			}
+		}
+		keyCounts[shardid] = len(batch)
+	}
+	fmt.Printf("Restored %d keys from backup %s\n", len(entries), manifest.ID)
+	return c.JSON(http.StatusOK, map[string]interface{}{"result": "restored", "backup-id": manifest.ID, "keys": len(entries), "key-counts": keyCounts})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackupArchive(t *testing.T) {
+	CONFIG = defaultConfig()
+	CONFIG.BackupDir = t.TempDir()
+	snapshots := map[string]Backup_Snapshot{
+		"shard0": {Node: "a", ShardID: "shard0", Entries: map[string]Value{"a": {Data: "1", Version: 2}, "b": {Data: 3.0, Flags: 7}}},
+		"shard1": {Node: "b", ShardID: "shard1", Entries: map[string]Value{"c": {Data: "1", Type: "int", Expires: 1700000000000}}},
+	}
+	manifest := Backup_Manifest{Format: backupFormat, FormatVersion: backupFormatVersion, ID: "backup-1", Created: time.Now().UTC()}
+	path, err := writeBackupArchive(&manifest, snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Keys != 3 || len(manifest.Files) != 2 {
+		t.Errorf("manifest has %d keys in %d files", manifest.Keys, len(manifest.Files))
+	}
+
+	read, entries, err := readBackupArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Value{"a": {Data: "1", Version: 2}, "b": {Data: 3.0, Flags: 7}, "c": {Data: "1", Type: "int", Expires: 1700000000000}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("archive holds %v, want %v", entries, want)
+	}
+	if !reflect.DeepEqual(read.Files, manifest.Files) {
+		t.Errorf("read manifest files %v, want %v", read.Files, manifest.Files)
+	}
+
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)/2], 0644)
+	if _, _, err := readBackupArchive(path); err == nil {
+		t.Error("read a truncated archive")
+	}
+	for _, id := range []string{"", ".", "..", "../backup-1", "a/b"} {
+		if _, err := backupPath(id); err == nil {
+			t.Errorf("backup id %q was accepted", id)
+		}
+	}
+}
+
+// A backup of two shards restores into a cluster of three
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	source := startCluster(t, 4, 2, "KVS_BACKUP_DIR="+dir)
+	const keys = 20
+	for i := 0; i < keys; i++ {
+		if status, reply := kvsRequest(t, "PUT", source.nodes[0], fmt.Sprintf("key%d", i), KVS_PUT_Request{Data: fmt.Sprintf("v%d", i)}); status != http.StatusCreated {
+			t.Fatalf("PUT returned %d: %v", status, reply)
+		}
+	}
+	status, reply := nodeRequest(t, "POST", source.nodes[1], "admin/backup", nil)
+	if status != http.StatusOK || reply["keys"] != float64(keys) {
+		t.Fatalf("backup returned %d: %v", status, reply)
+	}
+	backupID := reply["backup-id"]
+
+	target := startCluster(t, 3, 3, "KVS_BACKUP_DIR="+dir)
+	status, reply = nodeRequest(t, "POST", target.nodes[0], "admin/restore", map[string]interface{}{"backup-id": backupID})
+	if status != http.StatusOK || reply["keys"] != float64(keys) {
+		t.Fatalf("restore returned %d: %v", status, reply)
+	}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if status, reply := getFromNode(t, target.nodes[i%3], key, ""); status != http.StatusOK || reply["value"] != fmt.Sprintf("v%d", i) {
+			t.Errorf("GET %s after the restore returned %d: %v", key, status, reply)
+		}
+	}
+	if status, _ := nodeRequest(t, "POST", target.nodes[0], "admin/restore", map[string]string{"backup-id": "backup-0"}); status != http.StatusNotFound {
+		t.Errorf("restore of a missing backup returned %d", status)
+	}
+}
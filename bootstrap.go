@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Define JSON body for /bootstrap responses
+type Bootstrap_State struct {
+	View   []string            `json:"view"`
+	Shards map[string][]string `json:"shards"`
+}
+
+// GET /bootstrap
+// Returns the view and shard map so that a new node can join through this node
+func getBootstrapState(c echo.Context) error {
+	viewMutex.Lock()
+	view := append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	return c.JSON(http.StatusOK, Bootstrap_State{View: view, Shards: SHARDS})
+}
+
+// Join a running cluster knowing only the addresses of one or more seed nodes
+// The node adds itself to the view and becomes a member of the smallest shard
+func bootstrapFromSeeds(seeds []string) {
+	// Keep trying until one of the seeds answers with a shard map
+	var state Bootstrap_State
+	for {
+		err := fetchBootstrapState(seeds, &state)
+		if err == nil && len(state.Shards) > 0 {
+			break
+		}
+		fmt.Printf("Waiting for seeds %v: %v\n", seeds, err)
+		time.Sleep(time.Second)
+	}
+
+	viewMutex.Lock()
+	CURRENT_VIEW = state.View
+	if !contains(CURRENT_VIEW, SOCKET_ADDRESS) {
+		CURRENT_VIEW = append(CURRENT_VIEW, SOCKET_ADDRESS)
+	}
+	LAST_AGREED_VIEW = append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	SHARDS = state.Shards
+
+	// Tell every node about me before joining a shard, they reject unknown members
+	payload := map[string]string{"socket-address": SOCKET_ADDRESS}
+	jsonPayload, _ := json.Marshal(payload)
+	broadcastTest("PUT", "view", jsonPayload, CURRENT_VIEW)
+
+	// Pick the shard with the fewest members and get its data and vector clock
+	shardID := smallestShard(SHARDS)
+	if err := syncWithShard(shardID); err != nil {
+		// Nobody answers for a shard that has no data yet
+		initializeEmptyNode()
+	}
+	if !contains(SHARDS[shardID], SOCKET_ADDRESS) {
+		SHARDS[shardID] = append(SHARDS[shardID], SOCKET_ADDRESS)
+	}
+	MY_SHARD_ID = shardID
+	vectorClockMutex.Lock()
+	for _, address := range CURRENT_VIEW {
+		if _, ok := MY_VECTOR_CLOCK.FindTicks(address); !ok {
+			MY_VECTOR_CLOCK.Set(address, 0)
+		}
+	}
+	vectorClockMutex.Unlock()
+	rebuildRouting()
+
+	// Let every other node add me to the shard
+	payload = map[string]string{"socket-address": SOCKET_ADDRESS, "from-replica": SOCKET_ADDRESS}
+	jsonPayload, _ = json.Marshal(payload)
+	broadcast(context.Background(), "PUT", "shard/add-member/"+shardID, jsonPayload, CURRENT_VIEW)
+	fmt.Printf("Joined cluster through seeds %v as a member of %s\n", seeds, shardID)
+}
+
+// Ask the seeds for the current view and shard map until one of them answers
+func fetchBootstrapState(seeds []string, state *Bootstrap_State) error {
+	client := peerClient(time.Duration(CONFIG.SendToAnyTimeout))
+	for _, seed := range seeds {
+		if seed == SOCKET_ADDRESS {
+			continue
+		}
+		resp, err := client.Get(fmt.Sprintf("http://%s/bootstrap", seed))
+		if err != nil {
+			continue
+		}
+		err = json.NewDecoder(resp.Body).Decode(state)
+		drainAndClose(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("no seed reachable")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A node started with only SEEDS joins the smallest shard, gets its keys and is known to every node
+func TestBootstrapFromSeeds(t *testing.T) {
+	cluster := startCluster(t, 5, 2)
+	node := cluster.nodes[0]
+	for i := 0; i < 20; i++ {
+		if status, reply := kvsRequest(t, "PUT", node, fmt.Sprintf("key%d", i), KVS_PUT_Request{Data: "v"}); status != http.StatusCreated {
+			t.Fatalf("PUT returned %d: %v", status, reply)
+		}
+	}
+	waitForReplication(t, cluster.nodes)
+	members := make(map[string][]string)
+	for _, shardid := range []string{"shard0", "shard1"} {
+		_, reply := nodeRequest(t, "GET", node, "shard/members/"+shardid, nil)
+		for _, member := range reply["shard-members"].([]interface{}) {
+			members[shardid] = append(members[shardid], member.(string))
+		}
+	}
+	smallest := smallestShard(members)
+
+	joined := cluster.addNode("SEEDS=127.0.0.1:1," + node)
+	_, reply := nodeRequest(t, "GET", joined, "shard/node-shard-id", nil)
+	if reply["node-shard-id"] != smallest {
+		t.Fatalf("new node joined %v, want the smallest shard %s of %v", reply["node-shard-id"], smallest, members)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for _, address := range cluster.nodes[:5] {
+		for {
+			_, view := nodeRequest(t, "GET", address, "view", nil)
+			_, shard := nodeRequest(t, "GET", address, "shard/members/"+smallest, nil)
+			if containsValue(view["view"], joined) && containsValue(shard["shard-members"], joined) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s does not know about the new node: view %v, %s %v", address, view["view"], smallest, shard["shard-members"])
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	_, want := nodeRequest(t, "GET", members[smallest][0], "shard/key-count/"+smallest, nil)
+	_, got := nodeRequest(t, "GET", joined, "shard/key-count/"+smallest, nil)
+	if got["shard-key-count"] != want["shard-key-count"] {
+		t.Errorf("new node has %v keys, other members of %s have %v", got["shard-key-count"], smallest, want["shard-key-count"])
+	}
+}
+
+func TestSmallestShard(t *testing.T) {
+	shards := map[string][]string{"shard0": {"a", "b"}, "shard1": {"c"}, "shard2": {"d"}}
+	if got := smallestShard(shards); got != "shard1" {
+		t.Errorf("smallest shard is %s, want the first of the smallest ones", got)
+	}
+	if got := smallestShard(nil); got != "" {
+		t.Errorf("smallest of no shards is %q", got)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Formats of /admin/import and /admin/export
+const (
+	bulkFormatJSONL = "jsonl"
+	bulkFormatCSV   = "csv"
+)
+
+// Columns of CSV imports and exports; key and value are required on import
+var bulkCSVColumns = []string{"key", "value", "type", "ttl"}
+
+// One row of an import or export
+type Bulk_Row struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Type  string      `json:"type,omitempty"`
+	// Seconds until the key is deleted; 0 if it does not expire
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// Counts of an import, reported as it runs and at the end
+type Import_Progress struct {
+	Rows     int `json:"rows"`
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+}
+
+// Returns the format of a bulk request from the format query parameter or the content type
+func bulkFormat(c echo.Context) (string, error) {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = bulkFormatJSONL
+		if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv") {
+			format = bulkFormatCSV
+		}
+	}
+	if format != bulkFormatJSONL && format != bulkFormatCSV {
+		return "", fmt.Errorf("format must be %s or %s", bulkFormatJSONL, bulkFormatCSV)
+	}
+	return format, nil
+}
+
+// GET /admin/export?format=<jsonl|csv>&prefix=<PREFIX>
+// Streams every key-value pair of every shard, in key order within each shard
+// ttl is the number of seconds left for keys given an expiry time
+func exportKeys(c echo.Context) error {
+	format, err := bulkFormat(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	prefix := c.QueryParam("prefix")
+	shardids := make([]string, 0, len(SHARDS))
+	for shardid := range SHARDS {
+		shardids = append(shardids, shardid)
+	}
+	sort.Strings(shardids)
+	// Read every shard before answering, so that a failure is not a truncated export
+	shardEntries := make(map[string]map[string]Value)
+	for _, shardid := range shardids {
+		entries, err := fetchShardEntries(shardid)
+		if err != nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Failed to read " + shardid + ": " + err.Error()})
+		}
+		shardEntries[shardid] = entries
+	}
+
+	response := c.Response()
+	if format == bulkFormatCSV {
+		response.Header().Set(echo.HeaderContentType, "text/csv")
+	} else {
+		response.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	}
+	response.WriteHeader(http.StatusOK)
+	writer := bufio.NewWriter(response)
+	csvWriter := csv.NewWriter(writer)
+	encoder := json.NewEncoder(writer)
+	if format == bulkFormatCSV {
+		csvWriter.Write(bulkCSVColumns)
+	}
+	now := time.Now()
+	for _, shardid := range shardids {
+		entries := shardEntries[shardid]
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := entries[key]
+			if value.expired(now) {
+				continue
+			}
+			row := Bulk_Row{Key: key, Value: value.Data, Type: value.Type}
+			if value.Expires != 0 {
+				// Round up, so that a key about to expire is not exported without a ttl
+				row.TTL = int64(math.Ceil(float64(value.Expires-now.UnixMilli()) / 1000))
+			}
+			if format == bulkFormatCSV {
+				value := csvValue(row.Value)
+				ttl := ""
+				if row.TTL > 0 {
+					ttl = strconv.FormatInt(row.TTL, 10)
+				}
+				err = csvWriter.Write([]string{row.Key, value, row.Type, ttl})
+			} else {
+				err = encoder.Encode(row)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// Send each shard as soon as it is written
+		csvWriter.Flush()
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		response.Flush()
+	}
+	return nil
+}
+
+// Returns a value as a CSV field
+// Strings that would not be read back as JSON are written as they are, everything else as JSON
+func csvValue(value interface{}) string {
+	if text, ok := value.(string); ok && !json.Valid([]byte(text)) {
+		return text
+	}
+	jsonBytes, _ := json.Marshal(value)
+	return string(jsonBytes)
+}
+
+// Returns a copy of the key-value pairs of a shard, asking one of its members if needed
+func fetchShardEntries(shardid string) (map[string]Value, error) {
+	if shardid == MY_SHARD_ID {
+		KVSmutex.Lock()
+		defer KVSmutex.Unlock()
+		entries := make(map[string]Value, len(KVStore))
+		for key, value := range KVStore {
+			entries[key] = value
+		}
+		return entries, nil
+	}
+	client := peerClient(time.Duration(CONFIG.ReshardTimeout))
+	lastErr := fmt.Errorf("no members")
+	for _, address := range SHARDS[shardid] {
+		resp, err := client.Get(fmt.Sprintf("http://%s/sync", address))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var syncData Sync_Data
+		err = json.NewDecoder(resp.Body).Decode(&syncData)
+		drainAndClose(resp.Body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// The member may have been moved since the shard map was read
+		var shards map[string][]string
+		json.Unmarshal([]byte(syncData.ShardsString), &shards)
+		if !contains(shards[shardid], address) {
+			lastErr = fmt.Errorf("%s is no longer a member", address)
+			continue
+		}
+		var entries map[string]Value
+		if err := json.Unmarshal([]byte(syncData.KvsSync), &entries); err != nil {
+			lastErr = err
+			continue
+		}
+		return entries, nil
+	}
+	return nil, lastErr
+}
+
+// Reads rows of an import one at a time
+// next returns the reason a malformed row is skipped, or an error if the body cannot be read further
+type bulkReader struct {
+	next func() (row Bulk_Row, rowErr string, err error)
+}
+
+// Returns a reader of JSON lines or CSV with a header line
+func newBulkReader(format string, body io.Reader) (*bulkReader, error) {
+	if format == bulkFormatJSONL {
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		return &bulkReader{next: func() (Bulk_Row, string, error) {
+			var row Bulk_Row
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				// Blank lines are not rows
+				if line == "" {
+					continue
+				}
+				if err := json.Unmarshal([]byte(line), &row); err != nil {
+					return row, "Invalid JSON: " + err.Error(), nil
+				}
+				return row, "", nil
+			}
+			if err := scanner.Err(); err != nil {
+				return row, "", err
+			}
+			return row, "", io.EOF
+		}}, nil
+	}
+
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing CSV header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range bulkCSVColumns[:2] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV header has no %s column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	return &bulkReader{next: func() (Bulk_Row, string, error) {
+		var row Bulk_Row
+		record, err := reader.Read()
+		if err != nil {
+			// A malformed line is a row error; reading goes on with the next line
+			if parseErr, ok := err.(*csv.ParseError); ok {
+				return row, "Invalid CSV: " + parseErr.Err.Error(), nil
+			}
+			return row, "", err
+		}
+		row.Key = field(record, "key")
+		// Values are JSON if they parse as JSON, and strings otherwise
+		value := field(record, "value")
+		if err := json.Unmarshal([]byte(value), &row.Value); err != nil {
+			row.Value = value
+		}
+		row.Type = field(record, "type")
+		if ttl := strings.TrimSpace(field(record, "ttl")); ttl != "" {
+			if row.TTL, err = strconv.ParseInt(ttl, 10, 64); err != nil {
+				return row, "Invalid TTL " + strconv.Quote(ttl), nil
+			}
+		}
+		return row, "", nil
+	}}, nil
+}
+
+// Returns the reason a row cannot be imported, or "" if it can
+func checkImportRow(row Bulk_Row) string {
+	if row.Key == "" {
+		return "Row does not specify a key"
+	}
+	if len(row.Key) > CONFIG.MaxKeyLength {
+		return "Key is too long"
+	}
+	if row.Value == nil || row.Value == "" {
+		return "Row does not specify a value"
+	}
+	if row.TTL < 0 {
+		return "TTL must not be negative"
+	}
+	return ""
+}
+
+// POST /admin/import?format=<jsonl|csv>
+// Stores every row of the body in the shard that owns its key, sending the rows of each shard in batches
+// Streams JSON lines back: an error line for each row that was not imported, progress after each batch,
+// and a last line with the result or the error that stopped the import
+// Imported values replace existing ones without going through causal ordering,
+// so client writes are held back while each batch is stored
+func importKeys(c echo.Context) error {
+	format, err := bulkFormat(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; imports are disabled"})
+	}
+	if reshardInProgress() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A reshard is in progress"})
+	}
+	if len(SHARDS) == 0 {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "The cluster has no shards yet"})
+	}
+	reader, err := newBulkReader(format, c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	// Keep reading the body after progress has been sent; HTTP/1 servers close it on the first flush otherwise
+	http.NewResponseController(c.Response().Writer).EnableFullDuplex()
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	response.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(response)
+	report := func(line interface{}) {
+		encoder.Encode(line)
+		response.Flush()
+	}
+	fenceID := fmt.Sprintf("import-%x", time.Now().UnixNano())
+
+	var progress Import_Progress
+	keyCounts := make(map[string]int)
+	batches := make(map[string]map[string]Value)
+	flush := func(shardid string) error {
+		batch := batches[shardid]
+		if len(batch) == 0 {
+			return nil
+		}
+		if reshardInProgress() {
+			return fmt.Errorf("a reshard started during the import")
+		}
+		// Hold client writes back so that none of them is overwritten by the batch
+		viewMutex.Lock()
+		nodes := append([]string{}, CURRENT_VIEW...)
+		viewMutex.Unlock()
+		defer releaseWrites(fenceID, nodes)
+		cut, err := holdWrites(fenceID, nodes)
+		if err != nil {
+			return err
+		}
+		sent := false
+		for _, address := range SHARDS[shardid] {
+			if !contains(nodes, address) {
+				continue
+			}
+			if err := sendInBulk(address, batch, cut.ReturnVCString()); err != nil {
+				return fmt.Errorf("failed to send %s to %s: %v", shardid, address, err)
+			}
+			sent = true
+		}
+		if !sent {
+			return fmt.Errorf("no member of %s is in the view", shardid)
+		}
+		progress.Imported += len(batch)
+		keyCounts[shardid] += len(batch)
+		delete(batches, shardid)
+		report(map[string]Import_Progress{"progress": progress})
+		return nil
+	}
+	stop := func(err error) error {
+		report(map[string]interface{}{"error": "Import stopped: " + err.Error(), "rows": progress.Rows, "imported": progress.Imported, "failed": progress.Failed})
+		return nil
+	}
+
+	for {
+		row, reason, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stop(err)
+		}
+		progress.Rows++
+		if reason == "" {
+			reason = checkImportRow(row)
+		}
+		if reason != "" {
+			progress.Failed++
+			report(map[string]interface{}{"row": progress.Rows, "key": row.Key, "error": reason})
+			continue
+		}
+		shardid := locateShard(row.Key)
+		if batches[shardid] == nil {
+			batches[shardid] = make(map[string]Value)
+		}
+		value := Value{Data: row.Value, Type: row.Type}
+		// The expiry is stored with the value, so every member of the shard drops it at the same time
+		if row.TTL > 0 {
+			value.Expires = time.Now().Add(time.Duration(row.TTL) * time.Second).UnixMilli()
+		}
+		batches[shardid][row.Key] = value
+		if len(batches[shardid]) >= CONFIG.ReshardBatchSize {
+			if err := flush(shardid); err != nil {
+				return stop(err)
+			}
+		}
+	}
+	for shardid := range batches {
+		if err := flush(shardid); err != nil {
+			return stop(err)
+		}
+	}
+	fmt.Printf("Imported %d of %d rows\n", progress.Imported, progress.Rows)
+	report(map[string]interface{}{"result": "imported", "rows": progress.Rows, "imported": progress.Imported, "failed": progress.Failed, "key-counts": keyCounts})
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Imported values replace existing ones with a newer version, the same on every member of the shard
+func TestImportBumpsVersions(t *testing.T) {
+	cluster := startCluster(t, 2, 1)
+	node := cluster.nodes[0]
+
+	status, reply := kvsRequest(t, "PUT", node, "a", KVS_PUT_Request{Data: "1"})
+	if status != http.StatusCreated {
+		t.Fatalf("PUT a returned %d: %v", status, reply)
+	}
+	before := reply["version"].(float64)
+
+	resp, err := http.Post("http://"+node+"/admin/import?format=jsonl", "application/x-ndjson",
+		strings.NewReader(`{"key":"a","value":"2"}`+"\n"+`{"key":"b","value":"3"}`+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last map[string]interface{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		last = nil
+		json.Unmarshal(scanner.Bytes(), &last)
+	}
+	resp.Body.Close()
+	if last["result"] != "imported" || last["imported"] != float64(2) {
+		t.Fatalf("import ended with %v", last)
+	}
+
+	versions := make(map[string]float64)
+	for _, address := range cluster.nodes {
+		status, reply := kvsRequest(t, "GET", address, "a", KVS_GET_DELETE_Request{})
+		if status != http.StatusOK || reply["value"] != "2" {
+			t.Fatalf("GET a from %s returned %d: %v", address, status, reply)
+		}
+		versions[address] = reply["version"].(float64)
+		if versions[address] <= before {
+			t.Errorf("imported a has version %v on %s, not newer than %v", versions[address], address, before)
+		}
+	}
+	if versions[cluster.nodes[0]] != versions[cluster.nodes[1]] {
+		t.Errorf("imported a has different versions on the members of its shard: %v", versions)
+	}
+}
@@ -0,0 +1,397 @@
+// Package client is a Go client for kvs
+//
+// It caches the shard map of the cluster and sends every request straight to a member
+// of the shard that owns the key, failing over to the other members if one is down.
+// A Session carries causal metadata from one request to the next, so that a client
+// always reads its own writes without having to pass the metadata around itself.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of Options
+const (
+	defaultRequestTimeout  = 5 * time.Second
+	defaultRetryBackoff    = 10 * time.Millisecond
+	defaultMaxBackoff      = 500 * time.Millisecond
+	defaultMaxRetries      = 10
+	defaultRefreshInterval = 30 * time.Second
+)
+
+// Returned when the key does not exist
+var ErrNotFound = errors.New("kvs: key does not exist")
+
+// Returned when a conditional write finds another version of the key
+var ErrVersionMismatch = errors.New("kvs: version does not match")
+
+// Error is returned when a node rejects a request
+// It matches ErrNotFound and ErrVersionMismatch with errors.Is
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kvs: %s (status %d)", e.Message, e.StatusCode)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrVersionMismatch:
+		return e.StatusCode == http.StatusConflict
+	}
+	return false
+}
+
+// Options tune a Client; zero fields take their default
+type Options struct {
+	// Timeout of a single request to a node (default 5s)
+	RequestTimeout time.Duration
+	// Wait before retrying a request a node could not serve yet, doubled on every retry (default 10ms)
+	RetryBackoff time.Duration
+	// Longest wait between retries (default 500ms)
+	MaxBackoff time.Duration
+	// Retries of a request before its last error is returned (default 10)
+	MaxRetries int
+	// How long the shard map is used before it is fetched again (default 30s)
+	// It is also fetched again as soon as a request shows that it changed
+	RefreshInterval time.Duration
+	// Client used to talk to the nodes; one with pooled connections is created if nil
+	HTTPClient *http.Client
+}
+
+// Client sends requests to a kvs cluster
+// It is safe for concurrent use; requests made through it directly share one session
+type Client struct {
+	seeds   []string
+	opts    Options
+	http    *http.Client
+	session *Session
+
+	// Protects the fields below
+	mu      sync.Mutex
+	routing *routing
+	fetched time.Time
+	stale   bool
+	// Index of the member of each shard that requests go to first
+	preferred map[string]int
+
+	// Only one shard map fetch runs at a time
+	refreshMu sync.Mutex
+}
+
+// New returns a client for the cluster that nodes (IP:PORT) belong to
+// The shard map is fetched from any of them on the first request
+func New(nodes []string, opts *Options) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("kvs: no nodes given")
+	}
+	c := &Client{seeds: append([]string{}, nodes...), preferred: make(map[string]int)}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.RequestTimeout <= 0 {
+		c.opts.RequestTimeout = defaultRequestTimeout
+	}
+	if c.opts.RetryBackoff <= 0 {
+		c.opts.RetryBackoff = defaultRetryBackoff
+	}
+	if c.opts.MaxBackoff <= 0 {
+		c.opts.MaxBackoff = defaultMaxBackoff
+	}
+	if c.opts.MaxRetries <= 0 {
+		c.opts.MaxRetries = defaultMaxRetries
+	}
+	if c.opts.RefreshInterval <= 0 {
+		c.opts.RefreshInterval = defaultRefreshInterval
+	}
+	c.http = c.opts.HTTPClient
+	if c.http == nil {
+		c.http = &http.Client{Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: c.opts.RequestTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConnsPerHost: 64,
+			IdleConnTimeout:     90 * time.Second,
+		}}
+	}
+	c.session = c.NewSession()
+	return c, nil
+}
+
+// Get returns the value of key
+func (c *Client) Get(ctx context.Context, key string) (*Value, error) {
+	return c.session.Get(ctx, key)
+}
+
+// Put creates or replaces the value of key
+func (c *Client) Put(ctx context.Context, key string, value interface{}, opts ...PutOption) (*PutResult, error) {
+	return c.session.Put(ctx, key, value, opts...)
+}
+
+// Delete deletes key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.session.Delete(ctx, key)
+}
+
+// Shards returns the cached shard map, fetching it if there is none yet
+func (c *Client) Shards(ctx context.Context) (map[string][]string, error) {
+	r, err := c.currentRouting(ctx)
+	if err != nil {
+		return nil, err
+	}
+	shards := make(map[string][]string)
+	for shardid, nodes := range r.Shards {
+		shards[shardid] = append([]string{}, nodes...)
+	}
+	return shards, nil
+}
+
+// Refresh fetches the shard map again from any node
+func (c *Client) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	var lastErr error
+	for _, node := range c.knownNodes() {
+		r, err := c.fetchRouting(ctx, node)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		c.mu.Lock()
+		c.routing = r
+		c.fetched = time.Now()
+		c.stale = false
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("kvs: cannot fetch the shard map: %v", lastErr)
+}
+
+// Returns the members of every known shard, then the nodes given to New
+func (c *Client) knownNodes() []string {
+	seen := make(map[string]bool)
+	var nodes []string
+	c.mu.Lock()
+	if c.routing != nil {
+		for _, members := range c.routing.Shards {
+			for _, node := range members {
+				if !seen[node] {
+					seen[node] = true
+					nodes = append(nodes, node)
+				}
+			}
+		}
+	}
+	c.mu.Unlock()
+	for _, node := range c.seeds {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Fetch the routing state of the cluster from node
+func (c *Client) fetchRouting(ctx context.Context, node string) (*routing, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+node+"/shard/routing", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", node, resp.StatusCode)
+	}
+	var r routing
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("invalid shard map from %s: %v", node, err)
+	}
+	r.build()
+	return &r, nil
+}
+
+// Returns the cached routing state, fetching it again if it is missing, stale or old
+// A stale shard map is still used if no node can be reached
+func (c *Client) currentRouting(ctx context.Context) (*routing, error) {
+	c.mu.Lock()
+	r := c.routing
+	fresh := r != nil && !c.stale && time.Since(c.fetched) < c.opts.RefreshInterval
+	c.mu.Unlock()
+	if fresh {
+		return r, nil
+	}
+	if err := c.Refresh(ctx); err != nil {
+		if r != nil {
+			return r, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.routing, nil
+}
+
+// Fetch the shard map again before the next request
+func (c *Client) markStale() {
+	c.mu.Lock()
+	c.stale = true
+	c.mu.Unlock()
+}
+
+// Returns the nodes to try for a request to shardid, in order
+// Conditional writes go to the first member, which checks them for the whole shard
+func (c *Client) candidates(r *routing, shardid string, primary bool) []string {
+	members := r.Shards[shardid]
+	if len(members) == 0 {
+		// Any node forwards the request to the right shard
+		return c.knownNodes()
+	}
+	start := 0
+	if !primary {
+		c.mu.Lock()
+		start = c.preferred[shardid] % len(members)
+		c.mu.Unlock()
+	}
+	nodes := make([]string, 0, len(members))
+	for i := range members {
+		nodes = append(nodes, members[(start+i)%len(members)])
+	}
+	return nodes
+}
+
+// Send later requests for shardid to node first
+func (c *Client) prefer(r *routing, shardid string, node string) {
+	for i, member := range r.Shards[shardid] {
+		if member == node {
+			c.mu.Lock()
+			c.preferred[shardid] = i
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Returns true if a node answered 503 for a reason that goes away by itself
+func retryLater(reply map[string]interface{}) bool {
+	message, _ := reply["error"].(string)
+	return strings.Contains(message, "Causal dependencies not satisfied") ||
+		strings.Contains(message, "Resharding in progress") ||
+		strings.Contains(message, "Backup in progress")
+}
+
+// Send a request for key to its shard, retrying with backoff until a node gives a final answer
+// body returns the JSON body of every attempt, so that it carries the latest causal metadata
+func (c *Client) do(ctx context.Context, method string, key string, body func() map[string]interface{}, primary bool) (int, map[string]interface{}, error) {
+	backoff := c.opts.RetryBackoff
+	var lastErr error
+	for attempt := 0; attempt <= c.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return 0, nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > c.opts.MaxBackoff {
+				backoff = c.opts.MaxBackoff
+			}
+		}
+		r, err := c.currentRouting(ctx)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		shardid := r.locate(key)
+		jsonData, _ := json.Marshal(body())
+		status, reply, node, err := c.tryNodes(ctx, c.candidates(r, shardid, primary), method, key, jsonData)
+		if err != nil {
+			// No member of the shard answered; it may have moved
+			lastErr = err
+			c.markStale()
+			continue
+		}
+		if !primary {
+			c.prefer(r, shardid, node)
+		}
+		// The node had to forward the request, so the shard map changed since it was fetched
+		if answered, _ := reply["shard-id"].(string); answered != "" && shardid != "" && answered != shardid {
+			c.markStale()
+		}
+		if status == http.StatusServiceUnavailable {
+			message, _ := reply["error"].(string)
+			lastErr = &Error{StatusCode: status, Message: message}
+			if !retryLater(reply) && !primary {
+				// Try another member, e.g. if this one is in a minority partition
+				c.mu.Lock()
+				c.preferred[shardid]++
+				c.mu.Unlock()
+			}
+			continue
+		}
+		return status, reply, nil
+	}
+	return 0, nil, lastErr
+}
+
+// Send the request to each node in turn until one answers
+// Returns the status, decoded reply and address of the node that answered
+func (c *Client) tryNodes(ctx context.Context, nodes []string, method string, key string, jsonData []byte) (int, map[string]interface{}, string, error) {
+	var lastErr error
+	for _, node := range nodes {
+		status, reply, err := c.send(ctx, node, method, key, jsonData)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		return status, reply, node, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("kvs: no nodes to send the request to")
+	}
+	return 0, nil, "", lastErr
+}
+
+// Send a single request for key to node
+func (c *Client) send(ctx context.Context, node string, method string, key string, jsonData []byte) (int, map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+node+"/kvs/"+url.PathEscape(key), bytes.NewReader(jsonData))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	var reply map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return 0, nil, fmt.Errorf("invalid reply from %s: %v", node, err)
+	}
+	return resp.StatusCode, reply, nil
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A cluster of fake nodes that keep their keys in one map
+type fakeCluster struct {
+	mu      sync.Mutex
+	routing routing
+	values  map[string]interface{}
+	version map[string]uint64
+	// Requests for keys and fetches of the shard map received by every node
+	requests map[string][]string
+	fetches  int
+	// Causal metadata of the last request for a key
+	causal string
+	clock  uint64
+}
+
+// Start a fake node and return its address
+// Every node answers for every key as if it forwarded the request to the shard that owns it
+func (fc *fakeCluster) startNode(t *testing.T) string {
+	var address string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		if r.URL.Path == "/shard/routing" {
+			fc.fetches++
+			json.NewEncoder(w).Encode(fc.routing)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/kvs/")
+		fc.requests[address] = append(fc.requests[address], r.Method+" "+key)
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		fc.causal, _ = body["causal-metadata"].(string)
+		fc.clock++
+		reply := map[string]interface{}{"shard-id": fc.routing.locate(key), "causal-metadata": fmt.Sprintf(`{"%s":%d}`, address, fc.clock)}
+		status := http.StatusOK
+		_, exists := fc.values[key]
+		switch {
+		case !exists && r.Method != http.MethodPut:
+			status, reply["error"] = http.StatusNotFound, "Key does not exist"
+		case r.Method == http.MethodGet:
+			reply["value"], reply["version"] = fc.values[key], fc.version[key]
+		case r.Method == http.MethodDelete:
+			delete(fc.values, key)
+		case body["if-version"] != nil && uint64(body["if-version"].(float64)) != fc.version[key]:
+			status, reply["error"] = http.StatusConflict, "Version does not match"
+		default:
+			if !exists {
+				status = http.StatusCreated
+			}
+			fc.values[key] = body["value"]
+			fc.version[key]++
+			reply["version"] = fc.version[key]
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(reply)
+	}))
+	t.Cleanup(server.Close)
+	address = strings.TrimPrefix(server.URL, "http://")
+	return address
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{values: make(map[string]interface{}), version: make(map[string]uint64), requests: make(map[string][]string)}
+}
+
+// Returns an address nothing listens on
+func deadNode(t *testing.T) string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Two shards split at "m", with one node each
+func startRangeCluster(t *testing.T) (*fakeCluster, string, string) {
+	fc := newFakeCluster()
+	node0, node1 := fc.startNode(t), fc.startNode(t)
+	fc.routing = routing{
+		Partitioner: partitionerRange,
+		Shards:      map[string][]string{"shard0": {node0}, "shard1": {node1}},
+		Ranges:      []keyRange{{Start: "", End: "m", Shard: "shard0"}, {Start: "m", End: "", Shard: "shard1"}},
+	}
+	return fc, node0, node1
+}
+
+func TestRequestsGoToTheOwningShard(t *testing.T) {
+	fc, node0, node1 := startRangeCluster(t)
+	c, err := New([]string{node1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if result, err := c.Put(ctx, "apple", "red"); err != nil || !result.Created || result.ShardID != "shard0" {
+		t.Fatalf("put apple returned %v, %v", result, err)
+	}
+	if _, err := c.Put(ctx, "zebra", "striped"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "apple"); err != nil || value.Data != "red" || value.Version != 1 {
+		t.Fatalf("get apple returned %v, %v", value, err)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if got := strings.Join(fc.requests[node0], ","); got != "PUT apple,GET apple" {
+		t.Errorf("shard0 received %s", got)
+	}
+	if got := strings.Join(fc.requests[node1], ","); got != "PUT zebra" {
+		t.Errorf("shard1 received %s", got)
+	}
+	if fc.fetches != 1 {
+		t.Errorf("shard map was fetched %d times", fc.fetches)
+	}
+}
+
+// Every request of a session carries the causal metadata of the replies before it
+func TestSessionCarriesCausalMetadata(t *testing.T) {
+	fc, node0, node1 := startRangeCluster(t)
+	c, _ := New([]string{node0}, nil)
+	s := c.NewSession()
+	ctx := context.Background()
+	s.Put(ctx, "apple", "red")
+	s.Put(ctx, "zebra", "striped")
+	s.Get(ctx, "apple")
+
+	var clock map[string]uint64
+	fc.mu.Lock()
+	json.Unmarshal([]byte(fc.causal), &clock)
+	fc.mu.Unlock()
+	if clock[node0] != 1 || clock[node1] != 2 {
+		t.Errorf("last request carried causal metadata %v", clock)
+	}
+	if other := c.NewSession(); other.CausalMetadata() != "" {
+		t.Errorf("new session has causal metadata %s", other.CausalMetadata())
+	}
+}
+
+func TestFailover(t *testing.T) {
+	fc, node0, _ := startRangeCluster(t)
+	fc.routing.Shards["shard0"] = []string{deadNode(t), node0}
+	c, _ := New([]string{node0}, &Options{RequestTimeout: time.Second})
+	ctx := context.Background()
+	if _, err := c.Put(ctx, "apple", "red"); err != nil {
+		t.Fatalf("put with the first member down: %v", err)
+	}
+	if value, err := c.Get(ctx, "apple"); err != nil || value.Data != "red" {
+		t.Fatalf("get with the first member down returned %v, %v", value, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, node0, _ := startRangeCluster(t)
+	c, _ := New([]string{node0}, nil)
+	ctx := context.Background()
+	if _, err := c.Get(ctx, "apple"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get of a missing key returned %v", err)
+	}
+	c.Put(ctx, "apple", "red")
+	if _, err := c.Put(ctx, "apple", "green", IfVersion(5)); !errors.Is(err, ErrVersionMismatch) || errors.Is(err, ErrNotFound) {
+		t.Errorf("put with the wrong version returned %v", err)
+	}
+	if _, err := New(nil, nil); err == nil {
+		t.Error("created a client without nodes")
+	}
+}
+
+// A reply from another shard than expected means the shard map changed
+func TestRefreshAfterForward(t *testing.T) {
+	fc, node0, node1 := startRangeCluster(t)
+	c, _ := New([]string{node0}, nil)
+	ctx := context.Background()
+	c.Put(ctx, "apple", "red")
+
+	// Every key moved to shard1
+	fc.mu.Lock()
+	fc.routing.Ranges = []keyRange{{Start: "", End: "", Shard: "shard1"}}
+	fc.mu.Unlock()
+	c.Get(ctx, "apple")
+	c.Get(ctx, "apple")
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.fetches != 2 {
+		t.Errorf("shard map was fetched %d times", fc.fetches)
+	}
+	if got := fc.requests[node1]; len(got) != 1 || got[0] != "GET apple" {
+		t.Errorf("shard1 received %v", got)
+	}
+}
+
+func TestLocateWithOverrides(t *testing.T) {
+	r := routing{
+		Shards: map[string][]string{"shard0": {"a"}, "shard1": {"b"}},
+		Ring:   ringConfig{PartitionCount: 7, ReplicationFactor: 20, Load: 1.25},
+	}
+	r.build()
+	for partID := 0; partID < r.Ring.PartitionCount; partID++ {
+		if owner := r.hashRing.GetPartitionOwner(partID).String(); owner == "shard0" {
+			if r.Overrides == nil {
+				r.Overrides = make(map[int]string)
+			}
+			r.Overrides[partID] = "shard1"
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if shardid := r.locate(fmt.Sprintf("key%d", i)); shardid != "shard1" {
+			t.Fatalf("key%d is in %s", i, shardid)
+		}
+	}
+}
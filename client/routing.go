@@ -0,0 +1,84 @@
+package client
+
+import (
+	"sort"
+
+	"github.com/buraksezer/consistent"
+	"github.com/cespare/xxhash"
+)
+
+// Partitioner that maps sorted key ranges to shards; every other value means hash partitioning
+const partitionerRange = "range"
+
+// Routing state of the cluster as returned by GET /shard/routing
+type routing struct {
+	Partitioner string              `json:"partitioner"`
+	Shards      map[string][]string `json:"shards"`
+	Ring        ringConfig          `json:"ring"`
+	Overrides   map[int]string      `json:"overrides"`
+	Ranges      []keyRange          `json:"ranges"`
+	hashRing    *consistent.Consistent
+}
+
+// Parameters of the consistent hash ring
+type ringConfig struct {
+	PartitionCount    int     `json:"partition-count"`
+	ReplicationFactor int     `json:"replication-factor"`
+	Load              float64 `json:"load"`
+}
+
+// Keys from Start (inclusive) to End (exclusive) owned by Shard
+type keyRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Shard string `json:"shard"`
+}
+
+type member string
+
+func (m member) String() string {
+	return string(m)
+}
+
+type hasher struct{}
+
+func (h hasher) Sum64(data []byte) uint64 {
+	return xxhash.Sum64(data)
+}
+
+// Build the hash ring the same way the nodes do
+func (r *routing) build() {
+	if r.Partitioner == partitionerRange || len(r.Shards) == 0 {
+		return
+	}
+	r.hashRing = consistent.New(nil, consistent.Config{
+		PartitionCount:    r.Ring.PartitionCount,
+		ReplicationFactor: r.Ring.ReplicationFactor,
+		Load:              r.Ring.Load,
+		Hasher:            hasher{},
+	})
+	for shardid := range r.Shards {
+		r.hashRing.Add(member(shardid))
+	}
+}
+
+// Returns the shard that owns key, or "" if the cluster has no shards yet
+// Must give the same answer as locateShardIn on the nodes
+func (r *routing) locate(key string) string {
+	if r.Partitioner == partitionerRange {
+		// The first range starts at "", so every key is in some range
+		i := sort.Search(len(r.Ranges), func(i int) bool { return r.Ranges[i].Start > key }) - 1
+		if i < 0 {
+			return ""
+		}
+		return r.Ranges[i].Shard
+	}
+	if r.hashRing == nil {
+		return ""
+	}
+	partID := r.hashRing.FindPartitionID([]byte(key))
+	if shardid, ok := r.Overrides[partID]; ok {
+		return shardid
+	}
+	return r.hashRing.GetPartitionOwner(partID).String()
+}
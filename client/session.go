@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Session tracks the writes a client has seen, so that later requests see at least those writes
+// It is safe for concurrent use, but requests of one session are only ordered if they are made one by one
+type Session struct {
+	client *Client
+	mu     sync.Mutex
+	// Vector clock of the writes seen so far, by node address
+	clock map[string]uint64
+}
+
+// Value of a key
+type Value struct {
+	Data interface{}
+	// Number of writes to the key since it was created
+	Version uint64
+	Flags   uint32
+	ShardID string
+}
+
+// Result of a write
+type PutResult struct {
+	// True if the key did not exist before
+	Created bool
+	Version uint64
+	ShardID string
+}
+
+// PutOption changes a write
+type PutOption func(fields map[string]interface{})
+
+// WithFlags stores opaque client flags with the value
+func WithFlags(flags uint32) PutOption {
+	return func(fields map[string]interface{}) {
+		fields["flags"] = flags
+	}
+}
+
+// IfVersion only writes if the key has the given version; 0 means it must not exist
+// The write fails with ErrVersionMismatch otherwise
+func IfVersion(version uint64) PutOption {
+	return func(fields map[string]interface{}) {
+		fields["if-version"] = version
+	}
+}
+
+// IfExists only writes if the key exists; the write fails with ErrNotFound otherwise
+func IfExists() PutOption {
+	return func(fields map[string]interface{}) {
+		fields["if-exists"] = true
+	}
+}
+
+// NewSession returns a session that has not seen any writes
+func (c *Client) NewSession() *Session {
+	return &Session{client: c, clock: make(map[string]uint64)}
+}
+
+// CausalMetadata returns the causal metadata of the session as used by the HTTP API
+func (s *Session) CausalMetadata() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clock) == 0 {
+		return ""
+	}
+	jsonBytes, _ := json.Marshal(s.clock)
+	return string(jsonBytes)
+}
+
+// Merge causal metadata seen elsewhere, e.g. by another session or an HTTP client, into the session
+func (s *Session) Merge(causalMetadata string) error {
+	if causalMetadata == "" {
+		return nil
+	}
+	var clock map[string]uint64
+	if err := json.Unmarshal([]byte(causalMetadata), &clock); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for node, count := range clock {
+		if count > s.clock[node] {
+			s.clock[node] = count
+		}
+	}
+	return nil
+}
+
+// Returns a function that builds the request body with the current causal metadata
+func (s *Session) body(fields map[string]interface{}) func() map[string]interface{} {
+	return func() map[string]interface{} {
+		body := map[string]interface{}{"causal-metadata": s.CausalMetadata()}
+		for name, value := range fields {
+			body[name] = value
+		}
+		return body
+	}
+}
+
+// Send a request through the client and keep the causal metadata of the reply
+func (s *Session) do(ctx context.Context, method string, key string, fields map[string]interface{}, primary bool) (int, map[string]interface{}, error) {
+	status, reply, err := s.client.do(ctx, method, key, s.body(fields), primary)
+	if err != nil {
+		return 0, nil, err
+	}
+	if metadata, ok := reply["causal-metadata"].(string); ok {
+		s.Merge(metadata)
+	}
+	return status, reply, nil
+}
+
+// Returns the error of a reply that is not a success
+func replyError(status int, reply map[string]interface{}) error {
+	message, _ := reply["error"].(string)
+	return &Error{StatusCode: status, Message: message}
+}
+
+// Returns the uint64 field of a reply, such as its version
+func replyUint(reply map[string]interface{}, field string) uint64 {
+	number, _ := reply[field].(float64)
+	return uint64(number)
+}
+
+// Get returns the value of key
+func (s *Session) Get(ctx context.Context, key string) (*Value, error) {
+	status, reply, err := s.do(ctx, http.MethodGet, key, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, replyError(status, reply)
+	}
+	shardid, _ := reply["shard-id"].(string)
+	return &Value{
+		Data:    reply["value"],
+		Version: replyUint(reply, "version"),
+		Flags:   uint32(replyUint(reply, "flags")),
+		ShardID: shardid,
+	}, nil
+}
+
+// Put creates or replaces the value of key
+func (s *Session) Put(ctx context.Context, key string, value interface{}, opts ...PutOption) (*PutResult, error) {
+	fields := map[string]interface{}{"value": value}
+	for _, opt := range opts {
+		opt(fields)
+	}
+	_, hasVersion := fields["if-version"]
+	_, mustExist := fields["if-exists"]
+	status, reply, err := s.do(ctx, http.MethodPut, key, fields, hasVersion || mustExist)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return nil, replyError(status, reply)
+	}
+	shardid, _ := reply["shard-id"].(string)
+	return &PutResult{Created: status == http.StatusCreated, Version: replyUint(reply, "version"), ShardID: shardid}, nil
+}
+
+// Delete deletes key
+func (s *Session) Delete(ctx context.Context, key string) error {
+	status, reply, err := s.do(ctx, http.MethodDelete, key, nil, false)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return replyError(status, reply)
+	}
+	return nil
+}
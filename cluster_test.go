@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Node binary built once for every test that runs a cluster
+var (
+	nodeBinaryOnce sync.Once
+	nodeBinary     string
+	nodeBinaryErr  error
+)
+
+// A cluster of nodes running as separate processes on this host
+// Every node keeps its state in package globals, so nodes cannot share a test process
+type testCluster struct {
+	t     *testing.T
+	nodes []string
+	procs map[string]*exec.Cmd
+	logs  map[string]*bytes.Buffer
+	// Protects the log buffers, which the processes write to
+	logMutex sync.Mutex
+}
+
+// Writes to a log buffer of the cluster
+type lockedWriter struct {
+	mutex  *sync.Mutex
+	buffer *bytes.Buffer
+}
+
+func (w lockedWriter) Write(b []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buffer.Write(b)
+}
+
+// Build the node binary, once per test run
+func buildNode(t *testing.T) string {
+	nodeBinaryOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "kvs-test")
+		if err != nil {
+			nodeBinaryErr = err
+			return
+		}
+		nodeBinary = filepath.Join(dir, "kvs")
+		out, err := exec.Command("go", "build", "-o", nodeBinary, ".").CombinedOutput()
+		if err != nil {
+			nodeBinaryErr = fmt.Errorf("%v\n%s", err, out)
+		}
+	})
+	if nodeBinaryErr != nil {
+		t.Fatalf("failed to build node: %v", nodeBinaryErr)
+	}
+	return nodeBinary
+}
+
+// Returns count addresses on this host that nothing listens on
+func freeAddresses(t *testing.T, count int) []string {
+	var addresses []string
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, listener)
+		addresses = append(addresses, listener.Addr().String())
+	}
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	return addresses
+}
+
+// Start count nodes split into shardCount shards and wait until all of them answer
+// env is added to the environment of every node, e.g. KVS_HEARTBEAT_INTERVAL=500ms
+func startCluster(t *testing.T, count int, shardCount int, env ...string) *testCluster {
+	if testing.Short() {
+		t.Skip("runs a cluster of nodes")
+	}
+	cluster := &testCluster{t: t, nodes: freeAddresses(t, count), procs: make(map[string]*exec.Cmd), logs: make(map[string]*bytes.Buffer)}
+	t.Cleanup(cluster.stop)
+	view := strings.Join(cluster.nodes, ",")
+	for _, address := range cluster.nodes {
+		cluster.startNode(address, append([]string{"VIEW=" + view, fmt.Sprintf("SHARD_COUNT=%d", shardCount)}, env...)...)
+	}
+	for _, address := range cluster.nodes {
+		cluster.waitUntilUp(address)
+	}
+	return cluster
+}
+
+// Start a node at address with env added to its environment, without waiting for it
+func (tc *testCluster) startNode(address string, env ...string) {
+	cmd := exec.Command(buildNode(tc.t))
+	cmd.Env = append(os.Environ(), "SOCKET_ADDRESS="+address)
+	cmd.Env = append(cmd.Env, env...)
+	tc.logMutex.Lock()
+	tc.logs[address] = &bytes.Buffer{}
+	cmd.Stdout = lockedWriter{&tc.logMutex, tc.logs[address]}
+	tc.logMutex.Unlock()
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		tc.t.Fatal(err)
+	}
+	tc.procs[address] = cmd
+}
+
+// Start a node that is not part of any cluster yet and wait until it answers
+func (tc *testCluster) addNode(env ...string) string {
+	address := freeAddresses(tc.t, 1)[0]
+	tc.nodes = append(tc.nodes, address)
+	tc.startNode(address, env...)
+	tc.waitUntilUp(address)
+	return address
+}
+
+// Kill the node at address
+func (tc *testCluster) kill(address string) {
+	cmd := tc.procs[address]
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// Wait until the node at address answers
+func (tc *testCluster) waitUntilUp(address string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get("http://" + address + "/view")
+		if err == nil {
+			resp.Body.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	tc.t.Fatalf("node %s did not start", address)
+}
+
+// Kill every node, printing their logs if the test failed
+func (tc *testCluster) stop() {
+	for _, cmd := range tc.procs {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	if tc.t.Failed() {
+		tc.logMutex.Lock()
+		defer tc.logMutex.Unlock()
+		for _, address := range tc.nodes {
+			log := tc.logs[address].String()
+			// The end of the log is what explains a failure
+			if len(log) > 8000 {
+				log = log[len(log)-8000:]
+			}
+			tc.t.Logf("log of %s:\n%s", address, log)
+		}
+	}
+}
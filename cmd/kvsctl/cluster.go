@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often reshard-status -watch polls the job
+const watchInterval = time.Second
+
+// Print a {"result": ...} reply of an admin endpoint
+func printResult(reply map[string]interface{}) error {
+	if JSON_OUTPUT {
+		return printJSON(reply)
+	}
+	var details []string
+	for _, name := range sortedKeys(reply) {
+		if name != "result" {
+			details = append(details, fmt.Sprintf("%s=%v", name, reply[name]))
+		}
+	}
+	fmt.Println(strings.TrimSpace(fmt.Sprintf("%v %s", reply["result"], strings.Join(details, " "))))
+	return nil
+}
+
+// Returns the nodes in the view
+func fetchView(ctx context.Context) ([]string, error) {
+	var reply struct {
+		View []string `json:"view"`
+	}
+	if err := call(ctx, "GET", "view", nil, &reply); err != nil {
+		return nil, err
+	}
+	return reply.View, nil
+}
+
+func runView(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 0, "none"); err != nil {
+		return err
+	}
+	view, err := fetchView(ctx)
+	if err != nil {
+		return err
+	}
+	if JSON_OUTPUT {
+		return printJSON(map[string][]string{"view": view})
+	}
+	for _, node := range view {
+		fmt.Println(node)
+	}
+	return nil
+}
+
+// A shard with its members and number of keys
+type shardInfo struct {
+	ID       string   `json:"shard-id"`
+	Members  []string `json:"members"`
+	KeyCount int      `json:"key-count"`
+	// Set instead of KeyCount if the shard could not be asked
+	Error string `json:"error,omitempty"`
+}
+
+func runShards(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 0, "none"); err != nil {
+		return err
+	}
+	var routing struct {
+		Partitioner string              `json:"partitioner"`
+		Shards      map[string][]string `json:"shards"`
+	}
+	if err := call(ctx, "GET", "shard/routing", nil, &routing); err != nil {
+		return err
+	}
+	shards := make([]shardInfo, 0, len(routing.Shards))
+	for _, shardid := range sortedKeys(routing.Shards) {
+		info := shardInfo{ID: shardid, Members: routing.Shards[shardid]}
+		var reply struct {
+			Count int `json:"shard-key-count"`
+		}
+		if err := call(ctx, "GET", "shard/key-count/"+url.PathEscape(shardid), nil, &reply); err != nil {
+			info.Error = err.Error()
+		}
+		info.KeyCount = reply.Count
+		shards = append(shards, info)
+	}
+	if JSON_OUTPUT {
+		return printJSON(map[string]interface{}{"partitioner": routing.Partitioner, "shards": shards})
+	}
+	rows := make([][]string, 0, len(shards))
+	for _, info := range shards {
+		count := strconv.Itoa(info.KeyCount)
+		if info.Error != "" {
+			count = "? (" + info.Error + ")"
+		}
+		rows = append(rows, []string{info.ID, count, strings.Join(info.Members, ",")})
+	}
+	printTable([]string{"SHARD", "KEYS", "MEMBERS"}, rows)
+	return nil
+}
+
+// Vector clock of one node
+type nodeClock struct {
+	Node        string            `json:"node"`
+	ShardID     string            `json:"shard-id"`
+	VectorClock map[string]uint64 `json:"vector-clock"`
+	// Set instead of the clock if the node could not be asked
+	Error string `json:"error,omitempty"`
+}
+
+func runClocks(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 0, "none"); err != nil {
+		return err
+	}
+	view, err := fetchView(ctx)
+	if err != nil {
+		return err
+	}
+	clocks := make([]nodeClock, 0, len(view))
+	positions := make(map[string]bool)
+	for _, node := range view {
+		clock := nodeClock{Node: node}
+		if err := callNodes(ctx, []string{node}, "GET", "admin/vector-clock", nil, &clock); err != nil {
+			clock.Error = err.Error()
+		}
+		for position := range clock.VectorClock {
+			positions[position] = true
+		}
+		clocks = append(clocks, clock)
+	}
+	if JSON_OUTPUT {
+		return printJSON(clocks)
+	}
+	// One column per position of the clocks, in order
+	columns := sortedKeys(positions)
+	header := append([]string{"NODE", "SHARD"}, columns...)
+	rows := make([][]string, 0, len(clocks))
+	for _, clock := range clocks {
+		row := []string{clock.Node, clock.ShardID}
+		if clock.Error != "" {
+			rows = append(rows, append(row, clock.Error))
+			continue
+		}
+		for _, position := range columns {
+			row = append(row, strconv.FormatUint(clock.VectorClock[position], 10))
+		}
+		rows = append(rows, row)
+	}
+	printTable(header, rows)
+	return nil
+}
+
+// Parse a shard count argument
+func parseShardCount(arg string) (int, error) {
+	count, err := strconv.Atoi(arg)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid shard count %q", arg)
+	}
+	return count, nil
+}
+
+func runReshard(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 1, "COUNT"); err != nil {
+		return err
+	}
+	count, err := parseShardCount(args[0])
+	if err != nil {
+		return err
+	}
+	var reply map[string]interface{}
+	if err := call(ctx, "PUT", "shard/reshard", map[string]int{"shard-count": count}, &reply); err != nil {
+		return err
+	}
+	return printResult(reply)
+}
+
+func runReshardPlan(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 1, "COUNT"); err != nil {
+		return err
+	}
+	count, err := parseShardCount(args[0])
+	if err != nil {
+		return err
+	}
+	var plan struct {
+		Shards     map[string][]string `json:"shards"`
+		KeyCounts  map[string]int      `json:"key-counts"`
+		Migrations []struct {
+			From  string `json:"from"`
+			To    string `json:"to"`
+			Keys  int    `json:"keys"`
+			Bytes int    `json:"bytes"`
+		} `json:"migrations"`
+		KeysMoving  int `json:"keys-moving"`
+		BytesMoving int `json:"bytes-moving"`
+	}
+	var raw json.RawMessage
+	if err := call(ctx, "GET", "shard/reshard-plan?shard-count="+strconv.Itoa(count), nil, &raw); err != nil {
+		return err
+	}
+	if JSON_OUTPUT {
+		return printJSON(raw)
+	}
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(plan.Shards))
+	for _, shardid := range sortedKeys(plan.Shards) {
+		rows = append(rows, []string{shardid, strconv.Itoa(plan.KeyCounts[shardid]), strings.Join(plan.Shards[shardid], ",")})
+	}
+	printTable([]string{"SHARD", "KEYS", "MEMBERS"}, rows)
+	fmt.Println()
+	rows = rows[:0]
+	for _, migration := range plan.Migrations {
+		rows = append(rows, []string{migration.From, migration.To, strconv.Itoa(migration.Keys), strconv.Itoa(migration.Bytes)})
+	}
+	printTable([]string{"FROM", "TO", "KEYS", "BYTES"}, rows)
+	fmt.Printf("\n%d keys (%d bytes) would move\n", plan.KeysMoving, plan.BytesMoving)
+	return nil
+}
+
+// Progress of a reshard job as returned by GET /shard/reshard/<job-id>
+type reshardJob struct {
+	ID          string `json:"id"`
+	Coordinator string `json:"coordinator"`
+	ShardCount  int    `json:"shard-count"`
+	Phase       string `json:"phase"`
+	State       string `json:"state"`
+	Error       string `json:"error"`
+	Progress    map[string]struct {
+		Members   []string `json:"members"`
+		Completed []string `json:"completed"`
+		KeysSent  int      `json:"keys-sent"`
+	} `json:"progress"`
+	Updated time.Time `json:"updated"`
+}
+
+func printReshardJob(job reshardJob, raw json.RawMessage) error {
+	if JSON_OUTPUT {
+		return printJSON(raw)
+	}
+	fmt.Printf("job %s: %s, phase %q, %d shards, coordinated by %s, updated %s\n",
+		job.ID, job.State, job.Phase, job.ShardCount, job.Coordinator, job.Updated.Format(time.RFC3339))
+	if job.Error != "" {
+		fmt.Printf("error: %s\n", job.Error)
+	}
+	rows := make([][]string, 0, len(job.Progress))
+	for _, shardid := range sortedKeys(job.Progress) {
+		progress := job.Progress[shardid]
+		rows = append(rows, []string{
+			shardid,
+			fmt.Sprintf("%d/%d", len(progress.Completed), len(progress.Members)),
+			strconv.Itoa(progress.KeysSent),
+		})
+	}
+	if len(rows) > 0 {
+		printTable([]string{"SHARD", "MEMBERS DONE", "KEYS SENT"}, rows)
+	}
+	return nil
+}
+
+func runReshardStatus(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reshard-status", flag.ExitOnError)
+	watch := flags.Bool("watch", false, "print the job again every second until it is no longer running")
+	flags.Parse(args)
+	if err := wantArgs(flags.Args(), 1, "JOB"); err != nil {
+		return err
+	}
+	for {
+		var raw json.RawMessage
+		if err := call(ctx, "GET", "shard/reshard/"+url.PathEscape(flags.Arg(0)), nil, &raw); err != nil {
+			return err
+		}
+		var job reshardJob
+		if err := json.Unmarshal(raw, &job); err != nil {
+			return err
+		}
+		if err := printReshardJob(job, raw); err != nil {
+			return err
+		}
+		if !*watch || job.State != "running" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(watchInterval):
+		}
+		fmt.Println()
+	}
+}
+
+// Returns a command that resumes or rolls back a reshard job
+func runReshardAction(action string) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		if err := wantArgs(args, 1, "JOB"); err != nil {
+			return err
+		}
+		var reply map[string]interface{}
+		if err := call(ctx, "PUT", "shard/reshard/"+url.PathEscape(args[0])+"/"+action, nil, &reply); err != nil {
+			return err
+		}
+		return printResult(reply)
+	}
+}
+
+// PUT {"socket-address": NODE} to path
+func putNode(ctx context.Context, path string, node string) error {
+	var reply map[string]interface{}
+	if err := call(ctx, "PUT", path, map[string]string{"socket-address": node}, &reply); err != nil {
+		return err
+	}
+	return printResult(reply)
+}
+
+func runAddMember(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 2, "SHARD NODE"); err != nil {
+		return err
+	}
+	return putNode(ctx, "shard/add-member/"+url.PathEscape(args[0]), args[1])
+}
+
+func runMoveMember(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 2, "SHARD NODE"); err != nil {
+		return err
+	}
+	return putNode(ctx, "shard/move-member/"+url.PathEscape(args[0]), args[1])
+}
+
+func runDecommission(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 1, "NODE"); err != nil {
+		return err
+	}
+	// The node being removed is not asked to coordinate its own removal if another node answers
+	nodes := make([]string, 0, len(NODES))
+	for _, node := range NODES {
+		if node != args[0] {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		nodes = NODES
+	}
+	var reply map[string]interface{}
+	if err := callNodes(ctx, nodes, "PUT", "admin/decommission", map[string]string{"socket-address": args[0]}, &reply); err != nil {
+		return err
+	}
+	return printResult(reply)
+}
+
+func runReplaceNode(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 2, "OLD NEW"); err != nil {
+		return err
+	}
+	var reply map[string]interface{}
+	if err := call(ctx, "PUT", "admin/replace-node", map[string]string{"old": args[0], "new": args[1]}, &reply); err != nil {
+		return err
+	}
+	return printResult(reply)
+}
+
+func runBackup(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 0, "none"); err != nil {
+		return err
+	}
+	var reply map[string]interface{}
+	if err := call(ctx, "POST", "admin/backup", nil, &reply); err != nil {
+		return err
+	}
+	if JSON_OUTPUT {
+		return printJSON(reply)
+	}
+	fmt.Printf("backup %v written to %v with %v keys\n", reply["backup-id"], reply["path"], reply["keys"])
+	return nil
+}
+
+func runRestoreBackup(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 1, "ID"); err != nil {
+		return err
+	}
+	var reply map[string]interface{}
+	if err := call(ctx, "POST", "admin/restore", map[string]string{"backup-id": args[0]}, &reply); err != nil {
+		return err
+	}
+	return printResult(reply)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRunView(t *testing.T) {
+	NODES = []string{startNode(t, http.StatusOK, `{"view": ["10.0.0.1:8090", "10.0.0.2:8090"]}`)}
+	JSON_OUTPUT = false
+	if out := captureOutput(t, func() error { return runView(context.Background(), nil) }); out != "10.0.0.1:8090\n10.0.0.2:8090\n" {
+		t.Errorf("view printed %q", out)
+	}
+	JSON_OUTPUT = true
+	defer func() { JSON_OUTPUT = false }()
+	if out := captureOutput(t, func() error { return runView(context.Background(), nil) }); !strings.Contains(out, `"view": [`) {
+		t.Errorf("view -json printed %q", out)
+	}
+	if err := runView(context.Background(), []string{"extra"}); err == nil {
+		t.Error("view accepted an argument")
+	}
+}
+
+func TestParseShardCount(t *testing.T) {
+	if count, err := parseShardCount("3"); err != nil || count != 3 {
+		t.Errorf("parsed 3 as %d, %v", count, err)
+	}
+	for _, arg := range []string{"0", "-1", "two"} {
+		if _, err := parseShardCount(arg); err == nil {
+			t.Errorf("parsed %q", arg)
+		}
+	}
+}
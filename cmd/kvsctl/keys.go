@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"webservice/client"
+)
+
+// One key-value pair of a dump
+type dumpEntry struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Flags uint32      `json:"flags,omitempty"`
+}
+
+// Returns a session that has seen the writes of -causal-metadata
+func newSession() (*client.Session, error) {
+	session := CLIENT.NewSession()
+	if err := session.Merge(CAUSAL_METADATA); err != nil {
+		return nil, fmt.Errorf("invalid causal metadata: %v", err)
+	}
+	return session, nil
+}
+
+// Format a value for a table cell; strings are printed as they are
+func formatValue(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	jsonBytes, _ := json.Marshal(value)
+	return string(jsonBytes)
+}
+
+func runGet(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 1, "KEY"); err != nil {
+		return err
+	}
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	value, err := session.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if JSON_OUTPUT {
+		return printJSON(map[string]interface{}{
+			"key":             args[0],
+			"value":           value.Data,
+			"version":         value.Version,
+			"flags":           value.Flags,
+			"shard-id":        value.ShardID,
+			"causal-metadata": session.CausalMetadata(),
+		})
+	}
+	fmt.Println(formatValue(value.Data))
+	return nil
+}
+
+func runPut(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 2, "KEY VALUE"); err != nil {
+		return err
+	}
+	// Values that are not valid JSON are stored as strings
+	var value interface{}
+	if err := json.Unmarshal([]byte(args[1]), &value); err != nil {
+		value = args[1]
+	}
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	result, err := session.Put(ctx, args[0], value)
+	if err != nil {
+		return err
+	}
+	if JSON_OUTPUT {
+		return printJSON(map[string]interface{}{
+			"key":             args[0],
+			"created":         result.Created,
+			"version":         result.Version,
+			"shard-id":        result.ShardID,
+			"causal-metadata": session.CausalMetadata(),
+		})
+	}
+	action := "updated"
+	if result.Created {
+		action = "created"
+	}
+	fmt.Printf("%s %s in shard %s (version %d)\n", action, args[0], result.ShardID, result.Version)
+	return nil
+}
+
+func runDelete(ctx context.Context, args []string) error {
+	if err := wantArgs(args, 1, "KEY"); err != nil {
+		return err
+	}
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	if err := session.Delete(ctx, args[0]); err != nil {
+		return err
+	}
+	if JSON_OUTPUT {
+		return printJSON(map[string]interface{}{"key": args[0], "result": "deleted", "causal-metadata": session.CausalMetadata()})
+	}
+	fmt.Printf("deleted %s\n", args[0])
+	return nil
+}
+
+// A key found by a scan
+type scanEntry struct {
+	Key   string      `json:"key"`
+	Shard string      `json:"shard-id"`
+	Size  int         `json:"size"`
+	Value interface{} `json:"value,omitempty"`
+	Flags uint32      `json:"flags,omitempty"`
+}
+
+// Returns every key with prefix in order, with the shard that stores it and its size
+func scanKeys(ctx context.Context, prefix string) ([]scanEntry, error) {
+	shards, err := CLIENT.Shards(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var entries []scanEntry
+	for shardid := range shards {
+		var reply struct {
+			KeySizes map[string]int `json:"key-sizes"`
+		}
+		if err := call(ctx, "GET", "shard/key-sizes/"+url.PathEscape(shardid), nil, &reply); err != nil {
+			return nil, fmt.Errorf("shard %s: %v", shardid, err)
+		}
+		for key, size := range reply.KeySizes {
+			if strings.HasPrefix(key, prefix) {
+				entries = append(entries, scanEntry{Key: key, Shard: shardid, Size: size})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// Fill in the value of every entry, dropping keys deleted since the scan
+func fetchValues(ctx context.Context, session *client.Session, entries []scanEntry) ([]scanEntry, error) {
+	found := entries[:0]
+	for _, entry := range entries {
+		value, err := session.Get(ctx, entry.Key)
+		if errors.Is(err, client.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Key, err)
+		}
+		entry.Value = value.Data
+		entry.Flags = value.Flags
+		found = append(found, entry)
+	}
+	return found, nil
+}
+
+func runScan(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only list keys that start with this")
+	values := flags.Bool("values", false, "also print the value of every key")
+	flags.Parse(args)
+	entries, err := scanKeys(ctx, *prefix)
+	if err != nil {
+		return err
+	}
+	if *values {
+		session, err := newSession()
+		if err != nil {
+			return err
+		}
+		if entries, err = fetchValues(ctx, session, entries); err != nil {
+			return err
+		}
+	}
+	if JSON_OUTPUT {
+		if entries == nil {
+			entries = []scanEntry{}
+		}
+		return printJSON(entries)
+	}
+	header := []string{"KEY", "SHARD", "SIZE"}
+	if *values {
+		header = append(header, "VALUE")
+	}
+	rows := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		row := []string{entry.Key, entry.Shard, strconv.Itoa(entry.Size)}
+		if *values {
+			row = append(row, formatValue(entry.Value))
+		}
+		rows = append(rows, row)
+	}
+	printTable(header, rows)
+	return nil
+}
+
+func runDump(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	output := flags.String("o", "-", "file to write to, - for standard output")
+	flags.Parse(args)
+	entries, err := scanKeys(ctx, "")
+	if err != nil {
+		return err
+	}
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	if entries, err = fetchValues(ctx, session, entries); err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := bufio.NewWriter(out)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(dumpEntry{Key: entry.Key, Value: entry.Value, Flags: entry.Flags}); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "dumped %d keys to %s\n", len(entries), *output)
+	}
+	return nil
+}
+
+func runRestore(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := flags.String("i", "-", "file to read from, - for standard input")
+	flags.Parse(args)
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	session, err := newSession()
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(in)
+	restored := 0
+	for {
+		var entry dumpEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("entry %d: %v", restored+1, err)
+		}
+		if entry.Key == "" || entry.Value == nil {
+			return fmt.Errorf("entry %d: key and value are required", restored+1)
+		}
+		if _, err := session.Put(ctx, entry.Key, entry.Value, client.WithFlags(entry.Flags)); err != nil {
+			return fmt.Errorf("%s: %v", entry.Key, err)
+		}
+		restored++
+	}
+	if JSON_OUTPUT {
+		return printJSON(map[string]interface{}{"restored": restored, "causal-metadata": session.CausalMetadata()})
+	}
+	fmt.Printf("restored %d keys\n", restored)
+	return nil
+}
+
+// Returns the format of a bulk command, guessing it from the file name if not given
+func bulkFormat(format string, file string) string {
+	if format == "" {
+		format = "jsonl"
+		if strings.HasSuffix(file, ".csv") {
+			format = "csv"
+		}
+	}
+	return format
+}
+
+func runImport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "jsonl or csv; guessed from the file name if not given")
+	flags.Parse(args)
+	if err := wantArgs(flags.Args(), 1, "FILE"); err != nil {
+		return err
+	}
+	file := flags.Arg(0)
+	open := func() (io.ReadCloser, error) {
+		if file == "-" {
+			return io.NopCloser(os.Stdin), nil
+		}
+		return os.Open(file)
+	}
+	resp, err := stream(ctx, "POST", "admin/import?format="+bulkFormat(*format, file), "application/octet-stream", open)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The node reports row errors and progress as it goes, and the result last
+	decoder := json.NewDecoder(resp.Body)
+	var last map[string]interface{}
+	// Progress is printed over itself, so other lines must start on a new line
+	progressShown := false
+	endProgress := func() {
+		if progressShown {
+			fmt.Fprintln(os.Stderr)
+			progressShown = false
+		}
+	}
+	for {
+		var line map[string]interface{}
+		if err := decoder.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("import interrupted: %v", err)
+		}
+		last = line
+		switch {
+		case JSON_OUTPUT:
+			printJSON(line)
+		case line["row"] != nil:
+			endProgress()
+			if key, ok := line["key"].(string); ok && key != "" {
+				fmt.Fprintf(os.Stderr, "row %v (key %s): %v\n", line["row"], key, line["error"])
+			} else {
+				fmt.Fprintf(os.Stderr, "row %v: %v\n", line["row"], line["error"])
+			}
+		case line["progress"] != nil:
+			progress, _ := line["progress"].(map[string]interface{})
+			fmt.Fprintf(os.Stderr, "\r%v rows read, %v imported, %v failed", progress["rows"], progress["imported"], progress["failed"])
+			progressShown = true
+		}
+	}
+	endProgress()
+	if last == nil {
+		return fmt.Errorf("import interrupted")
+	}
+	if message, ok := last["error"].(string); ok {
+		return errors.New(message)
+	}
+	if !JSON_OUTPUT {
+		fmt.Printf("imported %v of %v rows (%v failed)\n", last["imported"], last["rows"], last["failed"])
+	}
+	return nil
+}
+
+func runExport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "", "jsonl or csv; guessed from the file name if not given")
+	prefix := flags.String("prefix", "", "only export keys that start with this")
+	output := flags.String("o", "-", "file to write to, - for standard output")
+	flags.Parse(args)
+	query := url.Values{"format": {bulkFormat(*format, *output)}, "prefix": {*prefix}}
+	noBody := func() (io.ReadCloser, error) { return http.NoBody, nil }
+	resp, err := stream(ctx, "GET", "admin/export?"+query.Encode(), "application/json", noBody)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestBulkFormat(t *testing.T) {
+	tests := []struct{ format, file, want string }{
+		{"", "keys.csv", "csv"},
+		{"", "keys.jsonl", "jsonl"},
+		{"", "-", "jsonl"},
+		{"jsonl", "keys.csv", "jsonl"},
+	}
+	for _, test := range tests {
+		if got := bulkFormat(test.format, test.file); got != test.want {
+			t.Errorf("bulkFormat(%q, %q) = %q, want %q", test.format, test.file, got, test.want)
+		}
+	}
+}
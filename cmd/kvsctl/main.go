@@ -0,0 +1,257 @@
+// Command kvsctl operates a kvs cluster
+//
+// Usage:
+//
+//	kvsctl [-nodes IP:PORT,...] [-json] [-timeout DURATION] <command> [arguments]
+//
+// Run kvsctl without a command to list the commands.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"webservice/client"
+)
+
+// A kvsctl command
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+// Nodes requests are sent to, in order
+var NODES []string
+
+// Print JSON instead of tables
+var JSON_OUTPUT bool
+
+// Client for the key commands
+var CLIENT *client.Client
+
+// Causal metadata to start the session of the key commands from
+var CAUSAL_METADATA string
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"get", "KEY", "print the value of a key", runGet},
+		{"put", "KEY VALUE", "set a key; VALUE is parsed as JSON if it can be, otherwise stored as a string", runPut},
+		{"delete", "KEY", "delete a key", runDelete},
+		{"scan", "[-prefix P] [-values]", "list the keys of every shard in order", runScan},
+		{"dump", "[-o FILE]", "write every key-value pair as JSON lines", runDump},
+		{"restore", "[-i FILE]", "put every key-value pair of a dump", runRestore},
+		{"import", "[-format jsonl|csv] FILE", "load JSON lines or CSV (key, value, type, ttl) through a node, - for standard input", runImport},
+		{"export", "[-format jsonl|csv] [-prefix P] [-o FILE]", "write every key-value pair as JSON lines or CSV", runExport},
+		{"backup", "", "write a consistent backup of every shard to the backup directory of a node", runBackup},
+		{"restore-backup", "ID", "load a backup from the backup directory of a node into the current shards", runRestoreBackup},
+		{"view", "", "print the view", runView},
+		{"shards", "", "print the shard map with the number of keys of each shard", runShards},
+		{"clocks", "", "print the vector clock of every node in the view", runClocks},
+		{"reshard", "COUNT", "reshard into COUNT shards and wait for it to finish", runReshard},
+		{"reshard-plan", "COUNT", "print what a reshard into COUNT shards would move", runReshardPlan},
+		{"reshard-status", "[-watch] JOB", "print the progress of a reshard job", runReshardStatus},
+		{"reshard-resume", "JOB", "continue an interrupted reshard job", runReshardAction("resume")},
+		{"reshard-rollback", "JOB", "abort an interrupted reshard job", runReshardAction("rollback")},
+		{"add-member", "SHARD NODE", "add a node that is in no shard to a shard", runAddMember},
+		{"move-member", "SHARD NODE", "move a node from its shard to another", runMoveMember},
+		{"replace-node", "OLD NEW", "put NEW in the shard slot of the dead node OLD", runReplaceNode},
+		{"decommission", "NODE", "take a node out of its shard and the view", runDecommission},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: kvsctl [flags] <command> [arguments]\n\nFlags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nCommands:\n")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.usage)
+	}
+	w.Flush()
+}
+
+func main() {
+	nodes := flag.String("nodes", envOr("KVSCTL_NODES", "localhost:8090"), "comma separated nodes to send requests to (env KVSCTL_NODES)")
+	timeout := flag.Duration("timeout", time.Minute, "give up on the command after this long")
+	flag.BoolVar(&JSON_OUTPUT, "json", false, "print JSON instead of tables")
+	flag.StringVar(&CAUSAL_METADATA, "causal-metadata", "", "causal metadata of an earlier command, to read at least its writes")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	for _, node := range strings.Split(*nodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			NODES = append(NODES, node)
+		}
+	}
+	var err error
+	if CLIENT, err = client.New(NODES, nil); err != nil {
+		fail(err)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		err := cmd.run(ctx, flag.Args()[1:])
+		cancel()
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "kvsctl: unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "kvsctl: %v\n", err)
+	os.Exit(1)
+}
+
+// Returns an error unless args has exactly count arguments
+func wantArgs(args []string, count int, names string) error {
+	if len(args) != count {
+		return fmt.Errorf("expected arguments: %s", names)
+	}
+	return nil
+}
+
+// Send a request to the first node that answers and decode its JSON reply into out
+// Replies other than 2xx are returned as errors with the message of the node
+func call(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	return callNodes(ctx, NODES, method, path, body, out)
+}
+
+// Send a request to the first of nodes that answers, see call
+func callNodes(ctx context.Context, nodes []string, method string, path string, body interface{}, out interface{}) error {
+	var jsonData []byte
+	if body != nil {
+		jsonData, _ = json.Marshal(body)
+	}
+	var lastErr error
+	for _, node := range nodes {
+		req, err := http.NewRequestWithContext(ctx, method, "http://"+node+"/"+path, bytes.NewReader(jsonData))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			var reply map[string]interface{}
+			json.Unmarshal(respBody, &reply)
+			if message, ok := reply["error"].(string); ok {
+				// Failed reshards name their job so that it can be resumed or rolled back
+				if jobID, ok := reply["job-id"].(string); ok {
+					message += "; job " + jobID
+				}
+				return fmt.Errorf("%s (status %d)", message, resp.StatusCode)
+			}
+			return fmt.Errorf("%s returned status %d", node, resp.StatusCode)
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(respBody, out)
+	}
+	return fmt.Errorf("no node answered: %v", lastErr)
+}
+
+// Send a request with a streamed body to the first node that answers and return the response
+// open is called for every attempt so that each one sends the whole body
+// Replies other than 2xx are returned as errors like by call
+func stream(ctx context.Context, method string, path string, contentType string, open func() (io.ReadCloser, error)) (*http.Response, error) {
+	var lastErr error
+	for _, node := range NODES {
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, "http://"+node+"/"+path, body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			defer resp.Body.Close()
+			var reply map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&reply)
+			if message, ok := reply["error"].(string); ok {
+				return nil, fmt.Errorf("%s (status %d)", message, resp.StatusCode)
+			}
+			return nil, fmt.Errorf("%s returned status %d", node, resp.StatusCode)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no node answered: %v", lastErr)
+}
+
+// Print v as indented JSON
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// Print rows under a header as an aligned table
+func printTable(header []string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+// Returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Start a node that answers every request with status and body, and return its address
+func startNode(t *testing.T, status int, body string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Returns an address nothing listens on
+func deadNode(t *testing.T) string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Returns what run printed to standard output
+func captureOutput(t *testing.T, run func() error) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	err = run()
+	os.Stdout = stdout
+	writer.Close()
+	out, _ := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestCallNodes(t *testing.T) {
+	ctx := context.Background()
+	up := startNode(t, http.StatusOK, `{"view": ["a", "b"]}`)
+	var reply struct {
+		View []string `json:"view"`
+	}
+	if err := callNodes(ctx, []string{deadNode(t), up}, "GET", "view", nil, &reply); err != nil || len(reply.View) != 2 {
+		t.Errorf("call with the first node down returned %v, %v", reply, err)
+	}
+	if err := callNodes(ctx, []string{deadNode(t)}, "GET", "view", nil, nil); err == nil || !strings.Contains(err.Error(), "no node answered") {
+		t.Errorf("call with every node down returned %v", err)
+	}
+
+	// The message of a node is returned as it is, with the job of a failed reshard
+	failed := startNode(t, http.StatusInternalServerError, `{"error": "Reshard failed", "job-id": "reshard-1"}`)
+	if err := callNodes(ctx, []string{failed, up}, "PUT", "shard/reshard", nil, nil); err == nil || err.Error() != "Reshard failed; job reshard-1 (status 500)" {
+		t.Errorf("failed call returned %v", err)
+	}
+	broken := startNode(t, http.StatusBadGateway, "not json")
+	if err := callNodes(ctx, []string{broken}, "GET", "view", nil, nil); err == nil || !strings.Contains(err.Error(), "returned status 502") {
+		t.Errorf("call answered without JSON returned %v", err)
+	}
+}
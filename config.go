@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Effective configuration of this node
+var CONFIG = defaultConfig()
+
+// Config holds every tunable of a node
+// Values are loaded from defaults, then the config file, then KVS_* env vars, then flags
+type Config struct {
+	HeartbeatInterval    Duration `yaml:"heartbeat-interval" json:"heartbeat-interval"`
+	HeartbeatTimeout     Duration `yaml:"heartbeat-timeout" json:"heartbeat-timeout"`
+	SendTimeout          Duration `yaml:"send-timeout" json:"send-timeout"`
+	SendRetryInterval    Duration `yaml:"send-retry-interval" json:"send-retry-interval"`
+	SendMaxRetries       int      `yaml:"send-max-retries" json:"send-max-retries"`
+	SendMaxBackoff       Duration `yaml:"send-max-backoff" json:"send-max-backoff"`
+	SendToAnyTimeout     Duration `yaml:"send-to-any-timeout" json:"send-to-any-timeout"`
+	PartitionCount       int      `yaml:"partition-count" json:"partition-count"`
+	ReplicationFactor    int      `yaml:"replication-factor" json:"replication-factor"`
+	Load                 float64  `yaml:"load" json:"load"`
+	MaxKeyLength         int      `yaml:"max-key-length" json:"max-key-length"`
+	MinNodesPerShard     int      `yaml:"min-nodes-per-shard" json:"min-nodes-per-shard"`
+	PartitionMode        string   `yaml:"partition-mode" json:"partition-mode"`
+	ReshardTimeout       Duration `yaml:"reshard-timeout" json:"reshard-timeout"`
+	ReshardBatchSize     int      `yaml:"reshard-batch-size" json:"reshard-batch-size"`
+	DataDir              string   `yaml:"data-dir" json:"data-dir"`
+	BackupDir            string   `yaml:"backup-dir" json:"backup-dir"`
+	BackupTimeout        Duration `yaml:"backup-timeout" json:"backup-timeout"`
+	FailureDomain        string   `yaml:"failure-domain" json:"failure-domain"`
+	Partitioner          string   `yaml:"partitioner" json:"partitioner"`
+	RangeSplitKeys       int      `yaml:"range-split-keys" json:"range-split-keys"`
+	RangeMergeKeys       int      `yaml:"range-merge-keys" json:"range-merge-keys"`
+	RangeCheckInterval   Duration `yaml:"range-check-interval" json:"range-check-interval"`
+	RebalanceInterval    Duration `yaml:"rebalance-interval" json:"rebalance-interval"`
+	RebalanceThreshold   float64  `yaml:"rebalance-threshold" json:"rebalance-threshold"`
+	RebalanceMinRequests float64  `yaml:"rebalance-min-requests" json:"rebalance-min-requests"`
+	RebalanceMaxKeys     int      `yaml:"rebalance-max-keys" json:"rebalance-max-keys"`
+	Transport            string   `yaml:"transport" json:"transport"`
+	PeerMaxConns         int      `yaml:"peer-max-conns" json:"peer-max-conns"`
+	PeerIdleTimeout      Duration `yaml:"peer-idle-timeout" json:"peer-idle-timeout"`
+	PeerKeepAlive        Duration `yaml:"peer-keep-alive" json:"peer-keep-alive"`
+	RedisAddress         string   `yaml:"redis-address" json:"redis-address"`
+	MemcachedAddress     string   `yaml:"memcached-address" json:"memcached-address"`
+	GRPCAddress          string   `yaml:"grpc-address" json:"grpc-address"`
+	TraceOutput          string   `yaml:"trace-output" json:"trace-output"`
+	ExpirySweepInterval  Duration `yaml:"expiry-sweep-interval" json:"expiry-sweep-interval"`
+	ShardCount           int      `yaml:"shard-count" json:"shard-count"`
+}
+
+// Duration is a time.Duration written as "5s" in config files, env vars, flags and JSON
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.Set(node.Value)
+}
+
+// Flag values for the remaining config field types
+type intValue struct{ p *int }
+
+func (v intValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v.p = n
+	return nil
+}
+
+type stringValue struct{ p *string }
+
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+type floatValue struct{ p *float64 }
+
+func (v floatValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v.p, 'g', -1, 64)
+}
+
+func (v floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v.p = f
+	return nil
+}
+
+// configOption describes a tunable that can be set through an env var or a flag
+type configOption struct {
+	name  string
+	usage string
+	value func(cfg *Config) flag.Value
+}
+
+var configOptions = []configOption{
+	{"heartbeat-interval", "time between heartbeat rounds", func(cfg *Config) flag.Value { return &cfg.HeartbeatInterval }},
+	{"heartbeat-timeout", "timeout of a single heartbeat request", func(cfg *Config) flag.Value { return &cfg.HeartbeatTimeout }},
+	{"send-timeout", "timeout of replication requests", func(cfg *Config) flag.Value { return &cfg.SendTimeout }},
+	{"send-retry-interval", "time to wait before retrying a replication request", func(cfg *Config) flag.Value { return &cfg.SendRetryInterval }},
+	{"send-max-retries", "number of times a replication request a replica keeps rejecting is retried", func(cfg *Config) flag.Value { return intValue{&cfg.SendMaxRetries} }},
+	{"send-max-backoff", "longest time to wait before retrying a replication request to an unreachable node", func(cfg *Config) flag.Value { return &cfg.SendMaxBackoff }},
+	{"send-to-any-timeout", "timeout of requests sent to any node of a list", func(cfg *Config) flag.Value { return &cfg.SendToAnyTimeout }},
+	{"partition-count", "number of partitions in the hash ring", func(cfg *Config) flag.Value { return intValue{&cfg.PartitionCount} }},
+	{"replication-factor", "number of virtual nodes per shard in the hash ring", func(cfg *Config) flag.Value { return intValue{&cfg.ReplicationFactor} }},
+	{"load", "maximum load of a shard relative to the average", func(cfg *Config) flag.Value { return floatValue{&cfg.Load} }},
+	{"max-key-length", "maximum length of a key", func(cfg *Config) flag.Value { return intValue{&cfg.MaxKeyLength} }},
+	{"min-nodes-per-shard", "minimum number of nodes in every shard", func(cfg *Config) flag.Value { return intValue{&cfg.MinNodesPerShard} }},
+	{"partition-mode", "behavior in a minority partition: causal-only or read-only", func(cfg *Config) flag.Value { return stringValue{&cfg.PartitionMode} }},
+	{"reshard-timeout", "timeout of a single reshard phase or key transfer", func(cfg *Config) flag.Value { return &cfg.ReshardTimeout }},
+	{"reshard-batch-size", "number of keys sent per transfer request while resharding", func(cfg *Config) flag.Value { return intValue{&cfg.ReshardBatchSize} }},
+	{"data-dir", "directory where reshard jobs are persisted (optional)", func(cfg *Config) flag.Value { return stringValue{&cfg.DataDir} }},
+	{"backup-dir", "directory where backup archives are written and restored from (optional)", func(cfg *Config) flag.Value { return stringValue{&cfg.BackupDir} }},
+	{"backup-timeout", "longest time a backup or restore holds client writes back", func(cfg *Config) flag.Value { return &cfg.BackupTimeout }},
+	{"failure-domain", "label of the rack or host of this node, used to spread shard members (optional)", func(cfg *Config) flag.Value { return stringValue{&cfg.FailureDomain} }},
+	{"partitioner", "how keys are mapped to shards: hash or range; must be the same on every node", func(cfg *Config) flag.Value { return stringValue{&cfg.Partitioner} }},
+	{"range-split-keys", "split a key range holding more keys than this", func(cfg *Config) flag.Value { return intValue{&cfg.RangeSplitKeys} }},
+	{"range-merge-keys", "merge neighboring key ranges holding fewer keys than this together", func(cfg *Config) flag.Value { return intValue{&cfg.RangeMergeKeys} }},
+	{"range-check-interval", "time between checks of the key range sizes", func(cfg *Config) flag.Value { return &cfg.RangeCheckInterval }},
+	{"rebalance-interval", "time between partition moves; load counters are halved every interval", func(cfg *Config) flag.Value { return &cfg.RebalanceInterval }},
+	{"rebalance-threshold", "move partitions off a shard whose load exceeds the average by this factor; 0 disables", func(cfg *Config) flag.Value { return floatValue{&cfg.RebalanceThreshold} }},
+	{"rebalance-min-requests", "load below which a shard is never considered hot", func(cfg *Config) flag.Value { return floatValue{&cfg.RebalanceMinRequests} }},
+	{"rebalance-max-keys", "maximum number of keys moved with a single partition", func(cfg *Config) flag.Value { return intValue{&cfg.RebalanceMaxKeys} }},
+	{"transport", "protocol used between nodes: binary or http; must be the same on every node", func(cfg *Config) flag.Value { return stringValue{&cfg.Transport} }},
+	{"peer-max-conns", "maximum number of HTTP connections to every other node", func(cfg *Config) flag.Value { return intValue{&cfg.PeerMaxConns} }},
+	{"peer-idle-timeout", "time an unused HTTP connection to another node is kept open", func(cfg *Config) flag.Value { return &cfg.PeerIdleTimeout }},
+	{"peer-keep-alive", "interval of TCP keep-alive probes on connections to other nodes", func(cfg *Config) flag.Value { return &cfg.PeerKeepAlive }},
+	{"redis-address", "address of the Redis protocol listener, e.g. :6379 (optional)", func(cfg *Config) flag.Value { return stringValue{&cfg.RedisAddress} }},
+	{"memcached-address", "address of the memcached protocol listener, e.g. :11211 (optional)", func(cfg *Config) flag.Value { return stringValue{&cfg.MemcachedAddress} }},
+	{"grpc-address", "address of the gRPC listener, e.g. :9090 (optional)", func(cfg *Config) flag.Value { return stringValue{&cfg.GRPCAddress} }},
+	{"trace-output", "where spans are written: stdout or a file path; tracing is off if empty", func(cfg *Config) flag.Value { return stringValue{&cfg.TraceOutput} }},
+	{"shard-count", "number of shards of a new cluster started from VIEW; also read from SHARD_COUNT (optional)", func(cfg *Config) flag.Value { return intValue{&cfg.ShardCount} }},
+	{"expiry-sweep-interval", "time between deletions of expired keys; they read as missing in between", func(cfg *Config) flag.Value { return &cfg.ExpirySweepInterval }},
+}
+
+// Returns the built-in defaults
+func defaultConfig() Config {
+	return Config{
+		HeartbeatInterval:    Duration(time.Second),
+		HeartbeatTimeout:     Duration(5 * time.Second),
+		SendTimeout:          Duration(time.Second),
+		SendRetryInterval:    Duration(time.Second),
+		SendMaxRetries:       60,
+		SendMaxBackoff:       Duration(10 * time.Second),
+		SendToAnyTimeout:     Duration(time.Second),
+		PartitionCount:       11,
+		ReplicationFactor:    5,
+		Load:                 1.10,
+		MaxKeyLength:         50,
+		MinNodesPerShard:     2,
+		PartitionMode:        partitionModeCausalOnly,
+		ReshardTimeout:       Duration(10 * time.Second),
+		ReshardBatchSize:     500,
+		BackupTimeout:        Duration(30 * time.Second),
+		Partitioner:          partitionerHash,
+		RangeSplitKeys:       10000,
+		RangeMergeKeys:       1000,
+		RangeCheckInterval:   Duration(10 * time.Second),
+		RebalanceInterval:    Duration(30 * time.Second),
+		RebalanceThreshold:   0,
+		RebalanceMinRequests: 100,
+		RebalanceMaxKeys:     5000,
+		Transport:            transportBinary,
+		PeerMaxConns:         64,
+		PeerIdleTimeout:      Duration(90 * time.Second),
+		PeerKeepAlive:        Duration(30 * time.Second),
+		ExpirySweepInterval:  Duration(time.Second),
+	}
+}
+
+// Build the configuration from defaults, the config file, env vars and command line flags
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	// Flags are parsed first to find the config file, but applied last
+	flagValues := make(map[string]string)
+	fs := flag.NewFlagSet("kvs", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("KVS_CONFIG"), "path to a YAML config file")
+	for _, option := range configOptions {
+		name := option.name
+		fs.Func(name, option.usage+" (default "+option.value(&cfg).String()+")", func(s string) error {
+			flagValues[name] = s
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// Config file
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed to parse config file: %v", err)
+		}
+	}
+
+	// SHARD_COUNT predates the KVS_ prefix, so KVS_SHARD_COUNT overrides it
+	if s, ok := os.LookupEnv("SHARD_COUNT"); ok {
+		if err := (intValue{&cfg.ShardCount}).Set(s); err != nil {
+			return cfg, fmt.Errorf("invalid value %q for SHARD_COUNT: %v", s, err)
+		}
+	}
+
+	// Env overrides, e.g. KVS_HEARTBEAT_TIMEOUT=2s
+	for _, option := range configOptions {
+		env := "KVS_" + strings.ToUpper(strings.ReplaceAll(option.name, "-", "_"))
+		if s, ok := os.LookupEnv(env); ok {
+			if err := option.value(&cfg).Set(s); err != nil {
+				return cfg, fmt.Errorf("invalid value %q for %s: %v", s, env, err)
+			}
+		}
+	}
+
+	// Flag overrides
+	for _, option := range configOptions {
+		if s, ok := flagValues[option.name]; ok {
+			if err := option.value(&cfg).Set(s); err != nil {
+				return cfg, fmt.Errorf("invalid value %q for -%s: %v", s, option.name, err)
+			}
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+// Check that every value is usable
+func (cfg Config) validate() error {
+	durations := map[string]Duration{
+		"heartbeat-interval":    cfg.HeartbeatInterval,
+		"heartbeat-timeout":     cfg.HeartbeatTimeout,
+		"send-timeout":          cfg.SendTimeout,
+		"send-retry-interval":   cfg.SendRetryInterval,
+		"send-max-backoff":      cfg.SendMaxBackoff,
+		"send-to-any-timeout":   cfg.SendToAnyTimeout,
+		"reshard-timeout":       cfg.ReshardTimeout,
+		"range-check-interval":  cfg.RangeCheckInterval,
+		"rebalance-interval":    cfg.RebalanceInterval,
+		"peer-idle-timeout":     cfg.PeerIdleTimeout,
+		"peer-keep-alive":       cfg.PeerKeepAlive,
+		"backup-timeout":        cfg.BackupTimeout,
+		"expiry-sweep-interval": cfg.ExpirySweepInterval,
+	}
+	for name, d := range durations {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if cfg.SendMaxRetries < 0 {
+		return fmt.Errorf("send-max-retries must not be negative")
+	}
+	if cfg.PartitionCount < 1 {
+		return fmt.Errorf("partition-count must be at least 1")
+	}
+	if cfg.ReplicationFactor < 1 {
+		return fmt.Errorf("replication-factor must be at least 1")
+	}
+	if cfg.Load <= 1.0 {
+		return fmt.Errorf("load must be greater than 1.0")
+	}
+	if cfg.ShardCount < 0 {
+		return fmt.Errorf("shard-count must not be negative")
+	}
+	// Nodes started with a shard count build a hash ring with that many shards right away
+	if cfg.ShardCount > 0 {
+		ring := Ring_Config{PartitionCount: cfg.PartitionCount, ReplicationFactor: cfg.ReplicationFactor, Load: cfg.Load}
+		if err := checkRingCapacity(ring, cfg.ShardCount); err != nil {
+			return fmt.Errorf("partition-count is too small for shard-count: %v", err)
+		}
+	}
+	if cfg.MaxKeyLength < 1 {
+		return fmt.Errorf("max-key-length must be at least 1")
+	}
+	if cfg.MinNodesPerShard < 1 {
+		return fmt.Errorf("min-nodes-per-shard must be at least 1")
+	}
+	if cfg.ReshardBatchSize < 1 {
+		return fmt.Errorf("reshard-batch-size must be at least 1")
+	}
+	if cfg.Partitioner != partitionerHash && cfg.Partitioner != partitionerRange {
+		return fmt.Errorf("partitioner must be %s or %s", partitionerHash, partitionerRange)
+	}
+	// Halves of a split range must not be merged right back
+	if cfg.RangeSplitKeys < 2 || cfg.RangeMergeKeys < 0 || cfg.RangeMergeKeys > cfg.RangeSplitKeys/2 {
+		return fmt.Errorf("range-split-keys must be at least 2 and range-merge-keys between 0 and half of it")
+	}
+	if cfg.Transport != transportBinary && cfg.Transport != transportHTTP {
+		return fmt.Errorf("transport must be %s or %s", transportBinary, transportHTTP)
+	}
+	if cfg.PeerMaxConns < 1 {
+		return fmt.Errorf("peer-max-conns must be at least 1")
+	}
+	if cfg.RebalanceThreshold != 0 && cfg.RebalanceThreshold <= 1.0 {
+		return fmt.Errorf("rebalance-threshold must be 0 or greater than 1.0")
+	}
+	if cfg.RebalanceMinRequests < 0 || cfg.RebalanceMaxKeys < 1 {
+		return fmt.Errorf("rebalance-min-requests must not be negative and rebalance-max-keys must be at least 1")
+	}
+	if cfg.DataDir != "" {
+		if info, err := os.Stat(cfg.DataDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("data-dir %s is not a directory", cfg.DataDir)
+		}
+	}
+	if cfg.BackupDir != "" {
+		if info, err := os.Stat(cfg.BackupDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("backup-dir %s is not a directory", cfg.BackupDir)
+		}
+	}
+	if cfg.PartitionMode != partitionModeCausalOnly && cfg.PartitionMode != partitionModeReadOnly {
+		return fmt.Errorf("partition-mode must be %s or %s", partitionModeCausalOnly, partitionModeReadOnly)
+	}
+	return nil
+}
+
+// GET /admin/config
+// Returns the effective configuration of this node
+func getConfig(c echo.Context) error {
+	cfg := CONFIG
+	// The metadata service may have changed the ring parameters
+	cfg.PartitionCount = RING_CONFIG.PartitionCount
+	cfg.ReplicationFactor = RING_CONFIG.ReplicationFactor
+	cfg.Load = RING_CONFIG.Load
+	return c.JSON(http.StatusOK, cfg)
+}
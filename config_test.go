@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Values from the config file override the defaults, env vars override the file and flags override both
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvs.yaml")
+	file := "heartbeat-timeout: 2s\nsend-timeout: 3s\nmax-key-length: 10\npartition-count: 20\n"
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KVS_SEND_TIMEOUT", "4s")
+	t.Setenv("KVS_MAX_KEY_LENGTH", "20")
+
+	cfg, err := loadConfig([]string{"-config", path, "-max-key-length", "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HeartbeatInterval != Duration(time.Second) {
+		t.Errorf("heartbeat-interval is %v, want the default", cfg.HeartbeatInterval)
+	}
+	if cfg.HeartbeatTimeout != Duration(2*time.Second) {
+		t.Errorf("heartbeat-timeout is %v, want the value of the file", cfg.HeartbeatTimeout)
+	}
+	if cfg.SendTimeout != Duration(4*time.Second) {
+		t.Errorf("send-timeout is %v, want the value of the env var", cfg.SendTimeout)
+	}
+	if cfg.MaxKeyLength != 30 {
+		t.Errorf("max-key-length is %d, want the value of the flag", cfg.MaxKeyLength)
+	}
+	if cfg.PartitionCount != 20 {
+		t.Errorf("partition-count is %d, want the value of the file", cfg.PartitionCount)
+	}
+}
+
+func TestLoadConfigShardCount(t *testing.T) {
+	t.Setenv("SHARD_COUNT", "2")
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ShardCount != 2 {
+		t.Errorf("shard-count is %d, want SHARD_COUNT", cfg.ShardCount)
+	}
+
+	t.Setenv("KVS_SHARD_COUNT", "3")
+	if cfg, err = loadConfig(nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ShardCount != 3 {
+		t.Errorf("shard-count is %d, want KVS_SHARD_COUNT over SHARD_COUNT", cfg.ShardCount)
+	}
+
+	// The ring is checked against the shard count and partition count that are in effect
+	if _, err := loadConfig([]string{"-shard-count", "12"}); err == nil || !strings.Contains(err.Error(), "partition-count is too small") {
+		t.Errorf("12 shards over the default 11 partitions gave %v", err)
+	}
+	if _, err := loadConfig([]string{"-shard-count", "12", "-partition-count", "24"}); err != nil {
+		t.Errorf("12 shards over 24 partitions gave %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+	}{
+		{"zero duration", func(cfg *Config) { cfg.SendTimeout = 0 }},
+		{"negative retries", func(cfg *Config) { cfg.SendMaxRetries = -1 }},
+		{"load of 1", func(cfg *Config) { cfg.Load = 1.0 }},
+		{"negative shard count", func(cfg *Config) { cfg.ShardCount = -1 }},
+		{"unknown partitioner", func(cfg *Config) { cfg.Partitioner = "random" }},
+		{"merge above half of split", func(cfg *Config) { cfg.RangeMergeKeys = cfg.RangeSplitKeys }},
+		{"unknown transport", func(cfg *Config) { cfg.Transport = "udp" }},
+		{"missing data dir", func(cfg *Config) { cfg.DataDir = filepath.Join(t.TempDir(), "missing") }},
+	}
+	if err := defaultConfig().validate(); err != nil {
+		t.Fatalf("defaults are invalid: %v", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			test.modify(&cfg)
+			if err := cfg.validate(); err == nil {
+				t.Error("validate accepted the config")
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// A client of a protocol frontend (Redis, memcached, gRPC)
+// Commands run through the same handlers as the HTTP API, and the causal metadata
+// of every reply is kept for the next command so that clients need not track it
+type frontendSession struct {
+	local   net.Addr
+	remote  net.Addr
+	handler http.Handler
+	causal  string
+}
+
+// Send a request for key to the KVS handlers, retrying while causal dependencies are not satisfied
+// fields are added to the JSON body next to the causal metadata; returns the status and the decoded reply
+func (s *frontendSession) kvsRequest(method string, key string, fields map[string]interface{}) (int, map[string]interface{}) {
+	request := map[string]interface{}{"causal-metadata": s.causal}
+	for name, value := range fields {
+		request[name] = value
+	}
+	body, _ := json.Marshal(request)
+	deadline := time.Now().Add(time.Duration(CONFIG.SendToAnyTimeout))
+	for {
+		status, respBody := serveLocally(s.handler, s.local, s.remote, method, "/kvs/"+url.PathEscape(key), nil, body)
+		var reply map[string]interface{}
+		json.Unmarshal(respBody, &reply)
+		if metadata, ok := reply["causal-metadata"].(string); ok && metadata != "" {
+			s.causal = metadata
+		}
+		// Writes this client depends on may still be on their way to the node that has the key
+		if status != http.StatusServiceUnavailable || time.Now().After(deadline) || !strings.Contains(fmt.Sprint(reply["error"]), "Causal") {
+			return status, reply
+		}
+		time.Sleep(time.Duration(CONFIG.SendRetryInterval))
+	}
+}
+
+// Log a panic while serving a frontend client and drop only its connection, as net/http does
+// Must be deferred directly by the goroutine serving conn
+func recoverSession(conn net.Conn) {
+	if r := recover(); r != nil {
+		fmt.Printf("Panic serving %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+	}
+}
+
+// Returns the value of a GET reply as a string
+// Values written over HTTP may be any JSON value
+func replyValueString(reply map[string]interface{}) string {
+	if value, ok := reply["value"].(string); ok {
+		return value
+	}
+	jsonBytes, _ := json.Marshal(reply["value"])
+	return string(jsonBytes)
+}
+
+// Returns the uint64 field of a reply, such as its version
+func replyUint(reply map[string]interface{}, field string) uint64 {
+	number, _ := reply[field].(float64)
+	return uint64(number)
+}
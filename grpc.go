@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"webservice/kvspb"
+)
+
+// Implements the KVS gRPC service on top of the HTTP handlers
+type grpcServer struct {
+	kvspb.UnimplementedKVSServer
+	handler http.Handler
+	local   net.Addr
+}
+
+// Accept gRPC clients on address until the listener fails
+func serveGRPC(address string, handler http.Handler) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Printf("Failed to start gRPC listener on %s: %v\n", address, err)
+		return
+	}
+	fmt.Printf("gRPC listener started on %s\n", address)
+	// A panicking call fails with Internal instead of taking the node down
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(recoverUnary), grpc.ChainStreamInterceptor(recoverStream))
+	kvspb.RegisterKVSServer(server, &grpcServer{handler: handler, local: listener.Addr()})
+	if err := server.Serve(listener); err != nil {
+		fmt.Printf("gRPC listener stopped: %v\n", err)
+	}
+}
+
+// Turn a panic in a unary call into an Internal error
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic serving %s: %v\n%s", info.FullMethod, r, debug.Stack())
+			err = grpcstatus.Error(codes.Internal, "internal server error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// Turn a panic in a streaming call into an Internal error
+func recoverStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic serving %s: %v\n%s", info.FullMethod, r, debug.Stack())
+			err = grpcstatus.Error(codes.Internal, "internal server error")
+		}
+	}()
+	return handler(srv, stream)
+}
+
+// Returns a session that runs the requests of a call, starting from the causal metadata of the client
+func (s *grpcServer) session(ctx context.Context, causal *kvspb.CausalMetadata) *frontendSession {
+	session := &frontendSession{local: s.local, remote: s.local, handler: s.handler, causal: causalString(causal)}
+	if p, ok := peer.FromContext(ctx); ok {
+		session.remote = p.Addr
+	}
+	return session
+}
+
+// Returns the causal metadata of a message as used by the HTTP API
+func causalString(causal *kvspb.CausalMetadata) string {
+	if len(causal.GetClock()) == 0 {
+		return ""
+	}
+	jsonBytes, _ := json.Marshal(causal.GetClock())
+	return string(jsonBytes)
+}
+
+// Returns the causal metadata of the HTTP API as a message
+func causalMessage(causal string) *kvspb.CausalMetadata {
+	vc, err := NewVClockFromString(causal)
+	if err != nil {
+		return nil
+	}
+	return &kvspb.CausalMetadata{Clock: vc}
+}
+
+// Returns the gRPC error for a failed KVS request
+func grpcKVSError(status int, reply map[string]interface{}) error {
+	message, ok := reply["error"].(string)
+	if !ok {
+		message = fmt.Sprintf("request failed with status %d", status)
+	}
+	code := codes.Internal
+	switch status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		// The key does not have the version the write expected
+		code = codes.FailedPrecondition
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return grpcstatus.Error(code, message)
+}
+
+// Returns the value of a GET reply as a message
+func replyValue(reply map[string]interface{}) *structpb.Value {
+	value, err := structpb.NewValue(reply["value"])
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *kvspb.GetRequest) (*kvspb.GetResponse, error) {
+	return grpcGet(s.session(ctx, req.GetCausalMetadata()), req)
+}
+
+func (s *grpcServer) Put(ctx context.Context, req *kvspb.PutRequest) (*kvspb.PutResponse, error) {
+	return grpcPut(s.session(ctx, req.GetCausalMetadata()), req)
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *kvspb.DeleteRequest) (*kvspb.DeleteResponse, error) {
+	return grpcDelete(s.session(ctx, req.GetCausalMetadata()), req)
+}
+
+func grpcGet(session *frontendSession, req *kvspb.GetRequest) (*kvspb.GetResponse, error) {
+	status, reply := session.kvsRequest("GET", req.GetKey(), nil)
+	if status != http.StatusOK {
+		return nil, grpcKVSError(status, reply)
+	}
+	shardid, _ := reply["shard-id"].(string)
+	return &kvspb.GetResponse{
+		Value:          replyValue(reply),
+		Version:        replyUint(reply, "version"),
+		Flags:          uint32(replyUint(reply, "flags")),
+		ShardId:        shardid,
+		CausalMetadata: causalMessage(session.causal),
+	}, nil
+}
+
+func grpcPut(session *frontendSession, req *kvspb.PutRequest) (*kvspb.PutResponse, error) {
+	fields := map[string]interface{}{"value": req.GetValue().AsInterface(), "flags": req.GetFlags()}
+	if req.IfVersion != nil {
+		fields["if-version"] = req.GetIfVersion()
+	}
+	if req.GetIfExists() {
+		fields["if-exists"] = true
+	}
+	status, reply := session.kvsRequest("PUT", req.GetKey(), fields)
+	if status != http.StatusOK && status != http.StatusCreated {
+		return nil, grpcKVSError(status, reply)
+	}
+	shardid, _ := reply["shard-id"].(string)
+	return &kvspb.PutResponse{
+		Created:        status == http.StatusCreated,
+		Version:        replyUint(reply, "version"),
+		ShardId:        shardid,
+		CausalMetadata: causalMessage(session.causal),
+	}, nil
+}
+
+func grpcDelete(session *frontendSession, req *kvspb.DeleteRequest) (*kvspb.DeleteResponse, error) {
+	status, reply := session.kvsRequest("DELETE", req.GetKey(), nil)
+	if status != http.StatusOK {
+		return nil, grpcKVSError(status, reply)
+	}
+	shardid, _ := reply["shard-id"].(string)
+	return &kvspb.DeleteResponse{ShardId: shardid, CausalMetadata: causalMessage(session.causal)}, nil
+}
+
+// Run the operations one by one; a failed operation does not stop the ones after it
+func (s *grpcServer) Batch(ctx context.Context, req *kvspb.BatchRequest) (*kvspb.BatchResponse, error) {
+	session := s.session(ctx, req.GetCausalMetadata())
+	results := make([]*kvspb.BatchResult, 0, len(req.GetOperations()))
+	for _, operation := range req.GetOperations() {
+		if err := ctx.Err(); err != nil {
+			return nil, grpcstatus.FromContextError(err).Err()
+		}
+		result := &kvspb.BatchResult{}
+		var err error
+		switch op := operation.GetOperation().(type) {
+		case *kvspb.BatchOperation_Get:
+			var resp *kvspb.GetResponse
+			if resp, err = grpcGet(session, op.Get); err == nil {
+				result.Result = &kvspb.BatchResult_Get{Get: resp}
+			}
+		case *kvspb.BatchOperation_Put:
+			var resp *kvspb.PutResponse
+			if resp, err = grpcPut(session, op.Put); err == nil {
+				result.Result = &kvspb.BatchResult_Put{Put: resp}
+			}
+		case *kvspb.BatchOperation_Delete:
+			var resp *kvspb.DeleteResponse
+			if resp, err = grpcDelete(session, op.Delete); err == nil {
+				result.Result = &kvspb.BatchResult_Delete{Delete: resp}
+			}
+		default:
+			err = grpcstatus.Error(codes.InvalidArgument, "Operation is not set")
+		}
+		if err != nil {
+			status := grpcstatus.Convert(err)
+			result.Code = int32(status.Code())
+			result.Error = status.Message()
+		}
+		results = append(results, result)
+	}
+	return &kvspb.BatchResponse{Results: results, CausalMetadata: causalMessage(session.causal)}, nil
+}
+
+// Stream the keys of every shard in order, reading each value as the scan reaches it
+func (s *grpcServer) Scan(req *kvspb.ScanRequest, stream kvspb.KVS_ScanServer) error {
+	sizes, err := fetchAllKeySizes()
+	if err != nil {
+		return grpcstatus.Error(codes.Unavailable, err.Error())
+	}
+	var keys []string
+	for _, shardSizes := range sizes {
+		for key := range shardSizes {
+			if strings.HasPrefix(key, req.GetPrefix()) && key >= req.GetStartKey() {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	session := s.session(stream.Context(), req.GetCausalMetadata())
+	sent := uint32(0)
+	for _, key := range keys {
+		if req.GetLimit() > 0 && sent >= req.GetLimit() {
+			break
+		}
+		if err := stream.Context().Err(); err != nil {
+			return grpcstatus.FromContextError(err).Err()
+		}
+		resp, err := grpcGet(session, &kvspb.GetRequest{Key: key})
+		// The key was deleted after the keys were listed
+		if grpcstatus.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&kvspb.ScanResponse{
+			Key:            key,
+			Value:          resp.Value,
+			Version:        resp.Version,
+			Flags:          resp.Flags,
+			ShardId:        resp.ShardId,
+			CausalMetadata: resp.CausalMetadata,
+		})
+		if err != nil {
+			return err
+		}
+		sent++
+	}
+	return nil
+}
+
+// Stream the writes this node sees until the client goes away or falls behind
+func (s *grpcServer) Watch(req *kvspb.WatchRequest, stream kvspb.KVS_WatchServer) error {
+	w := watchChanges(req.GetPrefix())
+	defer stopWatching(w)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return grpcstatus.FromContextError(stream.Context().Err()).Err()
+		case change, ok := <-w.changes:
+			if !ok {
+				return grpcstatus.Error(codes.ResourceExhausted, "Watcher fell behind; read the keys again and start a new watch")
+			}
+			event := &kvspb.WatchEvent{
+				Type:           kvspb.WatchEvent_DELETE,
+				Key:            change.Key,
+				CausalMetadata: causalMessage(change.CausalMetaData),
+			}
+			if change.Value != nil {
+				event.Type = kvspb.WatchEvent_PUT
+				event.Value, _ = structpb.NewValue(change.Value.Data)
+				event.Version = change.Value.Version
+				event.Flags = change.Value.Flags
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"webservice/kvspb"
+)
+
+// Serve the gRPC API of a single node and return a client for it
+func startGRPC(t *testing.T) kvspb.KVSClient {
+	handler := startLocalNode(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, _ := net.ResolveTCPAddr("tcp", SOCKET_ADDRESS)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(recoverUnary), grpc.ChainStreamInterceptor(recoverStream))
+	kvspb.RegisterKVSServer(server, &grpcServer{handler: handler, local: local})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return kvspb.NewKVSClient(conn)
+}
+
+func TestGRPC(t *testing.T) {
+	client := startGRPC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	put, err := client.Put(ctx, &kvspb.PutRequest{Key: "a", Value: structpb.NewStringValue("1"), Flags: 3})
+	if err != nil || !put.GetCreated() || put.GetShardId() != "shard0" {
+		t.Fatalf("put returned %v, %v", put, err)
+	}
+	// Reads carry on from the causal metadata of the write
+	get, err := client.Get(ctx, &kvspb.GetRequest{Key: "a", CausalMetadata: put.GetCausalMetadata()})
+	if err != nil || get.GetValue().GetStringValue() != "1" || get.GetFlags() != 3 || get.GetVersion() != put.GetVersion() {
+		t.Fatalf("get returned %v, %v", get, err)
+	}
+
+	stale := put.GetVersion() + 1
+	_, err = client.Put(ctx, &kvspb.PutRequest{Key: "a", Value: structpb.NewStringValue("2"), IfVersion: &stale})
+	if code := grpcstatus.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("put with a stale version failed with %v", code)
+	}
+
+	batch, err := client.Batch(ctx, &kvspb.BatchRequest{Operations: []*kvspb.BatchOperation{
+		{Operation: &kvspb.BatchOperation_Delete{Delete: &kvspb.DeleteRequest{Key: "a"}}},
+		{Operation: &kvspb.BatchOperation_Get{Get: &kvspb.GetRequest{Key: "a"}}},
+		{},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []codes.Code{codes.OK, codes.NotFound, codes.InvalidArgument}
+	if len(batch.GetResults()) != len(want) {
+		t.Fatalf("batch returned %v", batch.GetResults())
+	}
+	for i, result := range batch.GetResults() {
+		if codes.Code(result.GetCode()) != want[i] {
+			t.Errorf("batch operation %d ended with %v, want %v", i, codes.Code(result.GetCode()), want[i])
+		}
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	client := startGRPC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &kvspb.WatchRequest{Prefix: "user:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The watch is only registered once the stream reached the server
+	for !watching() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Put(ctx, &kvspb.PutRequest{Key: "other", Value: structpb.NewStringValue("x")})
+	client.Put(ctx, &kvspb.PutRequest{Key: "user:1", Value: structpb.NewStringValue("ann")})
+	client.Delete(ctx, &kvspb.DeleteRequest{Key: "user:1"})
+
+	event, err := stream.Recv()
+	if err != nil || event.GetType() != kvspb.WatchEvent_PUT || event.GetKey() != "user:1" || event.GetValue().GetStringValue() != "ann" {
+		t.Fatalf("first event is %v, %v", event, err)
+	}
+	event, err = stream.Recv()
+	if err != nil || event.GetType() != kvspb.WatchEvent_DELETE || event.GetKey() != "user:1" {
+		t.Fatalf("second event is %v, %v", event, err)
+	}
+}
+
+// Returns true if anyone is watching key changes
+func watching() bool {
+	watchersMutex.Lock()
+	defer watchersMutex.Unlock()
+	return len(WATCHERS) > 0
+}
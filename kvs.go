@@ -4,17 +4,29 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/DistributedClocks/GoVector/govec/vclock"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Define JSON body for kvs PUT requests
 type KVS_PUT_Request struct {
 	Data           interface{} `json:"value"`
 	Type           string      `json:"type"`
+	Flags          uint32      `json:"flags,omitempty"`
 	CausalMetaData string      `json:"causal-metadata"`
 	FromRepilca    string      `json:"from-replica,omitempty"`
+	// Only write if the key has this version; 0 means it must not exist
+	IfVersion *uint64 `json:"if-version,omitempty"`
+	// Only write if the key exists
+	IfExists bool `json:"if-exists,omitempty"`
+	// Version given to the write by the node that took it from the client
+	Version uint64 `json:"version,omitempty"`
+	// Unix time in milliseconds at which the value expires; 0 means never
+	ExpiresAt int64 `json:"expires-at,omitempty"`
 }
 
 // Define JSON body for kvs GET and DELETE requests
@@ -23,6 +35,53 @@ type KVS_GET_DELETE_Request struct {
 	FromRepilca    string `json:"from-replica,omitempty"`
 }
 
+// Serializes client writes so that conditional writes see the version they replace
+var versionMutex sync.Mutex
+
+// Low bits of a version, which hold the member of the shard that took the write
+const versionWriterBits = 16
+
+// Returns the version of a write to a key whose version is current
+// The high bits count the writes to the key and the low bits hold the position of this node
+// in its shard, so that writes taken concurrently by different replicas never share a version
+func nextVersion(current uint64) uint64 {
+	writer := uint64(0)
+	for i, address := range SHARDS[MY_SHARD_ID] {
+		if address == SOCKET_ADDRESS {
+			writer = uint64(i + 1)
+		}
+	}
+	return importVersion(current) | writer
+}
+
+// Returns the version of an imported value stored over one whose version is current
+// Imports are not taken by a member of the shard, so every member gives the value the same version
+func importVersion(current uint64) uint64 {
+	return (current>>versionWriterBits + 1) << versionWriterBits
+}
+
+// Returns true if the value has an expiry time and it has passed
+func (value Value) expired(now time.Time) bool {
+	return value.Expires != 0 && now.UnixMilli() >= value.Expires
+}
+
+// Delete the expired keys of this node every expiry-sweep-interval
+// Every replica stores the same expiry time with the value, so each one drops
+// the key on its own and the delete is not replicated
+func sweepExpiredKeys() {
+	for {
+		time.Sleep(time.Duration(CONFIG.ExpirySweepInterval))
+		now := time.Now()
+		KVSmutex.Lock()
+		for key, value := range KVStore {
+			if value.expired(now) {
+				delete(KVStore, key)
+			}
+		}
+		KVSmutex.Unlock()
+	}
+}
+
 // PUT /kvs/<key>
 // Add a key-value to the database
 func putKey(c echo.Context) error {
@@ -40,8 +99,8 @@ func putKey(c echo.Context) error {
 	}
 	// Check which shard the key belongs to
 	key := c.Param("key")
-	keyByte := []byte(key)
-	shardid := HASH_RING.LocateKey(keyByte).String()
+	shardid := locateShard(key)
+	traceRoute(c, key, shardid)
 
 	// Check if shardid is NOT the same as MY_SHARD_ID
 	if shardid != MY_SHARD_ID {
@@ -51,15 +110,30 @@ func putKey(c echo.Context) error {
 			if err != nil {
 				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid metadata format"})
 			}
-			MY_VECTOR_CLOCK.Merge(senderVC)
+			// Only take the sender's own position, the other positions may count
+			// writes to my shard that have not been delivered to me yet
+			mergeSenderPosition(senderVC, input.FromRepilca)
+			// Watchers on this node see writes to every shard
+			publishChange(key, &Value{Data: input.Data, Type: input.Type, Version: input.Version, Flags: input.Flags, Expires: input.ExpiresAt}, input.CausalMetaData)
 			return c.JSON(http.StatusOK, map[string]string{"result": "vector clock updated"})
 		} else {
 			return forwardRequest(c, choseNodeFromShard(shardid), "kvs/"+key, body)
 		}
 	}
+	// Conditional writes are all checked by the first live member of the shard,
+	// so that two nodes never accept a write for the same version
+	if input.FromRepilca == "" && (input.IfVersion != nil || input.IfExists) {
+		if primary := firstLiveNode(shardid); primary != SOCKET_ADDRESS {
+			return forwardRequest(c, primary, "kvs/"+key, body)
+		}
+	}
+	// Count client traffic of the partition of the key
+	if input.FromRepilca == "" {
+		recordPartitionLoad(key, len(body))
+	}
 
 	// Validate key length
-	if len(key) > 50 {
+	if len(key) > CONFIG.MaxKeyLength {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Key is too long"})
 	}
 
@@ -67,6 +141,9 @@ func putKey(c echo.Context) error {
 	if input.Data == nil || input.Data == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "PUT request does not specify a value"})
 	}
+	if input.ExpiresAt < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid expiry time"})
+	}
 
 	// Handle the causal metadata to ensure causal consistency
 	var senderVC vclock.VClock
@@ -79,14 +156,40 @@ func putKey(c echo.Context) error {
 		if err != nil {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid metadata format"})
 		}
+		vectorClockMutex.Lock()
+		// Acknowledge a write I already have again, so the sender stops retrying it
+		if alreadyApplied(senderVC, MY_VECTOR_CLOCK, senderPos) {
+			vectorClockMutex.Unlock()
+			return c.JSON(http.StatusOK, map[string]string{"result": "already applied"})
+		}
 		// Return error if senders VC value is not +1 receivers vc value
-		if !(compareReplicasVC(senderVC, MY_VECTOR_CLOCK, senderPos)) {
+		deliverable := awaitDeliverable(senderVC, senderPos)
+		traceCausalCheck(c, "replica", senderVC, deliverable)
+		if !deliverable {
+			vectorClockMutex.Unlock()
+			causalWaits.WithLabelValues("replica").Inc()
 			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Causal dependencies not satisfied; try again later"})
 		}
 		// Merge the replicas's vector clock with client vector clock
 		MY_VECTOR_CLOCK.Merge(senderVC)
+		vectorClockAdvanced.Broadcast()
+		vectorClockMutex.Unlock()
 	} else {
 		// HANDLE REQUEST FROM A CLIENT
+		// Reject writes while in a read-only minority partition
+		if writesDisabled() {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; writes are disabled"})
+		}
+		// Hold writes back while keys are moving between shards, and keep
+		// the shard map from changing until this write has been applied
+		reshardMutex.RLock()
+		defer reshardMutex.RUnlock()
+		if writeFenced(key) {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Resharding in progress; try again later"})
+		}
+		if BACKUP_FENCE != "" {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Backup in progress; try again later"})
+		}
 		// Check if the client vector clock is nil
 		if input.CausalMetaData != "" {
 			// Parse causal metadata string from client
@@ -97,36 +200,70 @@ func putKey(c echo.Context) error {
 			// Check if clients request is deliverable based on its vector clock
 			// if recieverVC ---> clientVc return error
 			// If the replica is less updated than the client, it cant deliver the message
-			if !(senderVC.Compare(MY_VECTOR_CLOCK, vclock.Concurrent) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Equal)) {
+			vectorClockMutex.Lock()
+			deliverable := senderVC.Compare(MY_VECTOR_CLOCK, vclock.Concurrent) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Equal) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Descendant)
+			traceCausalCheck(c, "client", senderVC, deliverable)
+			vectorClockMutex.Unlock()
+			if !deliverable {
+				causalWaits.WithLabelValues("client").Inc()
 				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Causal dependencies not satisfied; try again later"})
 			}
 		}
+		// Conditional writes check and bump the version of the key atomically
+		versionMutex.Lock()
+		defer versionMutex.Unlock()
+		KVSmutex.Lock()
+		current, existed := KVStore[key]
+		KVSmutex.Unlock()
+		// An expired value is missing to clients, but the next version still counts from it
+		currentVersion := current.Version
+		if current.expired(time.Now()) {
+			existed, currentVersion = false, 0
+		}
+		if input.IfExists && !existed {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Key does not exist"})
+		}
+		if input.IfVersion != nil && *input.IfVersion != currentVersion {
+			return c.JSON(http.StatusConflict, map[string]interface{}{"error": "Version does not match", "version": currentVersion})
+		}
+		input.Version = nextVersion(current.Version)
 		// Merge the replicas's vector clock with client vector clock
+		vectorClockMutex.Lock()
 		MY_VECTOR_CLOCK.Merge(senderVC)
 		// Increment replica's index in the vector clock to track a new write
 		MY_VECTOR_CLOCK.Tick(SOCKET_ADDRESS)
 		// Otherwise broadcast request to other replicas and deliver
 		input.FromRepilca = SOCKET_ADDRESS
 		input.CausalMetaData = MY_VECTOR_CLOCK.ReturnVCString()
+		vectorClockMutex.Unlock()
 		jsonData, _ := json.Marshal(input)
-		go broadcast("PUT", "kvs/"+key, jsonData, CURRENT_VIEW)
+		go broadcast(c.Request().Context(), "PUT", "kvs/"+key, jsonData, CURRENT_VIEW)
 	}
 
-	// Check if the key existed before the update
-	_, existed := KVStore[key]
+	// Trace the write with the vector clock it is applied at
+	span := startSpan(c, "apply", attribute.String("kvs.key", key), attribute.Int64("kvs.version", int64(input.Version)), attribute.String("kvs.vc", vectorClockString()))
 
 	// Update or create key-value mapping
+	value := Value{Data: input.Data, Type: input.Type, Version: input.Version, Flags: input.Flags, Expires: input.ExpiresAt}
 	// Lock before accessing the KVStore
 	KVSmutex.Lock()
-	KVStore[key] = Value{input.Data, input.Type}
+	// Check if the key existed before the update
+	previous, existed := KVStore[key]
+	existed = existed && !previous.expired(time.Now())
+	KVStore[key] = value
 	// Unlock after accessing the KVStore
 	KVSmutex.Unlock()
+	// Remember the write in case some node is unreachable
+	recordDivergedWrite(key, &value, input.FromRepilca, input.CausalMetaData)
+	// Let watchers know about the write
+	publishChange(key, &value, input.CausalMetaData)
+	span.End()
 
 	// Return response with the appropriate status
 	if existed {
-		return c.JSON(http.StatusOK, map[string]string{"result": "replaced", "causal-metadata": MY_VECTOR_CLOCK.ReturnVCString(), "shard-id": MY_SHARD_ID})
+		return c.JSON(http.StatusOK, map[string]interface{}{"result": "replaced", "causal-metadata": vectorClockString(), "shard-id": MY_SHARD_ID, "version": input.Version})
 	}
-	return c.JSON(http.StatusCreated, map[string]string{"result": "created", "causal-metadata": MY_VECTOR_CLOCK.ReturnVCString(), "shard-id": MY_SHARD_ID})
+	return c.JSON(http.StatusCreated, map[string]interface{}{"result": "created", "causal-metadata": vectorClockString(), "shard-id": MY_SHARD_ID, "version": input.Version})
 }
 
 // GET /kvs/<key>
@@ -134,8 +271,8 @@ func putKey(c echo.Context) error {
 func getKey(c echo.Context) error {
 	// Check which shard the key belongs to
 	key := c.Param("key")
-	keyByte := []byte(key)
-	shardid := HASH_RING.LocateKey(keyByte).String()
+	shardid := locateShard(key)
+	traceRoute(c, key, shardid)
 
 	// Read JSON from request body
 	body, err := io.ReadAll(c.Request().Body)
@@ -166,8 +303,14 @@ func getKey(c echo.Context) error {
 		// Check if clients request is deliverable based on its vector clock
 		// if recieverVC ---> clientVc return error
 		// If the replica is less updated than the client, it cant deliver the message
-		if !(senderVC.Compare(MY_VECTOR_CLOCK, vclock.Concurrent) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Equal) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Descendant)) {
-			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Causal dependencies not satisfied; try again later", "vc": MY_VECTOR_CLOCK.ReturnVCString()})
+		vectorClockMutex.Lock()
+		deliverable := senderVC.Compare(MY_VECTOR_CLOCK, vclock.Concurrent) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Equal) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Descendant)
+		traceCausalCheck(c, "client", senderVC, deliverable)
+		vc := MY_VECTOR_CLOCK.ReturnVCString()
+		vectorClockMutex.Unlock()
+		if !deliverable {
+			causalWaits.WithLabelValues("client").Inc()
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Causal dependencies not satisfied; try again later", "vc": vc})
 		}
 	}
 
@@ -177,17 +320,32 @@ func getKey(c echo.Context) error {
 	value, ok := KVStore[key]
 	// Unlock after accessing the KVStore
 	KVSmutex.Unlock()
-	if !ok {
+	// An expired key reads as missing until it is swept
+	if !ok || value.expired(time.Now()) {
+		recordPartitionLoad(key, 0)
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "Key does not exist"})
 	}
+	// Count client traffic of the partition of the key
+	valueBytes, _ := json.Marshal(value.Data)
+	recordPartitionLoad(key, len(valueBytes))
 
 	// Return response with original data type
-	return c.JSON(http.StatusOK, map[string]interface{}{
+	reply := map[string]interface{}{
 		"result":          "found",
 		"value":           value.Data,
-		"causal-metadata": MY_VECTOR_CLOCK.ReturnVCString(),
+		"causal-metadata": vectorClockString(),
 		"shard-id":        MY_SHARD_ID,
-	})
+		"version":         value.Version,
+		"flags":           value.Flags,
+	}
+	// Frontends rewrite the value with its type and expiry, e.g. to increment it
+	if value.Type != "" {
+		reply["type"] = value.Type
+	}
+	if value.Expires != 0 {
+		reply["expires-at"] = value.Expires
+	}
+	return c.JSON(http.StatusOK, reply)
 }
 
 // DELETE /kvs/<key>
@@ -206,8 +364,8 @@ func deleteKey(c echo.Context) error {
 	}
 	// Check which shard the key belongs to
 	key := c.Param("key")
-	keyByte := []byte(key)
-	shardid := HASH_RING.LocateKey(keyByte).String()
+	shardid := locateShard(key)
+	traceRoute(c, key, shardid)
 	// If shardid is NOT the same as MY_SHARD_ID, then forward the request to the appropriate shard
 	if shardid != MY_SHARD_ID {
 		if input.FromRepilca != "" {
@@ -215,12 +373,20 @@ func deleteKey(c echo.Context) error {
 			if err != nil {
 				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid metadata format"})
 			}
-			MY_VECTOR_CLOCK.Merge(senderVC)
+			// Only take the sender's own position, the other positions may count
+			// writes to my shard that have not been delivered to me yet
+			mergeSenderPosition(senderVC, input.FromRepilca)
+			// Watchers on this node see writes to every shard
+			publishChange(key, nil, input.CausalMetaData)
 			return c.JSON(http.StatusOK, map[string]string{"result": "vector clock updated"})
 		} else {
 			return forwardRequest(c, choseNodeFromShard(shardid), "kvs/"+key, body)
 		}
 	}
+	// Count client traffic of the partition of the key
+	if input.FromRepilca == "" {
+		recordPartitionLoad(key, len(body))
+	}
 
 	// Handle the causal metadata to ensure causal consistency
 	var senderVC vclock.VClock
@@ -233,14 +399,42 @@ func deleteKey(c echo.Context) error {
 		if err != nil {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid metadata format"})
 		}
+		vectorClockMutex.Lock()
+		// Acknowledge a write I already have again, so the sender stops retrying it
+		if alreadyApplied(senderVC, MY_VECTOR_CLOCK, senderPos) {
+			vectorClockMutex.Unlock()
+			return c.JSON(http.StatusOK, map[string]string{"result": "already applied"})
+		}
 		// Return error if senders VC value is not +1 receivers vc value
-		if !(compareReplicasVC(senderVC, MY_VECTOR_CLOCK, senderPos)) {
+		deliverable := awaitDeliverable(senderVC, senderPos)
+		traceCausalCheck(c, "replica", senderVC, deliverable)
+		if !deliverable {
+			vectorClockMutex.Unlock()
+			causalWaits.WithLabelValues("replica").Inc()
 			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Causal dependencies not satisfied; try again later"})
 		}
 		// Merge the replicas's vector clock with client vector clock
 		MY_VECTOR_CLOCK.Merge(senderVC)
+		vectorClockAdvanced.Broadcast()
+		vectorClockMutex.Unlock()
+		// Lock before accessing the KVStore
+		KVSmutex.Lock()
 	} else {
 		// HANDLE REQUEST FROM A CLIENT
+		// Reject writes while in a read-only minority partition
+		if writesDisabled() {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; writes are disabled"})
+		}
+		// Hold writes back while keys are moving between shards, and keep
+		// the shard map from changing until this write has been applied
+		reshardMutex.RLock()
+		defer reshardMutex.RUnlock()
+		if writeFenced(key) {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Resharding in progress; try again later"})
+		}
+		if BACKUP_FENCE != "" {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Backup in progress; try again later"})
+		}
 		// Check if the client vector clock is nil
 		if input.CausalMetaData != "" {
 			// Parse causal metadata string from client
@@ -251,34 +445,55 @@ func deleteKey(c echo.Context) error {
 			// Check if clients request is deliverable based on its vector clock
 			// if recieverVC ---> clientVc return error
 			// If the replica is less updated than the client, it cant deliver the message
-			if !(senderVC.Compare(MY_VECTOR_CLOCK, vclock.Concurrent) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Equal)) {
+			vectorClockMutex.Lock()
+			deliverable := senderVC.Compare(MY_VECTOR_CLOCK, vclock.Concurrent) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Equal) || senderVC.Compare(MY_VECTOR_CLOCK, vclock.Descendant)
+			traceCausalCheck(c, "client", senderVC, deliverable)
+			vectorClockMutex.Unlock()
+			if !deliverable {
+				causalWaits.WithLabelValues("client").Inc()
 				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Causal dependencies not satisfied; try again later"})
 			}
 		}
+		// Deleting a missing key is not a write, so other nodes are not told about it
+		// The lock is held until the key is deleted, so that a delete that was broadcast
+		// is not answered with 404 because a concurrent one got to the key first
+		KVSmutex.Lock()
+		if value, exists := KVStore[key]; !exists || value.expired(time.Now()) {
+			KVSmutex.Unlock()
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Key does not exist"})
+		}
 		// Merge the replicas's vector clock with client vector clock
+		vectorClockMutex.Lock()
 		MY_VECTOR_CLOCK.Merge(senderVC)
 		// Increment replica's index in the vector clock to track a new write
 		MY_VECTOR_CLOCK.Tick(SOCKET_ADDRESS)
 		// Otherwise broadcast request to other replicas and deliver
 		input.FromRepilca = SOCKET_ADDRESS
 		input.CausalMetaData = MY_VECTOR_CLOCK.ReturnVCString()
+		vectorClockMutex.Unlock()
 		jsonData, _ := json.Marshal(input)
-		go broadcast("PUT", "kvs/"+key, jsonData, CURRENT_VIEW)
+		go broadcast(c.Request().Context(), "DELETE", "kvs/"+key, jsonData, CURRENT_VIEW)
 	}
 
 	// Check if key exists
 	_, ok := KVStore[key]
 	if !ok {
+		KVSmutex.Unlock()
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "Key does not exist"})
 	}
 
-	// Lock before accessing the KVStore
-	KVSmutex.Lock()
+	// Trace the delete with the vector clock it is applied at
+	span := startSpan(c, "apply", attribute.String("kvs.key", key), attribute.String("kvs.vc", vectorClockString()))
 	// Delete key
 	delete(KVStore, key)
 	// Unlock after accessing the KVStore
 	KVSmutex.Unlock()
+	// Remember the delete in case some node is unreachable
+	recordDivergedWrite(key, nil, input.FromRepilca, input.CausalMetaData)
+	// Let watchers know about the delete
+	publishChange(key, nil, input.CausalMetaData)
+	span.End()
 
 	// Return response
-	return c.JSON(http.StatusOK, map[string]string{"result": "deleted", "causal-metadata": MY_VECTOR_CLOCK.ReturnVCString(), "shard-id": MY_SHARD_ID})
+	return c.JSON(http.StatusOK, map[string]string{"result": "deleted", "causal-metadata": vectorClockString(), "shard-id": MY_SHARD_ID})
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Send a request for key with body to node, retrying while it waits for causal dependencies
+func kvsRequest(t *testing.T, method string, node string, key string, body interface{}) (int, map[string]interface{}) {
+	jsonBytes, _ := json.Marshal(body)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, _ := http.NewRequest(method, "http://"+node+"/kvs/"+url.PathEscape(key), bytes.NewReader(jsonBytes))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s on %s failed: %v", method, key, node, err)
+		}
+		var reply map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&reply)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || time.Now().After(deadline) {
+			return resp.StatusCode, reply
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// A client whose causal metadata is older than the node's clock has seen nothing the node has not,
+// so its writes and deletes are accepted like its reads
+func TestWritesFromClientBehindNode(t *testing.T) {
+	cluster := startCluster(t, 2, 1, "KVS_SEND_RETRY_INTERVAL=50ms")
+	node := cluster.nodes[0]
+
+	status, reply := kvsRequest(t, "PUT", node, "a", KVS_PUT_Request{Data: "1"})
+	if status != http.StatusCreated {
+		t.Fatalf("first write returned %d: %v", status, reply)
+	}
+	stale := reply["causal-metadata"].(string)
+	// Another client moves the node's clock past the first client's
+	if status, reply := kvsRequest(t, "PUT", node, "b", KVS_PUT_Request{Data: "2"}); status != http.StatusCreated {
+		t.Fatalf("second write returned %d: %v", status, reply)
+	}
+
+	if status, reply := kvsRequest(t, "PUT", node, "a", KVS_PUT_Request{Data: "3", CausalMetaData: stale}); status != http.StatusOK {
+		t.Errorf("write with older causal metadata returned %d: %v", status, reply)
+	}
+	if status, reply := kvsRequest(t, "DELETE", node, "b", KVS_GET_DELETE_Request{CausalMetaData: stale}); status != http.StatusOK {
+		t.Errorf("delete with older causal metadata returned %d: %v", status, reply)
+	}
+}
+
+// A delete reaches the other replicas, and writes replicated after it are not held back by it
+func TestDeleteIsReplicated(t *testing.T) {
+	cluster := startCluster(t, 2, 1, "KVS_SEND_RETRY_INTERVAL=50ms")
+	node, replica := cluster.nodes[0], cluster.nodes[1]
+
+	status, reply := kvsRequest(t, "PUT", node, "a", KVS_PUT_Request{Data: "1"})
+	if status != http.StatusCreated {
+		t.Fatalf("write returned %d: %v", status, reply)
+	}
+	status, reply = kvsRequest(t, "DELETE", node, "a", KVS_GET_DELETE_Request{CausalMetaData: reply["causal-metadata"].(string)})
+	if status != http.StatusOK {
+		t.Fatalf("delete returned %d: %v", status, reply)
+	}
+	status, reply = kvsRequest(t, "PUT", node, "b", KVS_PUT_Request{Data: "2", CausalMetaData: reply["causal-metadata"].(string)})
+	if status != http.StatusCreated {
+		t.Fatalf("write after the delete returned %d: %v", status, reply)
+	}
+	causal := reply["causal-metadata"].(string)
+
+	if status, reply := kvsRequest(t, "GET", replica, "a", KVS_GET_DELETE_Request{CausalMetaData: causal}); status != http.StatusNotFound {
+		t.Errorf("deleted key on the other replica returned %d: %v", status, reply)
+	}
+	if status, reply := kvsRequest(t, "GET", replica, "b", KVS_GET_DELETE_Request{CausalMetaData: causal}); status != http.StatusOK || reply["value"] != "2" {
+		t.Errorf("write after the delete on the other replica returned %d: %v", status, reply)
+	}
+}
+
+// Of concurrent deletes of one key exactly one succeeds, and only that one is a write
+func TestConcurrentDeletesOfOneKey(t *testing.T) {
+	cluster := startCluster(t, 2, 1)
+	node := cluster.nodes[0]
+	const keys, deleters = 20, 8
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if status, reply := kvsRequest(t, "PUT", node, key, KVS_PUT_Request{Data: "v"}); status != http.StatusCreated {
+			t.Fatalf("PUT returned %d: %v", status, reply)
+		}
+		var deleted atomic.Int64
+		var wg sync.WaitGroup
+		for d := 0; d < deleters; d++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, reply := kvsRequest(t, "DELETE", node, key, KVS_GET_DELETE_Request{})
+				switch status {
+				case http.StatusOK:
+					deleted.Add(1)
+				case http.StatusNotFound:
+				default:
+					t.Errorf("DELETE returned %d: %v", status, reply)
+				}
+			}()
+		}
+		wg.Wait()
+		if deleted.Load() != 1 {
+			t.Fatalf("%d deletes of %s succeeded, want 1", deleted.Load(), key)
+		}
+	}
+	// Every key was written once and deleted once
+	_, reply := nodeRequest(t, "GET", node, "admin/vector-clock", nil)
+	clock, _ := reply["vector-clock"].(map[string]interface{})
+	if clock[node] != float64(2*keys) {
+		t.Errorf("position of %s is %v after %d writes", node, clock[node], 2*keys)
+	}
+}
+
+// Every replica stores the expiry time of a value, reads it as missing once it has passed and then drops it
+func TestExpiryIsReplicated(t *testing.T) {
+	cluster := startCluster(t, 2, 1, "KVS_EXPIRY_SWEEP_INTERVAL=2s")
+	node, other := cluster.nodes[0], cluster.nodes[1]
+	expiresAt := time.Now().Add(3 * time.Second).UnixMilli()
+	for key, input := range map[string]KVS_PUT_Request{
+		"a": {Data: "v", ExpiresAt: expiresAt},
+		"b": {Data: "v", ExpiresAt: expiresAt},
+		"c": {Data: "v"},
+	} {
+		if status, reply := kvsRequest(t, "PUT", node, key, input); status != http.StatusCreated {
+			t.Fatalf("PUT %s returned %d: %v", key, status, reply)
+		}
+	}
+	waitForReplication(t, cluster.nodes)
+	status, reply := kvsRequest(t, "GET", other, "a", KVS_GET_DELETE_Request{})
+	if status != http.StatusOK || reply["expires-at"] != float64(expiresAt) {
+		t.Fatalf("GET a from the other replica returned %d: %v", status, reply)
+	}
+
+	time.Sleep(time.Until(time.UnixMilli(expiresAt)))
+	for _, address := range cluster.nodes {
+		if status, reply := kvsRequest(t, "GET", address, "a", KVS_GET_DELETE_Request{}); status != http.StatusNotFound {
+			t.Errorf("GET of expired a from %s returned %d: %v", address, status, reply)
+		}
+		if status, _ := kvsRequest(t, "GET", address, "c", KVS_GET_DELETE_Request{}); status != http.StatusOK {
+			t.Errorf("GET of c from %s returned %d", address, status)
+		}
+	}
+	// An expired key that has not been dropped yet can be created again
+	zero := uint64(0)
+	status, reply = kvsRequest(t, "PUT", node, "a", KVS_PUT_Request{Data: "w", IfVersion: &zero})
+	if status != http.StatusCreated {
+		t.Fatalf("PUT of a that must not exist returned %d: %v", status, reply)
+	}
+	waitForReplication(t, cluster.nodes)
+
+	// Both replicas drop b without a delete being sent
+	deadline := time.Now().Add(10 * time.Second)
+	for _, address := range cluster.nodes {
+		for {
+			_, reply := nodeRequest(t, "GET", address, "shard/key-count/shard0", nil)
+			if reply["shard-key-count"] == float64(2) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s has %v keys, want 2", address, reply["shard-key-count"])
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if status, reply := kvsRequest(t, "GET", address, "a", KVS_GET_DELETE_Request{}); status != http.StatusOK || reply["value"] != "w" {
+			t.Errorf("GET of recreated a from %s returned %d: %v", address, status, reply)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.1
+// source: kvs.proto
+
+package kvspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	KVS_Get_FullMethodName    = "/kvs.v1.KVS/Get"
+	KVS_Put_FullMethodName    = "/kvs.v1.KVS/Put"
+	KVS_Delete_FullMethodName = "/kvs.v1.KVS/Delete"
+	KVS_Batch_FullMethodName  = "/kvs.v1.KVS/Batch"
+	KVS_Scan_FullMethodName   = "/kvs.v1.KVS/Scan"
+	KVS_Watch_FullMethodName  = "/kvs.v1.KVS/Watch"
+)
+
+// KVSClient is the client API for KVS service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KVSClient interface {
+	// Returns the value of a key
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Creates or replaces the value of a key
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
+	// Deletes a key
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Runs several operations in order and returns the result of each
+	// The batch is not atomic; operations on keys of different shards are applied one by one
+	Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	// Streams the keys of every shard in key order, with their values
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (KVS_ScanClient, error)
+	// Streams the writes this node sees from now on
+	// Keys moved between shards by a reshard are not reported
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (KVS_WatchClient, error)
+}
+
+type kVSClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKVSClient(cc grpc.ClientConnInterface) KVSClient {
+	return &kVSClient{cc}
+}
+
+func (c *kVSClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, KVS_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVSClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
+	out := new(PutResponse)
+	err := c.cc.Invoke(ctx, KVS_Put_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVSClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, KVS_Delete_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVSClient) Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, KVS_Batch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVSClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (KVS_ScanClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KVS_ServiceDesc.Streams[0], KVS_Scan_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kVSScanClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KVS_ScanClient interface {
+	Recv() (*ScanResponse, error)
+	grpc.ClientStream
+}
+
+type kVSScanClient struct {
+	grpc.ClientStream
+}
+
+func (x *kVSScanClient) Recv() (*ScanResponse, error) {
+	m := new(ScanResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *kVSClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (KVS_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KVS_ServiceDesc.Streams[1], KVS_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kVSWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KVS_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type kVSWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *kVSWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KVSServer is the server API for KVS service.
+// All implementations must embed UnimplementedKVSServer
+// for forward compatibility
+type KVSServer interface {
+	// Returns the value of a key
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Creates or replaces the value of a key
+	Put(context.Context, *PutRequest) (*PutResponse, error)
+	// Deletes a key
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Runs several operations in order and returns the result of each
+	// The batch is not atomic; operations on keys of different shards are applied one by one
+	Batch(context.Context, *BatchRequest) (*BatchResponse, error)
+	// Streams the keys of every shard in key order, with their values
+	Scan(*ScanRequest, KVS_ScanServer) error
+	// Streams the writes this node sees from now on
+	// Keys moved between shards by a reshard are not reported
+	Watch(*WatchRequest, KVS_WatchServer) error
+	mustEmbedUnimplementedKVSServer()
+}
+
+// UnimplementedKVSServer must be embedded to have forward compatible implementations.
+type UnimplementedKVSServer struct {
+}
+
+func (UnimplementedKVSServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedKVSServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedKVSServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedKVSServer) Batch(context.Context, *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Batch not implemented")
+}
+func (UnimplementedKVSServer) Scan(*ScanRequest, KVS_ScanServer) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedKVSServer) Watch(*WatchRequest, KVS_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedKVSServer) mustEmbedUnimplementedKVSServer() {}
+
+// UnsafeKVSServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KVSServer will
+// result in compilation errors.
+type UnsafeKVSServer interface {
+	mustEmbedUnimplementedKVSServer()
+}
+
+func RegisterKVSServer(s grpc.ServiceRegistrar, srv KVSServer) {
+	s.RegisterService(&KVS_ServiceDesc, srv)
+}
+
+func _KVS_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVSServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVS_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVSServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVS_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVSServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVS_Put_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVSServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVS_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVSServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVS_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVSServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVS_Batch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVSServer).Batch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVS_Batch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVSServer).Batch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVS_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVSServer).Scan(m, &kVSScanServer{stream})
+}
+
+type KVS_ScanServer interface {
+	Send(*ScanResponse) error
+	grpc.ServerStream
+}
+
+type kVSScanServer struct {
+	grpc.ServerStream
+}
+
+func (x *kVSScanServer) Send(m *ScanResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _KVS_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVSServer).Watch(m, &kVSWatchServer{stream})
+}
+
+type KVS_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type kVSWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *kVSWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// KVS_ServiceDesc is the grpc.ServiceDesc for KVS service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KVS_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kvs.v1.KVS",
+	HandlerType: (*KVSServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _KVS_Get_Handler,
+		},
+		{
+			MethodName: "Put",
+			Handler:    _KVS_Put_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _KVS_Delete_Handler,
+		},
+		{
+			MethodName: "Batch",
+			Handler:    _KVS_Batch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _KVS_Scan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _KVS_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "kvs.proto",
+}
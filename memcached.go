@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the memcached text protocol
+const (
+	memcachedMaxKey   = 250
+	memcachedMaxValue = 1 << 20
+	// Expiry times above this many seconds are unix timestamps
+	memcachedRelativeExpiry = 60 * 60 * 24 * 30
+	// Attempts of incr and decr before they give up on a key other clients keep writing
+	memcachedIncrAttempts = 10
+)
+
+// A memcached client connection
+type memcachedSession struct {
+	frontendSession
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// Accept memcached clients on address until the listener fails
+func serveMemcached(address string, handler http.Handler) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Printf("Failed to start memcached listener on %s: %v\n", address, err)
+		return
+	}
+	fmt.Printf("Memcached listener started on %s\n", address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("Memcached listener stopped: %v\n", err)
+			return
+		}
+		session := &memcachedSession{
+			frontendSession: frontendSession{local: conn.LocalAddr(), remote: conn.RemoteAddr(), handler: handler},
+			conn:            conn,
+			reader:          bufio.NewReader(conn),
+			writer:          bufio.NewWriter(conn),
+		}
+		go session.serve()
+	}
+}
+
+// Answer the commands of a client until it disconnects
+func (s *memcachedSession) serve() {
+	defer s.conn.Close()
+	defer recoverSession(s.conn)
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" {
+			s.writer.Flush()
+			return
+		}
+		if !s.execute(args) {
+			s.writer.Flush()
+			return
+		}
+		// Pipelined commands are answered together
+		if s.reader.Buffered() == 0 {
+			if err := s.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Run a single command and write its reply
+// Returns false if the connection cannot be used any more
+func (s *memcachedSession) execute(args []string) bool {
+	switch args[0] {
+	case "get", "gets":
+		if len(args) < 2 {
+			s.reply("ERROR")
+			return true
+		}
+		s.get(args[1:], args[0] == "gets")
+	case "set", "add", "replace", "cas":
+		return s.store(args)
+	case "delete":
+		if len(args) < 2 || len(args) > 3 {
+			s.reply("ERROR")
+			return true
+		}
+		s.delete(args[1], len(args) == 3 && args[2] == "noreply")
+	case "incr", "decr":
+		if len(args) < 3 || len(args) > 4 {
+			s.reply("ERROR")
+			return true
+		}
+		s.incr(args[1], args[2], args[0] == "decr", len(args) == 4 && args[3] == "noreply")
+	case "version":
+		s.reply("VERSION kvs")
+	default:
+		s.reply("ERROR")
+	}
+	return true
+}
+
+// Write a reply line
+func (s *memcachedSession) reply(line string) {
+	s.writer.WriteString(line + "\r\n")
+}
+
+// Write the reply of a failed KVS request
+func (s *memcachedSession) replyKVSError(status int, reply map[string]interface{}) {
+	if message, ok := reply["error"].(string); ok {
+		s.reply("SERVER_ERROR " + message)
+		return
+	}
+	s.reply(fmt.Sprintf("SERVER_ERROR request failed with status %d", status))
+}
+
+// get <key>*
+// gets <key>*
+func (s *memcachedSession) get(keys []string, withCAS bool) {
+	for _, key := range keys {
+		status, reply := s.kvsRequest("GET", key, nil)
+		if status == http.StatusNotFound {
+			continue
+		}
+		if status != http.StatusOK {
+			s.replyKVSError(status, reply)
+			return
+		}
+		value := replyValueString(reply)
+		flags := replyUint(reply, "flags")
+		if withCAS {
+			s.reply(fmt.Sprintf("VALUE %s %d %d %d", key, flags, len(value), replyUint(reply, "version")))
+		} else {
+			s.reply(fmt.Sprintf("VALUE %s %d %d", key, flags, len(value)))
+		}
+		s.reply(value)
+	}
+	s.reply("END")
+}
+
+// <command> <key> <flags> <exptime> <bytes> [noreply]
+// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+// The data block follows the command line
+func (s *memcachedSession) store(args []string) bool {
+	command := args[0]
+	fieldCount := 5
+	if command == "cas" {
+		fieldCount = 6
+	}
+	if len(args) < fieldCount || len(args) > fieldCount+1 {
+		s.reply("ERROR")
+		return true
+	}
+	noreply := len(args) == fieldCount+1 && args[fieldCount] == "noreply"
+	key := args[1]
+	flags, flagsErr := strconv.ParseUint(args[2], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[3], 10, 64)
+	size, sizeErr := strconv.Atoi(args[4])
+	if flagsErr != nil || exptimeErr != nil || sizeErr != nil || size < 0 {
+		s.reply("CLIENT_ERROR bad command line format")
+		return true
+	}
+	if size > memcachedMaxValue {
+		s.reply("SERVER_ERROR object too large for cache")
+		// The data block cannot be skipped safely
+		return false
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(s.reader, data); err != nil {
+		return false
+	}
+	if string(data[size:]) != "\r\n" {
+		s.reply("CLIENT_ERROR bad data chunk")
+		return false
+	}
+	value := string(data[:size])
+	if len(key) > memcachedMaxKey {
+		s.reply("CLIENT_ERROR key too long")
+		return true
+	}
+	// An empty value is rejected by putKey
+	if value == "" {
+		s.reply("SERVER_ERROR empty values are not supported")
+		return true
+	}
+
+	fields := map[string]interface{}{"value": value, "flags": flags}
+	// The expiry time is stored with the value, so that every replica drops it
+	if exptime != 0 {
+		fields["expires-at"] = time.Now().Add(memcachedTTL(exptime)).UnixMilli()
+	}
+	switch command {
+	case "add":
+		fields["if-version"] = 0
+	case "replace":
+		fields["if-exists"] = true
+	case "cas":
+		casUnique, err := strconv.ParseUint(args[5], 10, 64)
+		if err != nil {
+			s.reply("CLIENT_ERROR bad command line format")
+			return true
+		}
+		fields["if-version"] = casUnique
+		fields["if-exists"] = true
+	}
+	status, reply := s.kvsRequest("PUT", key, fields)
+	var result string
+	switch {
+	case status == http.StatusOK || status == http.StatusCreated:
+		result = "STORED"
+	case status == http.StatusNotFound && command == "cas":
+		result = "NOT_FOUND"
+	case status == http.StatusConflict && command == "cas":
+		result = "EXISTS"
+	case status == http.StatusNotFound || status == http.StatusConflict:
+		result = "NOT_STORED"
+	default:
+		if !noreply {
+			s.replyKVSError(status, reply)
+		}
+		return true
+	}
+	if !noreply {
+		s.reply(result)
+	}
+	return true
+}
+
+// Returns the time left until exptime, given in seconds or as a unix timestamp
+// Negative times expire the item right away
+func memcachedTTL(exptime int64) time.Duration {
+	if exptime < 0 {
+		return 0
+	}
+	if exptime > memcachedRelativeExpiry {
+		return time.Until(time.Unix(exptime, 0))
+	}
+	return time.Duration(exptime) * time.Second
+}
+
+// delete <key> [noreply]
+func (s *memcachedSession) delete(key string, noreply bool) {
+	status, reply := s.kvsRequest("DELETE", key, nil)
+	if noreply {
+		return
+	}
+	switch status {
+	case http.StatusOK:
+		s.reply("DELETED")
+	case http.StatusNotFound:
+		s.reply("NOT_FOUND")
+	default:
+		s.replyKVSError(status, reply)
+	}
+}
+
+// incr <key> <value> [noreply]
+// decr <key> <value> [noreply]
+// The write only succeeds if no other write came in between, otherwise it starts over, up to memcachedIncrAttempts times
+func (s *memcachedSession) incr(key string, delta string, decrement bool, noreply bool) {
+	amount, err := strconv.ParseUint(delta, 10, 64)
+	if err != nil {
+		s.reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	for attempt := 0; attempt < memcachedIncrAttempts; attempt++ {
+		status, reply := s.kvsRequest("GET", key, nil)
+		if status == http.StatusNotFound {
+			if !noreply {
+				s.reply("NOT_FOUND")
+			}
+			return
+		}
+		if status != http.StatusOK {
+			s.replyKVSError(status, reply)
+			return
+		}
+		number, err := strconv.ParseUint(strings.TrimSpace(replyValueString(reply)), 10, 64)
+		if err != nil {
+			s.reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+			return
+		}
+		// Like memcached, increments wrap around and decrements stop at 0
+		if !decrement {
+			number += amount
+		} else if amount > number {
+			number = 0
+		} else {
+			number -= amount
+		}
+		fields := map[string]interface{}{
+			"value":      strconv.FormatUint(number, 10),
+			"flags":      replyUint(reply, "flags"),
+			"if-version": replyUint(reply, "version"),
+			// Like memcached, the item keeps its expiry
+			"expires-at": replyUint(reply, "expires-at"),
+		}
+		status, reply = s.kvsRequest("PUT", key, fields)
+		if status == http.StatusConflict {
+			continue
+		}
+		if status != http.StatusOK && status != http.StatusCreated {
+			s.replyKVSError(status, reply)
+			return
+		}
+		if !noreply {
+			s.reply(strconv.FormatUint(number, 10))
+		}
+		return
+	}
+	s.reply("SERVER_ERROR key " + key + " kept changing while it was incremented; try again later")
+}
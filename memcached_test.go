@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemcachedTTL(t *testing.T) {
+	if ttl := memcachedTTL(60); ttl != time.Minute {
+		t.Errorf("ttl of 60 is %v, want a minute", ttl)
+	}
+	if ttl := memcachedTTL(memcachedRelativeExpiry); ttl != memcachedRelativeExpiry*time.Second {
+		t.Errorf("ttl of 30 days is %v", ttl)
+	}
+	// Larger times are unix timestamps
+	at := time.Now().Add(time.Hour).Unix()
+	if ttl := memcachedTTL(at); ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("ttl of the timestamp an hour from now is %v", ttl)
+	}
+	if ttl := memcachedTTL(memcachedRelativeExpiry + 1); ttl >= 0 {
+		t.Errorf("ttl of a timestamp in the past is %v", ttl)
+	}
+	if ttl := memcachedTTL(-1); ttl != 0 {
+		t.Errorf("ttl of -1 is %v, want 0", ttl)
+	}
+}
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Addresses of the nodes that run the replicated metadata service
+// If empty, every node computes its own shard map like before
+var METADATA_NODES []string
+
+// Directory used to persist the metadata service's raft state (optional)
+var METADATA_DIR string
+
+// Latest cluster configuration this node has applied
+var CLUSTER_CONFIG Cluster_Config
+
+// Protects access to CLUSTER_CONFIG
+var clusterConfigMutex sync.Mutex
+
+// Closed and replaced every time a newer cluster configuration is applied
+var clusterConfigChanged = make(chan struct{})
+
+// Raft state of this node, nil if this node is not a metadata node
+var RAFT *metadataRaft
+
+// Cluster_Config is the single source of truth for membership and placement
+type Cluster_Config struct {
+	Version    uint64              `json:"version"`
+	View       []string            `json:"view"`
+	ShardCount int                 `json:"shard-count"`
+	Shards     map[string][]string `json:"shards"`
+	Ring       Ring_Config         `json:"ring"`
+	Ranges     []Key_Range         `json:"ranges,omitempty"`
+	Overrides  map[int]string      `json:"overrides,omitempty"`
+	Weights    map[string]float64  `json:"weights,omitempty"`
+}
+
+// Define JSON body for metadata config proposals
+type Config_Proposal struct {
+	BaseVersion uint64         `json:"base-version"`
+	Config      Cluster_Config `json:"config"`
+}
+
+// Define raft roles
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+// Raft timing
+const (
+	raftHeartbeatInterval  = 300 * time.Millisecond
+	raftElectionTimeoutMin = 1500 * time.Millisecond
+	raftElectionTimeoutMax = 3000 * time.Millisecond
+	raftRPCTimeout         = 500 * time.Millisecond
+	raftProposalTimeout    = 5 * time.Second
+	configWatchTimeout     = 10 * time.Second
+)
+
+// Raft_Entry is a single entry of the replicated log
+// Every entry carries a full cluster configuration
+type Raft_Entry struct {
+	Term   uint64         `json:"term"`
+	Config Cluster_Config `json:"config"`
+}
+
+// Define JSON body for /metadata/request-vote
+type Request_Vote struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last-log-index"`
+	LastLogTerm  uint64 `json:"last-log-term"`
+}
+
+type Request_Vote_Reply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote-granted"`
+}
+
+// Define JSON body for /metadata/append-entries
+type Append_Entries struct {
+	Term         uint64       `json:"term"`
+	Leader       string       `json:"leader"`
+	PrevLogIndex uint64       `json:"prev-log-index"`
+	PrevLogTerm  uint64       `json:"prev-log-term"`
+	Entries      []Raft_Entry `json:"entries"`
+	LeaderCommit uint64       `json:"leader-commit"`
+}
+
+type Append_Entries_Reply struct {
+	Term       uint64 `json:"term"`
+	Success    bool   `json:"success"`
+	MatchIndex uint64 `json:"match-index"`
+}
+
+// Persistent part of the raft state
+type raftPersistentState struct {
+	CurrentTerm uint64       `json:"current-term"`
+	VotedFor    string       `json:"voted-for"`
+	Log         []Raft_Entry `json:"log"`
+}
+
+type metadataRaft struct {
+	mu          sync.Mutex
+	role        int
+	currentTerm uint64
+	votedFor    string
+	leader      string
+	// log[0] is a sentinel so that log indices start at 1
+	log         []Raft_Entry
+	commitIndex uint64
+	lastApplied uint64
+	// Signalled when commitIndex moves past lastApplied
+	applyReady  chan struct{}
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	lastContact time.Time
+	timeout     time.Duration
+}
+
+// Returns true if the cluster configuration is managed by the metadata service
+func metadataEnabled() bool {
+	return len(METADATA_NODES) > 0
+}
+
+// Starts the metadata service on metadata nodes, or subscribes to it on every other node
+func startMetadataService() {
+	if !contains(METADATA_NODES, SOCKET_ADDRESS) {
+		go watchClusterConfig()
+		return
+	}
+	RAFT = &metadataRaft{
+		log:         []Raft_Entry{{}},
+		lastContact: time.Now(),
+		timeout:     randomElectionTimeout(),
+		applyReady:  make(chan struct{}, 1),
+	}
+	RAFT.restore()
+	go RAFT.run()
+	go RAFT.applyLoop()
+}
+
+// Ask the metadata service to add this node to the cluster configuration
+// The first node to join also creates the initial shard map
+func joinCluster(shardCount int) {
+	for {
+		cfg, err := updateClusterConfig(func(cfg *Cluster_Config) bool {
+			if cfg.Version == 0 && len(cfg.Shards) == 0 {
+				// Without a shard count we wait for another node to create the shard map
+				if shardCount < 1 {
+					return false
+				}
+				viewMutex.Lock()
+				cfg.View = append([]string{}, CURRENT_VIEW...)
+				viewMutex.Unlock()
+				cfg.ShardCount = shardCount
+				cfg.Shards = distributeNodesIntoShards(shardCount, cfg.View)
+				cfg.Ring = RING_CONFIG
+				return true
+			}
+			changed := false
+			if !contains(cfg.View, SOCKET_ADDRESS) {
+				cfg.View = append(cfg.View, SOCKET_ADDRESS)
+				changed = true
+			}
+			// A node that joins an existing cluster goes to the smallest shard
+			if shardOfNode(cfg.Shards, SOCKET_ADDRESS) == "" {
+				if shardid := smallestShard(cfg.Shards); shardid != "" {
+					cfg.Shards[shardid] = append(cfg.Shards[shardid], SOCKET_ADDRESS)
+					changed = true
+				}
+			}
+			return changed
+		})
+		if err == nil && cfg.Version > 0 {
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to join cluster through metadata service: %v\n", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Applies mutate to the latest cluster configuration and commits the result
+// through the metadata service, retrying if another update got there first
+func updateClusterConfig(mutate func(cfg *Cluster_Config) bool) (Cluster_Config, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		base := currentClusterConfig()
+		proposal := copyClusterConfig(base)
+		if !mutate(&proposal) {
+			return base, nil
+		}
+		jsonBytes, _ := json.Marshal(Config_Proposal{BaseVersion: base.Version, Config: proposal})
+		status, body, err := sendToMetadata("PUT", "metadata/config", jsonBytes)
+		if err != nil {
+			return base, err
+		}
+		var committed Cluster_Config
+		if err := json.Unmarshal(body, &committed); err != nil {
+			return base, fmt.Errorf("error decoding metadata response: %v", err)
+		}
+		switch status {
+		case http.StatusOK:
+			publishClusterConfig(committed)
+			return committed, nil
+		case http.StatusConflict:
+			// Someone else updated the config first, retry on top of theirs
+			publishClusterConfig(committed)
+		default:
+			return base, fmt.Errorf("metadata service returned status %d", status)
+		}
+	}
+	return currentClusterConfig(), fmt.Errorf("too many conflicting cluster config updates")
+}
+
+// Send a request to the metadata nodes until one of them answers
+func sendToMetadata(method string, endpoint string, jsonData []byte) (int, []byte, error) {
+	client := peerClient(raftProposalTimeout + time.Second)
+	for _, address := range METADATA_NODES {
+		url := fmt.Sprintf("http://%s/%s", address, endpoint)
+		request, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
+		if err != nil {
+			continue
+		}
+		resp, err := client.Do(request)
+		if err != nil {
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		drainAndClose(resp.Body)
+		if err != nil || resp.StatusCode == http.StatusServiceUnavailable {
+			continue
+		}
+		return resp.StatusCode, body, nil
+	}
+	return 0, nil, fmt.Errorf("no metadata node available")
+}
+
+// Returns a copy of the latest applied cluster configuration
+func currentClusterConfig() Cluster_Config {
+	clusterConfigMutex.Lock()
+	defer clusterConfigMutex.Unlock()
+	return copyClusterConfig(CLUSTER_CONFIG)
+}
+
+// Deep copies a cluster configuration
+func copyClusterConfig(cfg Cluster_Config) Cluster_Config {
+	cfg.View = append([]string{}, cfg.View...)
+	shards := make(map[string][]string)
+	for shardid, nodes := range cfg.Shards {
+		shards[shardid] = append([]string{}, nodes...)
+	}
+	cfg.Shards = shards
+	cfg.Ranges = append([]Key_Range(nil), cfg.Ranges...)
+	if cfg.Overrides != nil {
+		overrides := make(map[int]string)
+		for partID, shardid := range cfg.Overrides {
+			overrides[partID] = shardid
+		}
+		cfg.Overrides = overrides
+	}
+	cfg.Weights = pruneWeights(cfg.Weights, cfg.Shards)
+	return cfg
+}
+
+// Blocks until a configuration newer than version is applied or the timeout expires
+func waitForClusterConfig(version uint64, timeout time.Duration) Cluster_Config {
+	deadline := time.After(timeout)
+	for {
+		clusterConfigMutex.Lock()
+		cfg := CLUSTER_CONFIG
+		changed := clusterConfigChanged
+		clusterConfigMutex.Unlock()
+		if cfg.Version > version {
+			return copyClusterConfig(cfg)
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return copyClusterConfig(cfg)
+		}
+	}
+}
+
+// Stores a newer cluster configuration and applies it to this node
+// The lock is held while applying so that configs are applied in version order
+func publishClusterConfig(cfg Cluster_Config) {
+	clusterConfigMutex.Lock()
+	defer clusterConfigMutex.Unlock()
+	if cfg.Version <= CLUSTER_CONFIG.Version {
+		return
+	}
+	CLUSTER_CONFIG = copyClusterConfig(cfg)
+	applyClusterConfig(cfg)
+	close(clusterConfigChanged)
+	clusterConfigChanged = make(chan struct{})
+}
+
+// Replace this node's view, shard map and hash ring with the ones in cfg
+func applyClusterConfig(cfg Cluster_Config) {
+	cfg = copyClusterConfig(cfg)
+	viewMutex.Lock()
+	CURRENT_VIEW = cfg.View
+	LAST_AGREED_VIEW = append([]string{}, cfg.View...)
+	viewMutex.Unlock()
+	if cfg.Ring.PartitionCount > 0 {
+		RING_CONFIG = cfg.Ring
+	}
+	SHARDS = cfg.Shards
+	if cfg.Ranges != nil {
+		RANGES = cfg.Ranges
+	}
+	PARTITION_OVERRIDES = pruneOverrides(cfg.Overrides, cfg.Shards)
+	SHARD_WEIGHTS = pruneWeights(cfg.Weights, cfg.Shards)
+	updateMyShardID()
+	// A node that has not synced yet gets its data and vector clock from its shard
+	if MY_VECTOR_CLOCK == nil && MY_SHARD_ID != "" {
+		if err := syncWithShard(MY_SHARD_ID); err != nil {
+			// Start empty if no other member of the shard is up yet
+			initializeEmptyNode()
+		}
+		SHARDS = cfg.Shards
+	}
+	if MY_VECTOR_CLOCK != nil {
+		vectorClockMutex.Lock()
+		for _, address := range cfg.View {
+			if _, ok := MY_VECTOR_CLOCK.FindTicks(address); !ok {
+				MY_VECTOR_CLOCK.Set(address, 0)
+			}
+		}
+		vectorClockMutex.Unlock()
+	}
+	rebuildRouting()
+	fmt.Printf("Applied cluster config version %d, my shard: %s\n", cfg.Version, MY_SHARD_ID)
+}
+
+// Long-poll the metadata nodes for configuration changes
+func watchClusterConfig() {
+	client := peerClient(configWatchTimeout + 5*time.Second)
+	for {
+		updated := false
+		for _, address := range METADATA_NODES {
+			version := currentClusterConfig().Version
+			url := fmt.Sprintf("http://%s/metadata/config?version=%d", address, version)
+			resp, err := client.Get(url)
+			if err != nil {
+				continue
+			}
+			var cfg Cluster_Config
+			err = json.NewDecoder(resp.Body).Decode(&cfg)
+			drainAndClose(resp.Body)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				continue
+			}
+			publishClusterConfig(cfg)
+			updated = true
+			break
+		}
+		if !updated {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// GET /metadata/config?version=<N>
+// Returns the cluster configuration once it is newer than version <N>
+func getClusterConfig(c echo.Context) error {
+	version, err := strconv.ParseUint(c.QueryParam("version"), 10, 64)
+	if err != nil {
+		version = 0
+	}
+	cfg := currentClusterConfig()
+	if c.QueryParam("version") != "" {
+		cfg = waitForClusterConfig(version, configWatchTimeout)
+	}
+	return c.JSON(http.StatusOK, cfg)
+}
+
+// PUT /metadata/config
+// JSON body {"base-version": <N>, "config": {...}}
+// Commits a new cluster configuration through raft
+func putClusterConfig(c echo.Context) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+	var input Config_Proposal
+	if err := json.Unmarshal(body, &input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	if RAFT == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Not a metadata node"})
+	}
+	RAFT.mu.Lock()
+	role, leader := RAFT.role, RAFT.leader
+	RAFT.mu.Unlock()
+	if role != raftLeader {
+		if leader == "" || leader == SOCKET_ADDRESS {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "No metadata leader elected"})
+		}
+		return forwardRequest(c, leader, "metadata/config", body)
+	}
+	cfg, status := RAFT.propose(input)
+	return c.JSON(status, cfg)
+}
+
+// POST /metadata/request-vote
+func requestVote(c echo.Context) error {
+	var input Request_Vote
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	if RAFT == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Not a metadata node"})
+	}
+	return c.JSON(http.StatusOK, RAFT.handleRequestVote(input))
+}
+
+// POST /metadata/append-entries
+func appendEntries(c echo.Context) error {
+	var input Append_Entries
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	if RAFT == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Not a metadata node"})
+	}
+	return c.JSON(http.StatusOK, RAFT.handleAppendEntries(input))
+}
+
+func randomElectionTimeout() time.Duration {
+	spread := int64(raftElectionTimeoutMax - raftElectionTimeoutMin)
+	return raftElectionTimeoutMin + time.Duration(rand.Int63n(spread))
+}
+
+// Returns the number of metadata nodes needed for a majority
+func raftQuorum() int {
+	return len(METADATA_NODES)/2 + 1
+}
+
+// Main raft loop: send heartbeats as leader, start elections as follower
+func (r *metadataRaft) run() {
+	lastHeartbeat := time.Time{}
+	for {
+		time.Sleep(50 * time.Millisecond)
+		r.mu.Lock()
+		role := r.role
+		expired := time.Since(r.lastContact) > r.timeout
+		r.mu.Unlock()
+		if role == raftLeader {
+			if time.Since(lastHeartbeat) >= raftHeartbeatInterval {
+				lastHeartbeat = time.Now()
+				r.replicateToAll()
+			}
+		} else if expired {
+			r.startElection()
+		}
+	}
+}
+
+func (r *metadataRaft) lastLogIndexAndTerm() (uint64, uint64) {
+	last := uint64(len(r.log) - 1)
+	return last, r.log[last].Term
+}
+
+// Called with the lock held when a message with a higher term is seen
+func (r *metadataRaft) stepDown(term uint64) {
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+	}
+	r.role = raftFollower
+	r.persist()
+}
+
+func (r *metadataRaft) startElection() {
+	r.mu.Lock()
+	r.role = raftCandidate
+	r.currentTerm++
+	r.votedFor = SOCKET_ADDRESS
+	r.leader = ""
+	r.lastContact = time.Now()
+	r.timeout = randomElectionTimeout()
+	r.persist()
+	lastIndex, lastTerm := r.lastLogIndexAndTerm()
+	request := Request_Vote{Term: r.currentTerm, Candidate: SOCKET_ADDRESS, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+	r.mu.Unlock()
+
+	votes := 1
+	var votesMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, address := range METADATA_NODES {
+		if address == SOCKET_ADDRESS {
+			continue
+		}
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			var reply Request_Vote_Reply
+			if err := sendRaftMessage(address, "metadata/request-vote", request, &reply); err != nil {
+				return
+			}
+			r.mu.Lock()
+			if reply.Term > r.currentTerm {
+				r.stepDown(reply.Term)
+			}
+			r.mu.Unlock()
+			if reply.VoteGranted {
+				votesMutex.Lock()
+				votes++
+				votesMutex.Unlock()
+			}
+		}(address)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role != raftCandidate || r.currentTerm != request.Term || votes < raftQuorum() {
+		return
+	}
+	fmt.Printf("Elected metadata leader for term %d\n", r.currentTerm)
+	r.role = raftLeader
+	r.leader = SOCKET_ADDRESS
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	for _, address := range METADATA_NODES {
+		r.nextIndex[address] = uint64(len(r.log))
+		r.matchIndex[address] = 0
+	}
+	// Append an entry for the new term so earlier entries can be committed
+	r.log = append(r.log, Raft_Entry{Term: r.currentTerm, Config: r.log[len(r.log)-1].Config})
+	r.persist()
+	r.advanceCommitIndex()
+}
+
+// Send append-entries to every other metadata node
+func (r *metadataRaft) replicateToAll() {
+	for _, address := range METADATA_NODES {
+		if address == SOCKET_ADDRESS {
+			continue
+		}
+		go r.replicateTo(address)
+	}
+}
+
+func (r *metadataRaft) replicateTo(address string) {
+	r.mu.Lock()
+	if r.role != raftLeader {
+		r.mu.Unlock()
+		return
+	}
+	next := r.nextIndex[address]
+	if next < 1 {
+		next = 1
+	}
+	request := Append_Entries{
+		Term:         r.currentTerm,
+		Leader:       SOCKET_ADDRESS,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.log[next-1].Term,
+		Entries:      append([]Raft_Entry{}, r.log[next:]...),
+		LeaderCommit: r.commitIndex,
+	}
+	r.mu.Unlock()
+
+	var reply Append_Entries_Reply
+	if err := sendRaftMessage(address, "metadata/append-entries", request, &reply); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reply.Term > r.currentTerm {
+		r.stepDown(reply.Term)
+		return
+	}
+	if r.role != raftLeader || r.currentTerm != request.Term {
+		return
+	}
+	if reply.Success {
+		match := request.PrevLogIndex + uint64(len(request.Entries))
+		if match > r.matchIndex[address] {
+			r.matchIndex[address] = match
+		}
+		r.nextIndex[address] = r.matchIndex[address] + 1
+		r.advanceCommitIndex()
+	} else if r.nextIndex[address] > 1 {
+		r.nextIndex[address] = reply.MatchIndex + 1
+	}
+}
+
+// Commit the highest entry of the current term stored on a majority
+// Called with the lock held
+func (r *metadataRaft) advanceCommitIndex() {
+	for n := uint64(len(r.log) - 1); n > r.commitIndex; n-- {
+		if r.log[n].Term != r.currentTerm {
+			break
+		}
+		count := 1
+		for address, match := range r.matchIndex {
+			if address != SOCKET_ADDRESS && match >= n {
+				count++
+			}
+		}
+		if count >= raftQuorum() {
+			r.commitIndex = n
+			break
+		}
+	}
+	r.applyCommitted()
+}
+
+// Wake up the apply loop to apply newly committed entries
+// Called with the lock held
+func (r *metadataRaft) applyCommitted() {
+	if r.lastApplied < r.commitIndex {
+		select {
+		case r.applyReady <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Apply committed entries one at a time and in log order
+// Applying may sync data from other nodes, so it happens without the lock held
+func (r *metadataRaft) applyLoop() {
+	for range r.applyReady {
+		for {
+			r.mu.Lock()
+			if r.lastApplied >= r.commitIndex {
+				r.mu.Unlock()
+				break
+			}
+			r.lastApplied++
+			cfg := r.log[r.lastApplied].Config
+			r.mu.Unlock()
+			publishClusterConfig(cfg)
+		}
+	}
+}
+
+func (r *metadataRaft) handleRequestVote(request Request_Vote) Request_Vote_Reply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if request.Term > r.currentTerm {
+		r.stepDown(request.Term)
+	}
+	reply := Request_Vote_Reply{Term: r.currentTerm}
+	if request.Term < r.currentTerm {
+		return reply
+	}
+	lastIndex, lastTerm := r.lastLogIndexAndTerm()
+	upToDate := request.LastLogTerm > lastTerm || (request.LastLogTerm == lastTerm && request.LastLogIndex >= lastIndex)
+	if (r.votedFor == "" || r.votedFor == request.Candidate) && upToDate {
+		r.votedFor = request.Candidate
+		r.lastContact = time.Now()
+		r.persist()
+		reply.VoteGranted = true
+	}
+	return reply
+}
+
+func (r *metadataRaft) handleAppendEntries(request Append_Entries) Append_Entries_Reply {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if request.Term < r.currentTerm {
+		return Append_Entries_Reply{Term: r.currentTerm}
+	}
+	if request.Term > r.currentTerm || r.role != raftFollower {
+		r.stepDown(request.Term)
+	}
+	r.leader = request.Leader
+	r.lastContact = time.Now()
+
+	reply := Append_Entries_Reply{Term: r.currentTerm}
+	// Reject if our log does not contain the entry preceding the new ones
+	if request.PrevLogIndex >= uint64(len(r.log)) || r.log[request.PrevLogIndex].Term != request.PrevLogTerm {
+		hint := uint64(len(r.log) - 1)
+		if request.PrevLogIndex > 0 && hint >= request.PrevLogIndex {
+			hint = request.PrevLogIndex - 1
+		}
+		reply.MatchIndex = hint
+		return reply
+	}
+	for i, entry := range request.Entries {
+		index := request.PrevLogIndex + 1 + uint64(i)
+		if index < uint64(len(r.log)) {
+			if r.log[index].Term == entry.Term {
+				continue
+			}
+			// Drop the conflicting entry and everything after it
+			r.log = r.log[:index]
+		}
+		r.log = append(r.log, entry)
+	}
+	r.persist()
+	lastNew := request.PrevLogIndex + uint64(len(request.Entries))
+	if request.LeaderCommit > r.commitIndex {
+		r.commitIndex = request.LeaderCommit
+		if lastNew < r.commitIndex {
+			r.commitIndex = lastNew
+		}
+		r.applyCommitted()
+	}
+	reply.Success = true
+	reply.MatchIndex = lastNew
+	return reply
+}
+
+// Append a new configuration to the log and wait until it is committed
+// Returns the committed config and the HTTP status to respond with
+func (r *metadataRaft) propose(proposal Config_Proposal) (Cluster_Config, int) {
+	r.mu.Lock()
+	latest := r.log[len(r.log)-1].Config
+	if proposal.BaseVersion != latest.Version {
+		r.mu.Unlock()
+		return latest, http.StatusConflict
+	}
+	cfg := copyClusterConfig(proposal.Config)
+	cfg.Version = latest.Version + 1
+	r.log = append(r.log, Raft_Entry{Term: r.currentTerm, Config: cfg})
+	index := uint64(len(r.log) - 1)
+	term := r.currentTerm
+	r.persist()
+	r.advanceCommitIndex()
+	r.mu.Unlock()
+
+	r.replicateToAll()
+	deadline := time.Now().Add(raftProposalTimeout)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		committed := r.commitIndex >= index
+		lost := r.currentTerm != term || uint64(len(r.log)) <= index || r.log[index].Term != term
+		r.mu.Unlock()
+		if lost {
+			return cfg, http.StatusServiceUnavailable
+		}
+		if committed {
+			publishClusterConfig(cfg)
+			return cfg, http.StatusOK
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cfg, http.StatusServiceUnavailable
+}
+
+// Write term, vote and log to METADATA_DIR
+// Called with the lock held
+func (r *metadataRaft) persist() {
+	if METADATA_DIR == "" {
+		return
+	}
+	state := raftPersistentState{CurrentTerm: r.currentTerm, VotedFor: r.votedFor, Log: r.log}
+	jsonBytes, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(METADATA_DIR, "raft.json")
+	if err := os.WriteFile(path+".tmp", jsonBytes, 0644); err != nil {
+		fmt.Printf("Failed to persist raft state: %v\n", err)
+		return
+	}
+	os.Rename(path+".tmp", path)
+}
+
+// Load term, vote and log from METADATA_DIR if present
+func (r *metadataRaft) restore() {
+	if METADATA_DIR == "" {
+		return
+	}
+	jsonBytes, err := os.ReadFile(filepath.Join(METADATA_DIR, "raft.json"))
+	if err != nil {
+		return
+	}
+	var state raftPersistentState
+	if err := json.Unmarshal(jsonBytes, &state); err != nil || len(state.Log) == 0 {
+		return
+	}
+	r.currentTerm = state.CurrentTerm
+	r.votedFor = state.VotedFor
+	r.log = state.Log
+}
+
+// POST a raft message to another metadata node and decode its reply
+func sendRaftMessage(address string, endpoint string, payload interface{}, reply interface{}) error {
+	client := peerClient(raftRPCTimeout)
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("http://%s/%s", address, endpoint)
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %d from %s", resp.StatusCode, address)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
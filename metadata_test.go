@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/DistributedClocks/GoVector/govec/vclock"
+)
+
+// Returns a follower whose log holds entries of the given terms, each with the next config version
+func newTestRaft(terms ...uint64) *metadataRaft {
+	r := &metadataRaft{log: []Raft_Entry{{}}, applyReady: make(chan struct{}, 1)}
+	for i, term := range terms {
+		r.log = append(r.log, Raft_Entry{Term: term, Config: Cluster_Config{Version: uint64(i + 1)}})
+		r.currentTerm = term
+	}
+	return r
+}
+
+func TestAppendEntriesReplacesConflictingEntries(t *testing.T) {
+	METADATA_DIR = ""
+	// Entry 3 was never committed by the leader of term 2
+	r := newTestRaft(1, 1, 2)
+	reply := r.handleAppendEntries(Append_Entries{
+		Term: 3, Leader: "leader", PrevLogIndex: 2, PrevLogTerm: 1,
+		Entries:      []Raft_Entry{{Term: 3, Config: Cluster_Config{Version: 3}}},
+		LeaderCommit: 5,
+	})
+	if !reply.Success || reply.MatchIndex != 3 {
+		t.Fatalf("append returned %+v", reply)
+	}
+	if len(r.log) != 4 || r.log[3].Term != 3 {
+		t.Errorf("entry 3 has term %d in a log of %d entries, want the leader's", r.log[3].Term, len(r.log))
+	}
+	// Only entries the follower has are committed
+	if r.commitIndex != 3 {
+		t.Errorf("commit index is %d, want 3", r.commitIndex)
+	}
+	if r.currentTerm != 3 || r.leader != "leader" {
+		t.Errorf("follower is at term %d following %q", r.currentTerm, r.leader)
+	}
+
+	// Sending entries the follower already has again changes nothing
+	r.handleAppendEntries(Append_Entries{Term: 3, Leader: "leader", PrevLogIndex: 1, PrevLogTerm: 1, Entries: r.log[2:4]})
+	if len(r.log) != 4 {
+		t.Errorf("log has %d entries after a repeated append", len(r.log))
+	}
+}
+
+func TestAppendEntriesRejectsGaps(t *testing.T) {
+	METADATA_DIR = ""
+	r := newTestRaft(1, 1)
+	reply := r.handleAppendEntries(Append_Entries{Term: 1, Leader: "leader", PrevLogIndex: 5, PrevLogTerm: 1, Entries: []Raft_Entry{{Term: 1}}})
+	if reply.Success || reply.MatchIndex != 2 {
+		t.Errorf("append after a gap returned %+v, want a hint of 2", reply)
+	}
+	reply = r.handleAppendEntries(Append_Entries{Term: 1, Leader: "leader", PrevLogIndex: 2, PrevLogTerm: 3})
+	if reply.Success || reply.MatchIndex != 1 {
+		t.Errorf("append after an entry of another term returned %+v, want a hint of 1", reply)
+	}
+	// Messages of an old leader are refused
+	if reply := r.handleAppendEntries(Append_Entries{Term: 0, Leader: "old"}); reply.Success || reply.Term != 1 {
+		t.Errorf("append of an older term returned %+v", reply)
+	}
+}
+
+func TestRequestVote(t *testing.T) {
+	METADATA_DIR = ""
+	r := newTestRaft(1, 2)
+	// A candidate whose log ends in an older term would lose committed entries
+	if reply := r.handleRequestVote(Request_Vote{Term: 3, Candidate: "a", LastLogIndex: 5, LastLogTerm: 1}); reply.VoteGranted {
+		t.Error("voted for a candidate with an older log")
+	}
+	if reply := r.handleRequestVote(Request_Vote{Term: 3, Candidate: "b", LastLogIndex: 2, LastLogTerm: 2}); !reply.VoteGranted {
+		t.Error("refused a candidate with the same log")
+	}
+	// One vote per term
+	if reply := r.handleRequestVote(Request_Vote{Term: 3, Candidate: "c", LastLogIndex: 2, LastLogTerm: 2}); reply.VoteGranted {
+		t.Error("voted twice in term 3")
+	}
+	if reply := r.handleRequestVote(Request_Vote{Term: 4, Candidate: "c", LastLogIndex: 2, LastLogTerm: 2}); !reply.VoteGranted || reply.Term != 4 {
+		t.Errorf("vote in a new term returned %+v", reply)
+	}
+}
+
+func TestRaftStateSurvivesRestart(t *testing.T) {
+	METADATA_DIR = t.TempDir()
+	defer func() { METADATA_DIR = "" }()
+	r := newTestRaft(1, 2)
+	r.mu.Lock()
+	r.votedFor = "a"
+	r.persist()
+	r.mu.Unlock()
+
+	restarted := newTestRaft()
+	restarted.restore()
+	if restarted.currentTerm != 2 || restarted.votedFor != "a" || len(restarted.log) != 3 || restarted.log[2].Config.Version != 2 {
+		t.Errorf("restored term %d, vote %q and %d entries", restarted.currentTerm, restarted.votedFor, len(restarted.log)-1)
+	}
+}
+
+// A proposal based on an older config is refused with the latest one, so that the proposer can retry on top of it
+func TestProposeRequiresLatestBase(t *testing.T) {
+	METADATA_DIR = ""
+	useTransport(t, transportHTTP)
+	SOCKET_ADDRESS = "127.0.0.1:2"
+	METADATA_NODES = []string{SOCKET_ADDRESS}
+	defer func() { METADATA_NODES = nil }()
+	CLUSTER_CONFIG = Cluster_Config{}
+	vectorClockMutex.Lock()
+	MY_VECTOR_CLOCK = vclock.New()
+	vectorClockMutex.Unlock()
+	r := newTestRaft(1)
+	r.role = raftLeader
+	r.matchIndex = map[string]uint64{}
+	r.nextIndex = map[string]uint64{}
+
+	cfg := Cluster_Config{View: []string{SOCKET_ADDRESS}, ShardCount: 1, Shards: map[string][]string{"shard0": {SOCKET_ADDRESS}}}
+	committed, status := r.propose(Config_Proposal{BaseVersion: 1, Config: cfg})
+	if status != http.StatusOK || committed.Version != 2 {
+		t.Fatalf("proposal returned %d with version %d", status, committed.Version)
+	}
+	if current := currentClusterConfig(); current.Version != 2 || MY_SHARD_ID != "shard0" {
+		t.Errorf("committed config was not applied: version %d, shard %q", current.Version, MY_SHARD_ID)
+	}
+	latest, status := r.propose(Config_Proposal{BaseVersion: 1, Config: cfg})
+	if status != http.StatusConflict || latest.Version != 2 {
+		t.Errorf("stale proposal returned %d with version %d", status, latest.Version)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry of every metric served on /metrics
+var METRICS = prometheus.NewRegistry()
+
+// Requests served, by method, route and status
+var requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kvs_http_requests_total",
+	Help: "Requests served, by method, route and status.",
+}, []string{"method", "path", "status"})
+
+// Time taken to serve requests, by method, route and status
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "kvs_http_request_duration_seconds",
+	Help:    "Time taken to serve requests, by method, route and status.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "path", "status"})
+
+// Requests forwarded to another node, by node
+var forwardedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kvs_forwarded_requests_total",
+	Help: "Requests forwarded to the node that can serve them, by node.",
+}, []string{"node"})
+
+// Replication requests sent again because the receiver answered 503
+var replicationRetries = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "kvs_replication_retries_total",
+	Help: "Replication requests sent again because the receiver could not apply them yet.",
+})
+
+// Replication requests given up because the receiver could not be reached
+var replicationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "kvs_replication_failures_total",
+	Help: "Replication requests given up because the receiver could not be reached.",
+})
+
+// Requests answered 503 because their causal dependencies had not arrived, by who sent them
+var causalWaits = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kvs_causal_waits_total",
+	Help: "Requests answered 503 because their causal dependencies had not arrived yet, by sender (client or replica).",
+}, []string{"sender"})
+
+// Heartbeats that found a node down, by node
+var heartbeatFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kvs_heartbeat_failures_total",
+	Help: "Heartbeats that found a node down, by node.",
+}, []string{"node"})
+
+// Time taken by reshards coordinated by this node, by how they ended
+var reshardDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "kvs_reshard_duration_seconds",
+	Help:    "Time taken by reshards coordinated by this node, by final state.",
+	Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+}, []string{"state"})
+
+// Time taken by each phase of the reshards coordinated by this node
+var reshardPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "kvs_reshard_phase_duration_seconds",
+	Help:    "Time taken by each phase of the reshards coordinated by this node.",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+}, []string{"phase"})
+
+// Reports the state of the node when it is scraped
+type stateCollector struct {
+	keys *prometheus.Desc
+}
+
+func (s stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.keys
+}
+
+func (s stateCollector) Collect(ch chan<- prometheus.Metric) {
+	KVSmutex.Lock()
+	count := len(KVStore)
+	KVSmutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(s.keys, prometheus.GaugeValue, float64(count), MY_SHARD_ID)
+}
+
+func init() {
+	METRICS.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		forwardedTotal,
+		replicationRetries,
+		replicationFailures,
+		causalWaits,
+		heartbeatFailures,
+		reshardDuration,
+		reshardPhaseDuration,
+		stateCollector{keys: prometheus.NewDesc("kvs_shard_keys", "Keys stored by this node, labelled with its shard.", []string{"shard"}, nil)},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "kvs_replication_queue_depth",
+			Help: "Replication requests sent by this node that have not completed yet.",
+		}, func() float64 { return float64(pendingSends.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "kvs_vector_clock_entries",
+			Help: "Number of nodes in the vector clock of this node.",
+		}, func() float64 {
+			vectorClockMutex.Lock()
+			defer vectorClockMutex.Unlock()
+			return float64(len(MY_VECTOR_CLOCK))
+		}),
+	)
+}
+
+// GET /metrics
+// Returns every metric in the Prometheus text format
+var getMetrics = echo.WrapHandler(promhttp.HandlerFor(METRICS, promhttp.HandlerOpts{}))
+
+// Count every request and the time it took by route and status
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		status := c.Response().Status
+		if err != nil {
+			// The error handler writes the response after the middleware returns
+			status = http.StatusInternalServerError
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				status = httpErr.Code
+			}
+		}
+		// Routes rather than URIs, so that every key does not get its own series
+		path := c.Path()
+		if path == "" {
+			path = "unmatched"
+		}
+		labels := []string{c.Request().Method, path, strconv.Itoa(status)}
+		requestsTotal.WithLabelValues(labels...).Inc()
+		requestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(metricsMiddleware)
+	e.PUT("/kvs/:key", func(c echo.Context) error {
+		return c.JSON(http.StatusCreated, map[string]string{"result": "created"})
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusBadGateway)
+	})
+	counter := func(method string, path string, status string) float64 {
+		return testutil.ToFloat64(requestsTotal.WithLabelValues(method, path, status))
+	}
+	created, failed, unmatched := counter("PUT", "/kvs/:key", "201"), counter("GET", "/fail", "502"), counter("GET", "unmatched", "404")
+
+	for _, key := range []string{"a", "b"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/kvs/"+key, nil))
+	}
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nowhere", nil))
+
+	// Every key counts for its route
+	if got := counter("PUT", "/kvs/:key", "201") - created; got != 2 {
+		t.Errorf("counted %v PUTs", got)
+	}
+	if got := counter("GET", "/fail", "502") - failed; got != 1 {
+		t.Errorf("counted %v failed requests", got)
+	}
+	if got := counter("GET", "unmatched", "404") - unmatched; got != 1 {
+		t.Errorf("counted %v unmatched requests", got)
+	}
+}
+
+func TestGetMetrics(t *testing.T) {
+	MY_SHARD_ID = "shard0"
+	KVSmutex.Lock()
+	KVStore = map[string]Value{"a": {Data: "1"}, "b": {Data: "2"}}
+	KVSmutex.Unlock()
+	e := echo.New()
+	e.GET("/metrics", getMetrics)
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	for _, line := range []string{`kvs_shard_keys{shard="shard0"} 2`, "kvs_replication_queue_depth 0", "# TYPE kvs_vector_clock_entries gauge"} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics do not have %q", line)
+		}
+	}
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 
@@ -29,6 +29,16 @@ var MY_SHARD_ID string
 // Protects access to CURRENT_VIEW
 var viewMutex sync.Mutex
 
+// Protects MY_VECTOR_CLOCK while it is compared and updated
+var vectorClockMutex sync.Mutex
+
+// Returns MY_VECTOR_CLOCK as a string, read under vectorClockMutex
+func vectorClockString() string {
+	vectorClockMutex.Lock()
+	defer vectorClockMutex.Unlock()
+	return MY_VECTOR_CLOCK.ReturnVCString()
+}
+
 // KVStore represents the in-memory key-value store
 var KVStore = make(map[string]Value)
 
@@ -36,12 +46,21 @@ var KVStore = make(map[string]Value)
 type Value struct {
 	Data interface{}
 	Type string
+	// Identifies the write that stored the value, used for compare-and-swap; see nextVersion
+	Version uint64 `json:",omitempty"`
+	// Opaque client flags, as used by memcached
+	Flags uint32 `json:",omitempty"`
+	// Unix time in milliseconds after which the value reads as missing; 0 if it never expires
+	Expires int64 `json:",omitempty"`
 }
 
 type Sync_Data struct {
-	KvsSync        string `json:"kvsCopy"`
-	VectorClockStr string `json:"vectorClock"`
-	ShardsString   string `json:"shard"`
+	KvsSync        string             `json:"kvsCopy"`
+	VectorClockStr string             `json:"vectorClock"`
+	ShardsString   string             `json:"shard"`
+	Ranges         []Key_Range        `json:"ranges,omitempty"`
+	Overrides      map[int]string     `json:"overrides,omitempty"`
+	Weights        map[string]float64 `json:"weights,omitempty"`
 }
 
 // GET /sync
@@ -67,12 +86,15 @@ func syncHandler(c echo.Context) error {
 	shardsString := string(jsonBytes)
 
 	// Convert Vector Clock to string
-	vcString := MY_VECTOR_CLOCK.ReturnVCString()
+	vcString := vectorClockString()
 
 	syncData := Sync_Data{
 		KvsSync:        kvsString,
 		VectorClockStr: vcString,
 		ShardsString:   shardsString,
+		Ranges:         RANGES,
+		Overrides:      PARTITION_OVERRIDES,
+		Weights:        SHARD_WEIGHTS,
 	}
 
 	// Send the current view and vector clock as a JSON response
@@ -80,17 +102,51 @@ func syncHandler(c echo.Context) error {
 }
 
 func main() {
+	// Load tunables from the config file, env vars and flags
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	CONFIG = cfg
+	// Requests to other nodes go through the configured transport
+	PEER_TRANSPORT = newTransport(CONFIG.Transport)
+	RING_CONFIG = Ring_Config{
+		PartitionCount:    CONFIG.PartitionCount,
+		ReplicationFactor: CONFIG.ReplicationFactor,
+		Load:              CONFIG.Load,
+	}
+	// Reload the reshard jobs this node took part in
+	loadReshardJobs()
 	// Read environment variables
 	SOCKET_ADDRESS = os.Getenv("SOCKET_ADDRESS")
-	CURRENT_VIEW = strings.Split(os.Getenv("VIEW"), ",")
-	SHARD_COUNT, err := strconv.Atoi(os.Getenv("SHARD_COUNT"))
-	// Check if SHARD_COUNT was specified
-	if err == nil {
-		syncMyself(SHARD_COUNT)
+	// Spans are labelled with the address of the node
+	if err := initTracing(); err != nil {
+		fmt.Printf("Failed to set up tracing: %v\n", err)
+		os.Exit(1)
+	}
+	if view := os.Getenv("VIEW"); view != "" {
+		CURRENT_VIEW = strings.Split(view, ",")
+	} else {
+		CURRENT_VIEW = []string{SOCKET_ADDRESS}
+	}
+	setAgreedView(CURRENT_VIEW)
+	// Check if the cluster config is managed by the metadata service
+	if metadataNodes := os.Getenv("METADATA_NODES"); metadataNodes != "" {
+		METADATA_NODES = strings.Split(metadataNodes, ",")
+		METADATA_DIR = os.Getenv("METADATA_DIR")
+		startMetadataService()
+		go joinCluster(CONFIG.ShardCount)
+	} else if seeds := os.Getenv("SEEDS"); seeds != "" && os.Getenv("VIEW") == "" {
+		// Join an existing cluster through the seed nodes
+		bootstrapFromSeeds(strings.Split(seeds, ","))
+	} else if CONFIG.ShardCount > 0 {
+		// Check if a shard count was specified
+		syncMyself(CONFIG.ShardCount)
 		// Store my shard id
 		updateMyShardID()
 		// Create a hash ring to represent the distribution of shards
-		HASH_RING = createHashRing()
+		rebuildRouting()
 	}
 	// Define new Echo instance
 	e := echo.New()
@@ -104,18 +160,23 @@ func main() {
 		LogUserAgent: true,
 		LogRemoteIP:  true,
 		BeforeNextFunc: func(c echo.Context) {
-			c.Set("vclock", MY_VECTOR_CLOCK.ReturnVCString())
+			c.Set("vclock", vectorClockString())
 		},
 		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
 			//vclock, _ := c.Get("vclock").(string)
 			//method := strings.ToUpper(v.Method)
-			if v.URI == "/view" {
+			if v.URI == "/view" || v.URI == "/metrics" {
 				return nil
 			}
 			fmt.Printf("%v %s %v status: %v shard: %s  \n  shardMap: %v\n  view: %v\n\n", v.RemoteIP, v.Method, v.URI, v.Status, MY_SHARD_ID, SHARDS, CURRENT_VIEW)
 			return nil
 		},
 	}))
+	// Continue the trace of requests sent by other nodes
+	e.Use(tracingMiddleware)
+	// Count requests and their latency for /metrics
+	e.Use(metricsMiddleware)
+	e.GET("/metrics", getMetrics)
 	// Define /kvs GET endpoints
 	e.GET("/kvs", getKey)
 	e.GET("/kvs/", getKey)
@@ -135,20 +196,86 @@ func main() {
 	// Define /shard endpoints
 	e.GET("/shard/ids", getAllShardIds)
 	e.GET("/shard/node-shard-id", getMyShardId)
+	e.GET("/shard/routing", getRouting)
 	e.GET("/shard/members/:id", getMembersOfShard)
 	e.GET("/shard/key-count/:id", getShardKeyCount)
+	e.GET("/shard/key-sizes/:id", getShardKeySizes)
+	e.GET("/shard/reshard-plan", getReshardPlan)
+	e.GET("/shard/partition-load", getPartitionLoad)
+	e.GET("/shard/load", getShardLoad)
 	e.PUT("/shard/add-member/:id", addNodeToShard)
-	e.PUT("shard/reshard", reshard)
-	e.PUT("/shard/kvs-update/:key", updateKvsForResharding)
+	e.PUT("/shard/move-member/:id", moveNodeToShard)
+	e.PUT("/shard/split/:id", splitShard)
+	e.PUT("/shard/merge/:id", mergeShards)
+	e.PUT("/shard/reshard", reshard)
+	e.PUT("/shard/reshard/:phase", reshardPhase)
+	e.GET("/shard/reshard/:id", getReshardJob)
+	e.PUT("/shard/reshard/:id/resume", resumeReshardJob)
+	e.PUT("/shard/reshard/:id/rollback", rollbackReshardJob)
+	e.PUT("/shard/kvs-bulk", updateKvsInBulk)
 	// Define /sync endpoint for syncing new nodes
 	e.GET("/sync", syncHandler)
+	// Define /bootstrap endpoint for nodes joining through a seed
+	e.GET("/bootstrap", getBootstrapState)
+	// Define /admin endpoints
+	e.GET("/admin/config", getConfig)
+	e.PUT("/admin/replace-node", replaceNode)
+	e.PUT("/admin/decommission", decommissionNode)
+	e.GET("/admin/vector-clock", getVectorClock)
+	e.POST("/admin/backup", backupCluster)
+	e.POST("/admin/restore", restoreCluster)
+	e.PUT("/admin/backup/fence", fenceWrites)
+	e.PUT("/admin/backup/release", releaseFence)
+	e.PUT("/admin/backup/snapshot", snapshotForBackup)
+	e.POST("/admin/import", importKeys)
+	e.GET("/admin/export", exportKeys)
+	e.GET("/admin/shard-weights", getShardWeights)
+	e.PUT("/admin/shard-weights", putShardWeights)
+	// Define /partition endpoints for detecting and healing partitions
+	e.GET("/partition/status", getPartitionStatus)
+	e.GET("/partition/diverged", getDivergedWrites)
+	// Define /metadata endpoints for the replicated cluster config
+	e.GET("/metadata/config", getClusterConfig)
+	e.PUT("/metadata/config", putClusterConfig)
+	e.POST("/metadata/request-vote", requestVote)
+	e.POST("/metadata/append-entries", appendEntries)
 	// Build the JSON body to be sent: {"socket-address":"<IP:PORT>"}
 	payload := map[string]string{"socket-address": SOCKET_ADDRESS}
 	jsonPayload, _ := json.Marshal(payload)
 	// Broadcaset Put View message to all replicas in the system
-	broadcast("PUT", "view", jsonPayload, CURRENT_VIEW)
+	broadcast(context.Background(), "PUT", "view", jsonPayload, CURRENT_VIEW)
 	// Start heartbeat checker
 	go heartbeat()
+	// Drop expired keys
+	go sweepExpiredKeys()
+	// Split and merge key ranges as they grow and shrink
+	if CONFIG.Partitioner == partitionerRange {
+		go balanceRanges()
+	} else {
+		// Move partitions away from hot or oversized shards
+		go decayPartitionLoad()
+		if CONFIG.RebalanceThreshold > 0 {
+			go rebalancePartitions()
+		}
+	}
+	// Serve Redis clients through the same handlers as the HTTP API
+	if CONFIG.RedisAddress != "" {
+		go serveRedis(CONFIG.RedisAddress, e)
+	}
+	// Serve memcached clients through the same handlers as the HTTP API
+	if CONFIG.MemcachedAddress != "" {
+		go serveMemcached(CONFIG.MemcachedAddress, e)
+	}
+	// Serve gRPC clients through the same handlers as the HTTP API
+	if CONFIG.GRPCAddress != "" {
+		go serveGRPC(CONFIG.GRPCAddress, e)
+	}
+	// Serve binary connections from other nodes on the same port as the HTTP API
+	listener, err := newRPCListener(SOCKET_ADDRESS, e)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	e.Listener = listener
 	// Start Echo server
 	e.Logger.Fatal(e.Start(SOCKET_ADDRESS))
 }
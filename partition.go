@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DistributedClocks/GoVector/govec/vclock"
+	"github.com/labstack/echo/v4"
+)
+
+// Supported values of the partition-mode config option
+const (
+	// Keep serving reads and writes, and reconcile diverged writes on heal
+	partitionModeCausalOnly = "causal-only"
+	// Reject client writes while this node sees only a minority of the agreed view
+	partitionModeReadOnly = "read-only"
+)
+
+// How long diverged writes are kept after a heal so every node can fetch them
+const divergedRetention = 30 * time.Second
+
+// Last view every node agreed on, used to tell a partition apart from a shrinking view
+var LAST_AGREED_VIEW []string
+
+// True while this node sees fewer than a majority of LAST_AGREED_VIEW
+var PARTITIONED bool
+
+// True while any node of LAST_AGREED_VIEW is unreachable
+var DEGRADED bool
+
+// Writes applied while DEGRADED, reconciled with the other side on heal
+var DIVERGED = make(map[string]Diverged_Write)
+
+// Protects PARTITIONED, DEGRADED and DIVERGED
+var partitionMutex sync.Mutex
+
+// Time since which every node of the agreed view is reachable again
+var healedSince time.Time
+
+// Diverged_Write records the latest write to a key while degraded
+type Diverged_Write struct {
+	// Nil when the key was deleted
+	Value  *Value `json:"value,omitempty"`
+	Writer string `json:"writer"`
+	// Vector clock the write was applied at, which orders writes to the same key
+	VectorClock string `json:"vector-clock,omitempty"`
+}
+
+// Define JSON body for /partition/diverged responses
+type Diverged_State struct {
+	Writes      map[string]Diverged_Write `json:"writes"`
+	VectorClock string                    `json:"vector-clock"`
+	Shards      map[string][]string       `json:"shards"`
+}
+
+// Replace the agreed view, e.g. after a reshard or a config change
+func setAgreedView(view []string) {
+	viewMutex.Lock()
+	LAST_AGREED_VIEW = append([]string{}, view...)
+	viewMutex.Unlock()
+}
+
+// Add a node that joined the cluster to the agreed view
+func addToAgreedView(address string) {
+	viewMutex.Lock()
+	if !contains(LAST_AGREED_VIEW, address) {
+		LAST_AGREED_VIEW = append(LAST_AGREED_VIEW, address)
+	}
+	viewMutex.Unlock()
+}
+
+// Drop a node that left the cluster from the agreed view, so it no longer counts toward the majority
+// Nodes the heartbeat cannot reach stay, since they may be on the other side of a partition
+func removeFromAgreedView(address string) {
+	viewMutex.Lock()
+	LAST_AGREED_VIEW = removeFromList(LAST_AGREED_VIEW, address)
+	viewMutex.Unlock()
+}
+
+// Returns true if client writes must be rejected
+func writesDisabled() bool {
+	partitionMutex.Lock()
+	defer partitionMutex.Unlock()
+	return PARTITIONED && CONFIG.PartitionMode == partitionModeReadOnly
+}
+
+// Returns true if this node is on the minority side of a partition
+func isPartitioned() bool {
+	partitionMutex.Lock()
+	defer partitionMutex.Unlock()
+	return PARTITIONED
+}
+
+// Remember a write applied while some node is unreachable
+// value is nil for deletes, and vc is the vector clock the write was applied at
+func recordDivergedWrite(key string, value *Value, writer string, vc string) {
+	partitionMutex.Lock()
+	defer partitionMutex.Unlock()
+	if DEGRADED {
+		DIVERGED[key] = Diverged_Write{Value: value, Writer: writer, VectorClock: vc}
+	}
+}
+
+// Probe nodes of the agreed view that dropped out of the current view,
+// merge with the ones that came back and update the partition state
+func checkPartition(client *http.Client) {
+	viewMutex.Lock()
+	agreed := append([]string{}, LAST_AGREED_VIEW...)
+	view := append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	for _, address := range agreed {
+		if address == SOCKET_ADDRESS || contains(view, address) {
+			continue
+		}
+		resp, err := client.Get(fmt.Sprintf("http://%s/view", address))
+		if err != nil {
+			continue
+		}
+		drainAndClose(resp.Body)
+		if resp.StatusCode == http.StatusOK {
+			if err := mergeWithNode(address); err != nil {
+				fmt.Printf("Failed to merge with %s: %v\n", address, err)
+			}
+		}
+	}
+	updatePartitionState()
+}
+
+// Recompute PARTITIONED and DEGRADED from the current and agreed views
+func updatePartitionState() {
+	viewMutex.Lock()
+	reachable := 0
+	for _, address := range LAST_AGREED_VIEW {
+		if address == SOCKET_ADDRESS || contains(CURRENT_VIEW, address) {
+			reachable++
+		}
+	}
+	total := len(LAST_AGREED_VIEW)
+	viewMutex.Unlock()
+
+	partitionMutex.Lock()
+	defer partitionMutex.Unlock()
+	partitioned := reachable < total/2+1
+	if partitioned != PARTITIONED {
+		if partitioned {
+			fmt.Printf("Only %d of %d nodes reachable, entering minority mode (%s)\n", reachable, total, CONFIG.PartitionMode)
+		} else {
+			fmt.Printf("%d of %d nodes reachable, leaving minority mode\n", reachable, total)
+		}
+	}
+	PARTITIONED = partitioned
+	DEGRADED = reachable < total
+	if DEGRADED {
+		healedSince = time.Time{}
+		return
+	}
+	// Keep diverged writes around for a while so slower nodes can still merge them
+	if healedSince.IsZero() {
+		healedSince = time.Now()
+	} else if len(DIVERGED) > 0 && time.Since(healedSince) > divergedRetention {
+		DIVERGED = make(map[string]Diverged_Write)
+	}
+}
+
+// Reconcile view, shard map and diverged data with a node that became reachable again
+func mergeWithNode(address string) error {
+	client := peerClient(time.Duration(CONFIG.SendToAnyTimeout))
+	resp, err := client.Get(fmt.Sprintf("http://%s/partition/diverged", address))
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %d", resp.StatusCode)
+	}
+	var theirs Diverged_State
+	if err := json.NewDecoder(resp.Body).Decode(&theirs); err != nil {
+		return fmt.Errorf("error decoding diverged state: %v", err)
+	}
+	theirVC, err := NewVClockFromString(theirs.VectorClock)
+	if err != nil {
+		return fmt.Errorf("error creating vector clock from string: %v", err)
+	}
+
+	// Reconcile the data of my shard
+	partitionMutex.Lock()
+	KVSmutex.Lock()
+	for key, write := range theirs.Writes {
+		if HASH_RING == nil || locateShard(key) != MY_SHARD_ID {
+			continue
+		}
+		if mine, ok := DIVERGED[key]; ok && !theirWriteWins(mine, write) {
+			continue
+		}
+		if write.Value == nil {
+			delete(KVStore, key)
+		} else {
+			KVStore[key] = *write.Value
+		}
+		DIVERGED[key] = write
+	}
+	KVSmutex.Unlock()
+	partitionMutex.Unlock()
+	// Only take the peer's own position, the other positions may count writes
+	// to my shard that are still on their way to me from other replicas
+	mergeSenderPosition(theirVC, address)
+
+	// The metadata service already owns the shard map
+	if !metadataEnabled() {
+		for shardid, nodes := range theirs.Shards {
+			for _, node := range nodes {
+				if !contains(SHARDS[shardid], node) {
+					SHARDS[shardid] = append(SHARDS[shardid], node)
+				}
+			}
+		}
+	}
+
+	viewMutex.Lock()
+	if !contains(CURRENT_VIEW, address) {
+		CURRENT_VIEW = append(CURRENT_VIEW, address)
+	}
+	viewMutex.Unlock()
+	fmt.Printf("Merged with %s after partition, %d diverged writes received\n", address, len(theirs.Writes))
+	return nil
+}
+
+// Decide which of two writes to the same key survives the merge
+// The later write wins if one happened after the other, and the writer breaks ties between
+// concurrent ones, so that every node reaches the same decision
+func theirWriteWins(mine Diverged_Write, theirs Diverged_Write) bool {
+	myVC, myErr := NewVClockFromString(mine.VectorClock)
+	theirVC, theirErr := NewVClockFromString(theirs.VectorClock)
+	if myErr == nil && theirErr == nil {
+		if myVC.Compare(theirVC, vclock.Descendant) {
+			return true
+		}
+		if myVC.Compare(theirVC, vclock.Ancestor) {
+			return false
+		}
+	}
+	return theirs.Writer > mine.Writer
+}
+
+// GET /partition/diverged
+// Returns the writes applied while some node was unreachable
+func getDivergedWrites(c echo.Context) error {
+	partitionMutex.Lock()
+	writes := make(map[string]Diverged_Write, len(DIVERGED))
+	for key, write := range DIVERGED {
+		writes[key] = write
+	}
+	partitionMutex.Unlock()
+	return c.JSON(http.StatusOK, Diverged_State{
+		Writes:      writes,
+		VectorClock: vectorClockString(),
+		Shards:      SHARDS,
+	})
+}
+
+// GET /partition/status
+// Returns whether this node is in a minority partition
+func getPartitionStatus(c echo.Context) error {
+	viewMutex.Lock()
+	agreed := append([]string{}, LAST_AGREED_VIEW...)
+	viewMutex.Unlock()
+	partitionMutex.Lock()
+	defer partitionMutex.Unlock()
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"partitioned":     PARTITIONED,
+		"degraded":        DEGRADED,
+		"mode":            CONFIG.PartitionMode,
+		"agreed-view":     agreed,
+		"diverged-writes": len(DIVERGED),
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DistributedClocks/GoVector/govec/vclock"
+)
+
+// Healing a partition with one replica must not skip the writes another replica still has queued for me
+func TestHealKeepsWritesQueuedByThirdReplica(t *testing.T) {
+	CONFIG = defaultConfig()
+	useTransport(t, transportHTTP)
+
+	// The peer on the other side of the partition has seen writes of the third replica that I have not
+	third := "127.0.0.1:1"
+	var peer string
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Diverged_State{
+			Writes: map[string]Diverged_Write{
+				"a": {Value: &Value{Data: "from peer", Type: "string"}, Writer: peer, VectorClock: `{"` + peer + `":2}`},
+			},
+			VectorClock: `{"` + peer + `":2, "` + third + `":3}`,
+		})
+	}))
+	defer peerServer.Close()
+	peer = strings.TrimPrefix(peerServer.URL, "http://")
+
+	SOCKET_ADDRESS = "127.0.0.1:2"
+	SHARDS = map[string][]string{"shard0": {SOCKET_ADDRESS, peer, third}}
+	MY_SHARD_ID = "shard0"
+	HASH_RING = createHashRing(SHARDS)
+	KVStore = make(map[string]Value)
+	DIVERGED = make(map[string]Diverged_Write)
+	CURRENT_VIEW = []string{SOCKET_ADDRESS, third}
+	vectorClockMutex.Lock()
+	MY_VECTOR_CLOCK = vclock.New()
+	MY_VECTOR_CLOCK.Set(SOCKET_ADDRESS, 0)
+	MY_VECTOR_CLOCK.Set(peer, 0)
+	MY_VECTOR_CLOCK.Set(third, 1)
+	vectorClockMutex.Unlock()
+
+	if err := mergeWithNode(peer); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := KVStore["a"]; !ok || value.Data != "from peer" {
+		t.Errorf("diverged write of the peer was not applied, got %v", KVStore["a"])
+	}
+	if !contains(CURRENT_VIEW, peer) {
+		t.Errorf("peer is not back in the view %v", CURRENT_VIEW)
+	}
+
+	vectorClockMutex.Lock()
+	defer vectorClockMutex.Unlock()
+	if ticks, _ := MY_VECTOR_CLOCK.FindTicks(peer); ticks != 2 {
+		t.Errorf("position of the peer is %d, want 2", ticks)
+	}
+	// The next write the third replica has queued for me is still deliverable
+	queued := vclock.New()
+	queued.Set(third, 2)
+	if !compareReplicasVC(queued, MY_VECTOR_CLOCK, third) {
+		t.Errorf("queued write of the third replica is not deliverable at %s", MY_VECTOR_CLOCK.ReturnVCString())
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/buraksezer/consistent"
+)
+
+// Partitioners that map keys to shards
+const (
+	partitionerHash  = "hash"
+	partitionerRange = "range"
+)
+
+// Characters used to spread the first ranges over the key space
+const rangeAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Define the key ranges owned by each shard when CONFIG.Partitioner is "range"
+// Sorted by Start; together the ranges cover the whole key space
+var RANGES []Key_Range
+
+// Key_Range holds the keys from Start (inclusive) to End (exclusive)
+// An empty End is the end of the key space
+type Key_Range struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Shard string `json:"shard"`
+}
+
+// Returns the shard id a key belongs to under the current shard map
+func locateShard(key string) string {
+	return locateShardIn(HASH_RING, RANGES, PARTITION_OVERRIDES, key)
+}
+
+// Returns the shard id a key belongs to under the given hash ring and partition overrides, or range map
+func locateShardIn(ring *consistent.Consistent, ranges []Key_Range, overrides map[int]string, key string) string {
+	if CONFIG.Partitioner == partitionerRange {
+		return rangeOwner(ranges, key)
+	}
+	if len(overrides) > 0 {
+		if shardid, ok := overrides[ring.FindPartitionID([]byte(key))]; ok {
+			return shardid
+		}
+	}
+	return ring.LocateKey([]byte(key)).String()
+}
+
+// Rebuild the hash ring from SHARDS, and the range map if it does not match SHARDS
+func rebuildRouting() {
+	HASH_RING = createHashRing(SHARDS)
+	PARTITION_OVERRIDES = pruneOverrides(PARTITION_OVERRIDES, SHARDS)
+	SHARD_WEIGHTS = pruneWeights(SHARD_WEIGHTS, SHARDS)
+	if CONFIG.Partitioner == partitionerRange && !rangesMatchShards(RANGES, SHARDS) {
+		RANGES = initialRanges(SHARDS)
+	}
+}
+
+// Returns the index of the range holding key
+func rangeIndex(ranges []Key_Range, key string) int {
+	// The first range starts at "", so every key is in some range
+	return sort.Search(len(ranges), func(i int) bool { return ranges[i].Start > key }) - 1
+}
+
+// Returns the shard id of the range holding key, or "" if there are no ranges
+func rangeOwner(ranges []Key_Range, key string) string {
+	i := rangeIndex(ranges, key)
+	if i < 0 {
+		return ""
+	}
+	return ranges[i].Shard
+}
+
+// Returns true if every range belongs to a shard in shards and every shard owns a range
+func rangesMatchShards(ranges []Key_Range, shards map[string][]string) bool {
+	if len(ranges) == 0 {
+		return false
+	}
+	owners := make(map[string]bool)
+	for _, r := range ranges {
+		if _, ok := shards[r.Shard]; !ok {
+			return false
+		}
+		owners[r.Shard] = true
+	}
+	return len(owners) == len(shards)
+}
+
+// Returns the shard ids in a deterministic order
+func sortedShardIDs(shards map[string][]string) []string {
+	shardIDs := make([]string, 0, len(shards))
+	for shardid := range shards {
+		shardIDs = append(shardIDs, shardid)
+	}
+	sort.Strings(shardIDs)
+	return shardIDs
+}
+
+// Split the key space evenly over rangeAlphabet, one range per shard
+// Every node computes the same map from the same shards
+func initialRanges(shards map[string][]string) []Key_Range {
+	shardIDs := sortedShardIDs(shards)
+	ranges := make([]Key_Range, 0, len(shardIDs))
+	for i, shardid := range shardIDs {
+		start := ""
+		if i > 0 {
+			start = string(rangeAlphabet[i*len(rangeAlphabet)/len(shardIDs)])
+		}
+		if i > 0 {
+			ranges[i-1].End = start
+		}
+		ranges = append(ranges, Key_Range{Start: start, Shard: shardid})
+	}
+	return ranges
+}
+
+// Returns a key strictly between start and end, or "" if none was found
+// Used to split ranges that hold too few keys to split at their median
+func midKey(start string, end string) string {
+	prefix := ""
+	for i := 0; i < 8; i++ {
+		lo, hi := int('0'), int('z')+1
+		if i < len(start) {
+			lo = int(start[i])
+		}
+		if end != "" && len(end) > i && end[:i] == prefix {
+			hi = int(end[i])
+		}
+		if hi-lo > 1 {
+			mid := prefix + string(rune((lo+hi)/2))
+			if mid > start && (end == "" || mid < end) {
+				return mid
+			}
+			return ""
+		}
+		prefix += string(rune(lo))
+	}
+	return ""
+}
+
+// Split ranges[i] at key, giving the upper part to shardid
+func splitRange(ranges []Key_Range, i int, key string, shardid string) []Key_Range {
+	split := make([]Key_Range, 0, len(ranges)+1)
+	split = append(split, ranges[:i]...)
+	split = append(split, Key_Range{Start: ranges[i].Start, End: key, Shard: ranges[i].Shard})
+	split = append(split, Key_Range{Start: key, End: ranges[i].End, Shard: shardid})
+	return append(split, ranges[i+1:]...)
+}
+
+// Merge adjacent ranges that belong to the same shard
+func coalesceRanges(ranges []Key_Range) []Key_Range {
+	merged := make([]Key_Range, 0, len(ranges))
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].Shard == r.Shard {
+			merged[n-1].End = r.End
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Returns the keys of each range, sorted
+func keysPerRange(ranges []Key_Range, sizes map[string]map[string]int) [][]string {
+	keys := make([][]string, len(ranges))
+	for _, shardSizes := range sizes {
+		for key := range shardSizes {
+			if i := rangeIndex(ranges, key); i >= 0 {
+				keys[i] = append(keys[i], key)
+			}
+		}
+	}
+	for i := range keys {
+		sort.Strings(keys[i])
+	}
+	return keys
+}
+
+// Returns a key to split range i at: its median key, or a key halfway through the range
+func splitPoint(ranges []Key_Range, i int, keys []string) string {
+	if len(keys) >= 2 {
+		if median := keys[len(keys)/2]; median > ranges[i].Start {
+			return median
+		}
+	}
+	return midKey(ranges[i].Start, ranges[i].End)
+}
+
+// Compute the range map for a new shard map, moving as few keys as possible
+// Ranges of removed shards go to a neighbor, and every new shard takes the upper
+// half of the range holding the most keys; sizes holds the keys of every current shard
+func planRanges(shards map[string][]string, sizes map[string]map[string]int) []Key_Range {
+	ranges := append([]Key_Range{}, RANGES...)
+	if !rangesMatchShards(ranges, SHARDS) {
+		ranges = initialRanges(SHARDS)
+	}
+	// Hand the ranges of removed shards to the previous range, or the next one for the first
+	for i := range ranges {
+		if _, ok := shards[ranges[i].Shard]; ok {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			if _, ok := shards[ranges[j].Shard]; ok {
+				ranges[i].Shard = ranges[j].Shard
+				break
+			}
+		}
+	}
+	for i := len(ranges) - 1; i >= 0; i-- {
+		if _, ok := shards[ranges[i].Shard]; ok {
+			continue
+		}
+		for j := i + 1; j < len(ranges); j++ {
+			if _, ok := shards[ranges[j].Shard]; ok {
+				ranges[i].Shard = ranges[j].Shard
+				break
+			}
+		}
+	}
+	ranges = coalesceRanges(ranges)
+	// Give new shards the upper half of the fullest range
+	owners := make(map[string]bool)
+	for _, r := range ranges {
+		owners[r.Shard] = true
+	}
+	for _, shardid := range sortedShardIDs(shards) {
+		if owners[shardid] {
+			continue
+		}
+		keys := keysPerRange(ranges, sizes)
+		fullest := 0
+		for i := range ranges {
+			if len(keys[i]) > len(keys[fullest]) {
+				fullest = i
+			}
+		}
+		if at := splitPoint(ranges, fullest, keys[fullest]); at != "" {
+			ranges = splitRange(ranges, fullest, at, shardid)
+			owners[shardid] = true
+			continue
+		}
+		// Fall back to any range that can still be split
+		for i := len(ranges) - 1; i >= 0; i-- {
+			if at := midKey(ranges[i].Start, ranges[i].End); at != "" {
+				ranges = splitRange(ranges, i, at, shardid)
+				owners[shardid] = true
+				break
+			}
+		}
+	}
+	return ranges
+}
+
+// Periodically split ranges holding too many keys and merge ranges holding too few
+// Only the first node of the view does this so that changes do not conflict
+func balanceRanges() {
+	for {
+		time.Sleep(time.Duration(CONFIG.RangeCheckInterval))
+		if !isBalancerLeader() || HASH_RING == nil || reshardInProgress() || isPartitioned() {
+			continue
+		}
+		ranges, reason := rebalancedRanges()
+		if ranges == nil {
+			continue
+		}
+		job := newReshardJob(len(SHARDS), SHARDS)
+		job.Ranges = ranges
+		if err := runReshard(&job, 0); err != nil {
+			fmt.Printf("Failed to %s: %v\n", reason, err)
+			continue
+		}
+		fmt.Printf("Range map changed to %s\n", reason)
+	}
+}
+
+// Returns a new range map with at most one range split or merged, or nil if none crossed a threshold
+func rebalancedRanges() ([]Key_Range, string) {
+	sizes := make(map[string]map[string]int)
+	for shardid := range SHARDS {
+		shardSizes, err := fetchShardKeySizes(shardid)
+		if err != nil {
+			return nil, ""
+		}
+		sizes[shardid] = shardSizes
+	}
+	ranges := append([]Key_Range{}, RANGES...)
+	keys := keysPerRange(ranges, sizes)
+	shardKeys := make(map[string]int)
+	for shardid, shardSizes := range sizes {
+		shardKeys[shardid] = len(shardSizes)
+	}
+
+	// Split the first range over the threshold and hand its upper half to the emptiest shard
+	for i := range ranges {
+		if len(keys[i]) <= CONFIG.RangeSplitKeys {
+			continue
+		}
+		at := splitPoint(ranges, i, keys[i])
+		if at == "" {
+			continue
+		}
+		target := ranges[i].Shard
+		for _, shardid := range sortedShardIDs(SHARDS) {
+			if shardKeys[shardid] < shardKeys[target] {
+				target = shardid
+			}
+		}
+		return splitRange(ranges, i, at, target), fmt.Sprintf("split range %q-%q at %q", ranges[i].Start, ranges[i].End, at)
+	}
+
+	// Merge two neighbors under the threshold, as long as every shard keeps a range
+	owned := make(map[string]int)
+	for _, r := range ranges {
+		owned[r.Shard]++
+	}
+	for i := 0; i+1 < len(ranges); i++ {
+		if len(keys[i])+len(keys[i+1]) >= CONFIG.RangeMergeKeys {
+			continue
+		}
+		// The range of the fuller shard joins the range of the emptier one
+		keep, give := i, i+1
+		if shardKeys[ranges[i+1].Shard] < shardKeys[ranges[i].Shard] {
+			keep, give = i+1, i
+		}
+		if ranges[keep].Shard != ranges[give].Shard && owned[ranges[give].Shard] < 2 {
+			continue
+		}
+		merged := append([]Key_Range{}, ranges...)
+		merged[give].Shard = merged[keep].Shard
+		return coalesceRanges(merged), fmt.Sprintf("merge range %q-%q into %s", ranges[give].Start, ranges[give].End, ranges[keep].Shard)
+	}
+	return nil, ""
+}
+
+// Returns a sorted copy of a list of addresses
+func sortedCopy(list []string) []string {
+	sorted := append([]string{}, list...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestInitialRanges(t *testing.T) {
+	ranges := initialRanges(map[string][]string{"shard1": {"b"}, "shard0": {"a"}})
+	want := []Key_Range{{Start: "", End: "V", Shard: "shard0"}, {Start: "V", End: "", Shard: "shard1"}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("ranges are %v, want %v", ranges, want)
+	}
+	for key, shardid := range map[string]string{"": "shard0", "0": "shard0", "Uz": "shard0", "V": "shard1", "zzz": "shard1", "~": "shard1"} {
+		if got := rangeOwner(ranges, key); got != shardid {
+			t.Errorf("%q is in %s, want %s", key, got, shardid)
+		}
+	}
+	if got := rangeOwner(nil, "a"); got != "" {
+		t.Errorf("owner without ranges is %q", got)
+	}
+}
+
+func TestMidKey(t *testing.T) {
+	for _, test := range []struct{ start, end string }{{"", ""}, {"a", "c"}, {"a", "b"}, {"U", ""}, {"abc", "abd"}} {
+		mid := midKey(test.start, test.end)
+		if mid == "" || mid <= test.start || (test.end != "" && mid >= test.end) {
+			t.Errorf("midKey(%q, %q) = %q", test.start, test.end, mid)
+		}
+	}
+}
+
+func TestSplitAndCoalesceRanges(t *testing.T) {
+	ranges := []Key_Range{{Start: "", End: "m", Shard: "shard0"}, {Start: "m", End: "", Shard: "shard1"}}
+	split := splitRange(ranges, 0, "f", "shard2")
+	want := []Key_Range{{Start: "", End: "f", Shard: "shard0"}, {Start: "f", End: "m", Shard: "shard2"}, {Start: "m", End: "", Shard: "shard1"}}
+	if !reflect.DeepEqual(split, want) {
+		t.Fatalf("split ranges are %v, want %v", split, want)
+	}
+	split[1].Shard = "shard1"
+	merged := coalesceRanges(split)
+	want = []Key_Range{{Start: "", End: "f", Shard: "shard0"}, {Start: "f", End: "", Shard: "shard1"}}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged ranges are %v, want %v", merged, want)
+	}
+}
+
+func TestPlanRanges(t *testing.T) {
+	CONFIG = defaultConfig()
+	CONFIG.Partitioner = partitionerRange
+	SHARDS = map[string][]string{"shard0": {"a"}, "shard1": {"b"}}
+	RANGES = []Key_Range{{Start: "", End: "m", Shard: "shard0"}, {Start: "m", End: "", Shard: "shard1"}}
+	sizes := map[string]map[string]int{
+		"shard0": {"a1": 1, "a2": 1, "a3": 1, "a4": 1},
+		"shard1": {"n1": 1},
+	}
+
+	// A new shard takes the upper half of the fullest range
+	ranges := planRanges(map[string][]string{"shard0": {"a"}, "shard1": {"b"}, "shard2": {"c"}}, sizes)
+	want := []Key_Range{{Start: "", End: "a3", Shard: "shard0"}, {Start: "a3", End: "m", Shard: "shard2"}, {Start: "m", End: "", Shard: "shard1"}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ranges with a new shard are %v, want %v", ranges, want)
+	}
+	// The range of a removed shard goes to its neighbor, so only its keys move
+	ranges = planRanges(map[string][]string{"shard1": {"b"}}, sizes)
+	want = []Key_Range{{Start: "", End: "", Shard: "shard1"}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("ranges without shard0 are %v, want %v", ranges, want)
+	}
+}
+
+// With the range partitioner, keys are stored by the shard whose range holds them
+func TestRangePartitioner(t *testing.T) {
+	cluster := startCluster(t, 4, 2, "KVS_PARTITIONER=range")
+	node := cluster.nodes[0]
+	_, reply := nodeRequest(t, "GET", node, "shard/ids", nil)
+	var ranges []Key_Range
+	for _, r := range reply["ranges"].([]interface{}) {
+		fields := r.(map[string]interface{})
+		ranges = append(ranges, Key_Range{Start: fields["start"].(string), End: fields["end"].(string), Shard: fields["shard"].(string)})
+	}
+	if len(ranges) != 2 {
+		t.Fatalf("cluster has ranges %v", reply["ranges"])
+	}
+	counts := make(map[string]float64)
+	for _, prefix := range []string{"0", "A", "a", "z"} {
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("%s%d", prefix, i)
+			status, reply := kvsRequest(t, "PUT", node, key, KVS_PUT_Request{Data: "v"})
+			if status != http.StatusCreated || reply["shard-id"] != rangeOwner(ranges, key) {
+				t.Errorf("PUT %s returned %d: %v, want shard %s", key, status, reply, rangeOwner(ranges, key))
+			}
+			counts[rangeOwner(ranges, key)]++
+		}
+	}
+	for shardid, count := range counts {
+		_, reply := nodeRequest(t, "GET", node, "shard/key-count/"+shardid, nil)
+		if reply["shard-key-count"] != count {
+			t.Errorf("%s has %v keys, want %v", shardid, reply["shard-key-count"], count)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Shards holding less than this many bytes are never considered oversized
+const rebalanceMinBytes = 1 << 20
+
+// Requests and bytes served by this node per partition of the hash ring
+// Halved every CONFIG.RebalanceInterval so that they follow recent traffic
+var PARTITION_LOAD = make(map[int]*Partition_Load)
+
+// Protects PARTITION_LOAD
+var partitionLoadMutex sync.Mutex
+
+// Partitions of the hash ring that were moved away from the shard the ring assigns them to
+// Replaced as a whole, never modified in place
+var PARTITION_OVERRIDES = make(map[int]string)
+
+// Load of a single partition
+type Partition_Load struct {
+	Requests float64 `json:"requests"`
+	Bytes    float64 `json:"bytes"`
+}
+
+// Load and size of a single shard, as reported by /shard/load
+type Shard_Load struct {
+	Requests    float64 `json:"requests"`
+	Bytes       float64 `json:"bytes"`
+	StoredKeys  int     `json:"stored-keys"`
+	StoredBytes int     `json:"stored-bytes"`
+	Partitions  []int   `json:"partitions"`
+}
+
+// Returns the partition of the hash ring a key belongs to, or -1 with range partitioning
+func partitionOf(key string) int {
+	if CONFIG.Partitioner == partitionerRange || HASH_RING == nil {
+		return -1
+	}
+	return HASH_RING.FindPartitionID([]byte(key))
+}
+
+// Returns true if partID is one of partIDs
+func containsPartition(partIDs []int, partID int) bool {
+	for _, id := range partIDs {
+		if id == partID {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the shard that owns a partition under the current hash ring and overrides
+func partitionOwner(partID int) string {
+	return partitionOwnerIn(PARTITION_OVERRIDES, partID)
+}
+
+// Returns the shard that owns a partition of the current hash ring under the given overrides
+func partitionOwnerIn(overrides map[int]string, partID int) string {
+	if shardid, ok := overrides[partID]; ok {
+		return shardid
+	}
+	return HASH_RING.GetPartitionOwner(partID).String()
+}
+
+// Count a client request for key that moved size bytes
+func recordPartitionLoad(key string, size int) {
+	partID := partitionOf(key)
+	if partID < 0 {
+		return
+	}
+	partitionLoadMutex.Lock()
+	defer partitionLoadMutex.Unlock()
+	load, ok := PARTITION_LOAD[partID]
+	if !ok {
+		load = &Partition_Load{}
+		PARTITION_LOAD[partID] = load
+	}
+	load.Requests++
+	load.Bytes += float64(size)
+}
+
+// Halve the load counters every interval
+func decayPartitionLoad() {
+	for {
+		time.Sleep(time.Duration(CONFIG.RebalanceInterval))
+		partitionLoadMutex.Lock()
+		for partID, load := range PARTITION_LOAD {
+			load.Requests /= 2
+			load.Bytes /= 2
+			if load.Requests < 1 {
+				delete(PARTITION_LOAD, partID)
+			}
+		}
+		partitionLoadMutex.Unlock()
+	}
+}
+
+// Drop overrides that point at shards that no longer exist
+func pruneOverrides(overrides map[int]string, shards map[string][]string) map[int]string {
+	pruned := make(map[int]string)
+	for partID, shardid := range overrides {
+		if _, ok := shards[shardid]; ok {
+			pruned[partID] = shardid
+		}
+	}
+	return pruned
+}
+
+// GET /shard/partition-load
+// Returns the load counters of this node
+func getPartitionLoad(c echo.Context) error {
+	partitionLoadMutex.Lock()
+	defer partitionLoadMutex.Unlock()
+	return c.JSON(http.StatusOK, map[string]interface{}{"partitions": PARTITION_LOAD})
+}
+
+// GET /shard/load
+// Returns the load and size of every shard and the partitions it owns
+func getShardLoad(c echo.Context) error {
+	if CONFIG.Partitioner == partitionerRange {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Partition load is only tracked with hash partitioning"})
+	}
+	loads, err := collectShardLoad()
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"shards": loads, "overrides": PARTITION_OVERRIDES})
+}
+
+// Sum the load counters of every node and the stored keys of every shard, by shard
+// Also returns the load of every partition
+func collectShardLoad() (map[string]*Shard_Load, error) {
+	partLoads, partStored, err := collectPartitionLoad()
+	if err != nil {
+		return nil, err
+	}
+	loads := make(map[string]*Shard_Load)
+	for shardid := range SHARDS {
+		loads[shardid] = &Shard_Load{Partitions: []int{}}
+	}
+	for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+		load, ok := loads[partitionOwner(partID)]
+		if !ok {
+			continue
+		}
+		load.Partitions = append(load.Partitions, partID)
+		load.Requests += partLoads[partID].Requests
+		load.Bytes += partLoads[partID].Bytes
+		load.StoredKeys += partStored[partID].StoredKeys
+		load.StoredBytes += partStored[partID].StoredBytes
+	}
+	return loads, nil
+}
+
+// Returns the traffic and stored data of every partition
+func collectPartitionLoad() (map[int]Partition_Load, map[int]Shard_Load, error) {
+	partLoads := make(map[int]Partition_Load)
+	viewMutex.Lock()
+	nodes := append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	for _, address := range nodes {
+		var body struct {
+			Partitions map[int]Partition_Load `json:"partitions"`
+		}
+		if address == SOCKET_ADDRESS {
+			partitionLoadMutex.Lock()
+			body.Partitions = make(map[int]Partition_Load)
+			for partID, load := range PARTITION_LOAD {
+				body.Partitions[partID] = *load
+			}
+			partitionLoadMutex.Unlock()
+		} else if err := getJSON(address, "shard/partition-load", &body); err != nil {
+			// A node that does not answer served no traffic that matters now
+			continue
+		}
+		for partID, load := range body.Partitions {
+			sum := partLoads[partID]
+			sum.Requests += load.Requests
+			sum.Bytes += load.Bytes
+			partLoads[partID] = sum
+		}
+	}
+	sizes, err := fetchAllKeySizes()
+	if err != nil {
+		return nil, nil, err
+	}
+	partStored := make(map[int]Shard_Load)
+	for _, shardSizes := range sizes {
+		for key, size := range shardSizes {
+			partID := partitionOf(key)
+			stored := partStored[partID]
+			stored.StoredKeys++
+			stored.StoredBytes += size
+			partStored[partID] = stored
+		}
+	}
+	return partLoads, partStored, nil
+}
+
+// GET a JSON document from another node
+func getJSON(address string, endpoint string, reply interface{}) error {
+	client := peerClient(time.Duration(CONFIG.SendToAnyTimeout))
+	resp, err := client.Get(fmt.Sprintf("http://%s/%s", address, endpoint))
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// Periodically move one partition from the hottest or largest shard to the coolest or smallest one
+// Only the first node of the view does this so that moves do not conflict
+func rebalancePartitions() {
+	for {
+		time.Sleep(time.Duration(CONFIG.RebalanceInterval))
+		if !isBalancerLeader() || HASH_RING == nil || reshardInProgress() || isPartitioned() {
+			continue
+		}
+		partID, target, reason := pickPartitionMove()
+		if target == "" {
+			continue
+		}
+		overrides := make(map[int]string)
+		for id, shardid := range PARTITION_OVERRIDES {
+			overrides[id] = shardid
+		}
+		overrides[partID] = target
+		// No override is needed to move a partition back to the shard the ring assigns it to
+		if HASH_RING.GetPartitionOwner(partID).String() == target {
+			delete(overrides, partID)
+		}
+		job := newReshardJob(len(SHARDS), SHARDS)
+		job.Overrides = overrides
+		// Only writes to the moved partition wait for it
+		job.Partitions = []int{partID}
+		if err := runReshard(&job, 0); err != nil {
+			fmt.Printf("Failed to move partition %d to %s: %v\n", partID, target, err)
+			continue
+		}
+		fmt.Printf("Moved partition %d to %s: %s\n", partID, target, reason)
+	}
+}
+
+// Returns true if this node is the one that changes the partitioning on its own
+func isBalancerLeader() bool {
+	viewMutex.Lock()
+	defer viewMutex.Unlock()
+	return len(CURRENT_VIEW) > 0 && sortedCopy(CURRENT_VIEW)[0] == SOCKET_ADDRESS
+}
+
+// Returns the partition to move and its new shard, or "" if every shard is within the threshold
+func pickPartitionMove() (int, string, string) {
+	if len(SHARDS) < 2 {
+		return 0, "", ""
+	}
+	partLoads, partStored, err := collectPartitionLoad()
+	if err != nil {
+		return 0, "", ""
+	}
+	// Hot shards first, then oversized ones
+	metrics := []struct {
+		name  string
+		floor float64
+		value func(partID int) float64
+	}{
+		{"requests", CONFIG.RebalanceMinRequests, func(partID int) float64 { return partLoads[partID].Requests }},
+		{"stored bytes", rebalanceMinBytes, func(partID int) float64 { return float64(partStored[partID].StoredBytes) }},
+	}
+	for _, metric := range metrics {
+		perShard := make(map[string]float64)
+		total := 0.0
+		for shardid := range SHARDS {
+			perShard[shardid] = 0
+		}
+		for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+			perShard[partitionOwner(partID)] += metric.value(partID)
+			total += metric.value(partID)
+		}
+		// Shards are compared by their load per unit of weight
+		totalWeight := 0.0
+		perWeight := make(map[string]float64)
+		for shardid := range SHARDS {
+			totalWeight += shardWeight(SHARD_WEIGHTS, shardid)
+			perWeight[shardid] = perShard[shardid] / shardWeight(SHARD_WEIGHTS, shardid)
+		}
+		shardIDs := sortedShardIDs(SHARDS)
+		sort.SliceStable(shardIDs, func(i, j int) bool { return perWeight[shardIDs[i]] > perWeight[shardIDs[j]] })
+		hot, cold := shardIDs[0], shardIDs[len(shardIDs)-1]
+		average := total / totalWeight
+		if perShard[hot] < metric.floor || perWeight[hot] <= average*CONFIG.RebalanceThreshold {
+			continue
+		}
+		// Move the largest partition that does not make the cold shard the new hot one
+		best, bestValue := -1, 0.0
+		for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+			value := metric.value(partID)
+			if partitionOwner(partID) != hot || value <= bestValue || value > (perShard[hot]-perShard[cold])/2 {
+				continue
+			}
+			if partStored[partID].StoredKeys > CONFIG.RebalanceMaxKeys {
+				continue
+			}
+			best, bestValue = partID, value
+		}
+		if best >= 0 {
+			return best, cold, fmt.Sprintf("%s of %s per unit of weight is %.0f, average is %.0f", metric.name, hot, perWeight[hot], average)
+		}
+	}
+	return 0, "", ""
+}
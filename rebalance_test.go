@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Make this node the only member of shard0 and a test server, which stores no keys, the only member of shard1
+func useTwoShards(t *testing.T) {
+	CONFIG = defaultConfig()
+	useTransport(t, transportHTTP)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"key-sizes": {}}`))
+	}))
+	t.Cleanup(peer.Close)
+	SOCKET_ADDRESS = "127.0.0.1:2"
+	SHARDS = map[string][]string{"shard0": {SOCKET_ADDRESS}, "shard1": {strings.TrimPrefix(peer.URL, "http://")}}
+	MY_SHARD_ID = "shard0"
+	CURRENT_VIEW = []string{SOCKET_ADDRESS}
+	RING_CONFIG = Ring_Config{PartitionCount: CONFIG.PartitionCount, ReplicationFactor: CONFIG.ReplicationFactor, Load: CONFIG.Load}
+	PARTITION_OVERRIDES = make(map[int]string)
+	SHARD_WEIGHTS = make(map[string]float64)
+	HASH_RING = createHashRing(SHARDS)
+	KVSmutex.Lock()
+	KVStore = make(map[string]Value)
+	KVSmutex.Unlock()
+	partitionLoadMutex.Lock()
+	PARTITION_LOAD = make(map[int]*Partition_Load)
+	partitionLoadMutex.Unlock()
+}
+
+// Returns the partitions the ring gives to shardid
+func ringPartitions(shardid string) []int {
+	var partIDs []int
+	for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+		if HASH_RING.GetPartitionOwner(partID).String() == shardid {
+			partIDs = append(partIDs, partID)
+		}
+	}
+	return partIDs
+}
+
+func TestPickPartitionMove(t *testing.T) {
+	useTwoShards(t)
+	CONFIG.RebalanceThreshold = 1.5
+	CONFIG.RebalanceMinRequests = 10
+	hot := ringPartitions("shard0")
+	if len(hot) < 2 {
+		t.Fatalf("shard0 owns partitions %v", hot)
+	}
+	// The busiest partition would make shard1 the hot shard, so the next one moves
+	PARTITION_LOAD[hot[0]] = &Partition_Load{Requests: 100}
+	PARTITION_LOAD[hot[1]] = &Partition_Load{Requests: 30}
+
+	partID, target, reason := pickPartitionMove()
+	if target != "shard1" || partID != hot[1] {
+		t.Errorf("moves partition %d to %q, want %d to shard1", partID, target, hot[1])
+	}
+	if !strings.Contains(reason, "requests of shard0") {
+		t.Errorf("reason is %q", reason)
+	}
+
+	// Moved partitions count for their new shard
+	PARTITION_OVERRIDES = map[int]string{hot[1]: "shard1"}
+	if partID, target, _ := pickPartitionMove(); target != "" {
+		t.Errorf("moves partition %d to %s after the load was evened out", partID, target)
+	}
+	PARTITION_OVERRIDES = make(map[int]string)
+
+	// Too little traffic to act on
+	CONFIG.RebalanceMinRequests = 1000
+	if partID, target, _ := pickPartitionMove(); target != "" {
+		t.Errorf("moves partition %d to %s under the minimum load", partID, target)
+	}
+}
+
+func TestPruneOverrides(t *testing.T) {
+	overrides := map[int]string{1: "shard0", 2: "shard2"}
+	pruned := pruneOverrides(overrides, map[string][]string{"shard0": {"a"}, "shard1": {"b"}})
+	if len(pruned) != 1 || pruned[1] != "shard0" {
+		t.Errorf("pruned overrides are %v", pruned)
+	}
+	if len(overrides) != 2 {
+		t.Error("pruning changed the overrides it was given")
+	}
+}
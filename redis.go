@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest bulk string and array accepted from a Redis client
+const (
+	redisMaxBulk  = 512 << 20
+	redisMaxArray = 1 << 20
+)
+
+// Attempts of INCR and EXPIRE before they give up on a key other clients keep writing
+const redisIncrAttempts = 10
+
+// Reply written as a RESP simple string, e.g. +OK
+type redisStatus string
+
+// Reply written as a RESP error, e.g. -ERR unknown command
+type redisError string
+
+// A Redis client connection
+type redisSession struct {
+	frontendSession
+	conn net.Conn
+}
+
+// Accept Redis clients on address until the listener fails
+func serveRedis(address string, handler http.Handler) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Printf("Failed to start Redis listener on %s: %v\n", address, err)
+		return
+	}
+	fmt.Printf("Redis listener started on %s\n", address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("Redis listener stopped: %v\n", err)
+			return
+		}
+		session := &redisSession{frontendSession{local: conn.LocalAddr(), remote: conn.RemoteAddr(), handler: handler}, conn}
+		go session.serve()
+	}
+}
+
+// Answer the commands of a client until it disconnects
+func (s *redisSession) serve() {
+	defer s.conn.Close()
+	defer recoverSession(s.conn)
+	reader := bufio.NewReader(s.conn)
+	writer := bufio.NewWriter(s.conn)
+	for {
+		args, err := readRedisCommand(reader)
+		if err != nil {
+			if err != io.EOF {
+				writeRedisReply(writer, redisError("ERR Protocol error: "+err.Error()))
+				writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			writeRedisReply(writer, redisStatus("OK"))
+			writer.Flush()
+			return
+		}
+		writeRedisReply(writer, s.execute(args))
+		// Pipelined commands are answered together
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Run a single command and return its reply
+func (s *redisSession) execute(args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+	wrongArgs := redisError("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			return wrongArgs
+		}
+		if len(args) == 1 {
+			return args[0]
+		}
+		return redisStatus("PONG")
+	case "GET":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		return s.get(args[0])
+	case "SET":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		return s.set(args[0], args[1])
+	case "DEL":
+		if len(args) < 1 {
+			return wrongArgs
+		}
+		deleted := 0
+		for _, key := range args {
+			reply := s.del(key)
+			if err, ok := reply.(redisError); ok {
+				return err
+			}
+			deleted += reply.(int)
+		}
+		return deleted
+	case "EXISTS":
+		if len(args) < 1 {
+			return wrongArgs
+		}
+		found := 0
+		for _, key := range args {
+			reply := s.get(key)
+			if err, ok := reply.(redisError); ok {
+				return err
+			}
+			if reply != nil {
+				found++
+			}
+		}
+		return found
+	case "MGET":
+		if len(args) < 1 {
+			return wrongArgs
+		}
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			reply := s.get(key)
+			if err, ok := reply.(redisError); ok {
+				return err
+			}
+			values[i] = reply
+		}
+		return values
+	case "MSET":
+		if len(args) < 2 || len(args)%2 != 0 {
+			return wrongArgs
+		}
+		// Keys of different shards are written one by one, so MSET is not atomic
+		for i := 0; i < len(args); i += 2 {
+			if reply := s.set(args[i], args[i+1]); reply != redisStatus("OK") {
+				return reply
+			}
+		}
+		return redisStatus("OK")
+	case "INCR":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		return s.incr(args[0])
+	case "EXPIRE":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		return s.expire(args[0], args[1])
+	case "SCAN":
+		if len(args) < 1 {
+			return wrongArgs
+		}
+		return s.scan(args)
+	case "SELECT":
+		// There is a single database
+		if len(args) != 1 || args[0] != "0" {
+			return redisError("ERR DB index is out of range")
+		}
+		return redisStatus("OK")
+	case "COMMAND":
+		return []interface{}{}
+	}
+	return redisError("ERR unknown command '" + strings.ToLower(name) + "'")
+}
+
+// Returns the error reply for a failed KVS request
+func redisKVSError(status int, reply map[string]interface{}) redisError {
+	if message, ok := reply["error"].(string); ok {
+		return redisError("ERR " + message)
+	}
+	return redisError(fmt.Sprintf("ERR request failed with status %d", status))
+}
+
+// Returns the value of key as a string, nil if it does not exist, or an error
+func (s *redisSession) get(key string) interface{} {
+	status, reply := s.kvsRequest("GET", key, nil)
+	switch status {
+	case http.StatusOK:
+		return replyValueString(reply)
+	case http.StatusNotFound:
+		return nil
+	}
+	return redisKVSError(status, reply)
+}
+
+func (s *redisSession) set(key string, value string) interface{} {
+	// An empty value is rejected by putKey
+	if value == "" {
+		return redisError("ERR empty values are not supported")
+	}
+	// Like Redis, a new value clears any expiry, as the write carries none
+	status, reply := s.kvsRequest("PUT", key, map[string]interface{}{"value": value})
+	if status != http.StatusOK && status != http.StatusCreated {
+		return redisKVSError(status, reply)
+	}
+	return redisStatus("OK")
+}
+
+// Returns 1 if key was deleted, 0 if it did not exist, or an error
+func (s *redisSession) del(key string) interface{} {
+	status, reply := s.kvsRequest("DELETE", key, nil)
+	switch status {
+	case http.StatusOK:
+		return 1
+	case http.StatusNotFound:
+		return 0
+	}
+	return redisKVSError(status, reply)
+}
+
+// Read, increment and write back an integer value
+// The write only succeeds if no other write came in between, otherwise it starts over, up to redisIncrAttempts times
+func (s *redisSession) incr(key string) interface{} {
+	for attempt := 0; attempt < redisIncrAttempts; attempt++ {
+		status, reply := s.kvsRequest("GET", key, nil)
+		number, version := int64(0), uint64(0)
+		switch status {
+		case http.StatusOK:
+			var err error
+			if number, err = strconv.ParseInt(replyValueString(reply), 10, 64); err != nil {
+				return redisError("ERR value is not an integer or out of range")
+			}
+			version = replyUint(reply, "version")
+		case http.StatusNotFound:
+		default:
+			return redisKVSError(status, reply)
+		}
+		number++
+		// Like Redis, the key keeps its expiry
+		status, reply = s.kvsRequest("PUT", key, map[string]interface{}{"value": strconv.FormatInt(number, 10), "if-version": version, "expires-at": replyUint(reply, "expires-at")})
+		if status == http.StatusConflict {
+			continue
+		}
+		if status != http.StatusOK && status != http.StatusCreated {
+			return redisKVSError(status, reply)
+		}
+		return int(number)
+	}
+	return redisError("ERR key " + key + " kept changing while it was incremented; try again later")
+}
+
+// Delete key after the given number of seconds
+// The value is written back with its expiry time, so that every replica drops it;
+// the write only succeeds if no other write came in between, otherwise it starts over, up to redisIncrAttempts times
+func (s *redisSession) expire(key string, seconds string) interface{} {
+	ttl, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return redisError("ERR value is not an integer or out of range")
+	}
+	if ttl <= 0 {
+		return s.del(key)
+	}
+	for attempt := 0; attempt < redisIncrAttempts; attempt++ {
+		status, reply := s.kvsRequest("GET", key, nil)
+		switch status {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return 0
+		default:
+			return redisKVSError(status, reply)
+		}
+		fields := map[string]interface{}{
+			"value":      reply["value"],
+			"type":       reply["type"],
+			"flags":      replyUint(reply, "flags"),
+			"if-version": replyUint(reply, "version"),
+			"expires-at": time.Now().Add(time.Duration(ttl) * time.Second).UnixMilli(),
+		}
+		status, reply = s.kvsRequest("PUT", key, fields)
+		if status == http.StatusConflict {
+			continue
+		}
+		if status != http.StatusOK && status != http.StatusCreated {
+			return redisKVSError(status, reply)
+		}
+		return 1
+	}
+	return redisError("ERR key " + key + " kept changing while its expiry was set; try again later")
+}
+
+// SCAN <cursor> [MATCH <pattern>] [COUNT <count>]
+// The cursor is an offset into the sorted keys of every shard
+func (s *redisSession) scan(args []string) interface{} {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return redisError("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return redisError("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return redisError("ERR value is not an integer or out of range")
+			}
+		default:
+			return redisError("ERR syntax error")
+		}
+	}
+	sizes, err := fetchAllKeySizes()
+	if err != nil {
+		return redisError("ERR " + err.Error())
+	}
+	var keys []string
+	for _, shardSizes := range sizes {
+		for key := range shardSizes {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	matched := []interface{}{}
+	end := cursor + count
+	if end >= len(keys) {
+		end = len(keys)
+	}
+	for i := cursor; i < end; i++ {
+		if ok, _ := path.Match(pattern, keys[i]); ok {
+			matched = append(matched, keys[i])
+		}
+	}
+	next := strconv.Itoa(end)
+	if end >= len(keys) {
+		next = "0"
+	}
+	return []interface{}{next, matched}
+}
+
+// Read a command sent as a RESP array of bulk strings, or as an inline command
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readRedisLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > redisMaxArray {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+	// A null or empty array is no command, as in Redis
+	if count <= 0 {
+		return nil, nil
+	}
+	// The count comes from the client, so args grows as the arguments actually arrive
+	args := make([]string, 0, min(count, 16))
+	for i := 0; i < count; i++ {
+		line, err := readRedisLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got '%s'", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > redisMaxBulk {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// Read a line without its CRLF
+func readRedisLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Write a reply: nil is a null bulk string, string a bulk string, int an integer
+// and []interface{} an array of replies
+func writeRedisReply(writer *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		writer.WriteString("$-1\r\n")
+	case redisStatus:
+		writer.WriteString("+" + string(v) + "\r\n")
+	case redisError:
+		// Line breaks would end the error early
+		writer.WriteString("-" + strings.ReplaceAll(string(v), "\n", " ") + "\r\n")
+	case string:
+		fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(v), v)
+	case int:
+		fmt.Fprintf(writer, ":%d\r\n", v)
+	case []interface{}:
+		fmt.Fprintf(writer, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRedisReply(writer, item)
+		}
+	}
+}
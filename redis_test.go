@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DistributedClocks/GoVector/govec/vclock"
+	"github.com/labstack/echo/v4"
+)
+
+func TestReadRedisCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		args    []string
+		wantErr bool
+	}{
+		{"array", "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$5\r\nhello\r\n", []string{"SET", "a", "hello"}, false},
+		{"binary-safe bulk string", "*2\r\n$3\r\nGET\r\n$4\r\na\r\nb\r\n", []string{"GET", "a\r\nb"}, false},
+		{"inline", "GET  a\r\n", []string{"GET", "a"}, false},
+		{"null array", "*-1\r\n", nil, false},
+		{"empty array", "*0\r\n", nil, false},
+		{"huge count", "*1048577\r\n", nil, true},
+		{"count larger than the arguments sent", "*1000000\r\n$4\r\nPING\r\n", nil, true},
+		{"invalid count", "*x\r\n", nil, true},
+		{"missing $", "*1\r\n+GET\r\n", nil, true},
+		{"negative bulk length", "*1\r\n$-1\r\n", nil, true},
+		{"short bulk string", "*1\r\n$10\r\nGET\r\n", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := readRedisCommand(bufio.NewReader(strings.NewReader(test.input)))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(args, test.args) {
+				t.Errorf("args = %q, want %q", args, test.args)
+			}
+		})
+	}
+}
+
+// Commands sent back to back are read one at a time
+func TestReadRedisCommandPipelined(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\n*-1\r\nPING\r\n"))
+	for _, want := range [][]string{{"PING"}, nil, {"PING"}} {
+		args, err := readRedisCommand(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, want) {
+			t.Errorf("args = %q, want %q", args, want)
+		}
+	}
+	if _, err := readRedisCommand(reader); err != io.EOF {
+		t.Errorf("err = %v at the end of the input, want EOF", err)
+	}
+}
+
+// Returns the KVS handlers of a node that is the only member of the only shard
+func startLocalNode(t *testing.T) http.Handler {
+	CONFIG = defaultConfig()
+	useTransport(t, transportHTTP)
+	SOCKET_ADDRESS = "127.0.0.1:2"
+	SHARDS = map[string][]string{"shard0": {SOCKET_ADDRESS}}
+	MY_SHARD_ID = "shard0"
+	HASH_RING = createHashRing(SHARDS)
+	CURRENT_VIEW = []string{SOCKET_ADDRESS}
+	KVSmutex.Lock()
+	KVStore = make(map[string]Value)
+	KVSmutex.Unlock()
+	vectorClockMutex.Lock()
+	MY_VECTOR_CLOCK = vclock.New()
+	vectorClockMutex.Unlock()
+	e := echo.New()
+	e.GET("/kvs/:key", getKey)
+	e.PUT("/kvs/:key", putKey)
+	e.DELETE("/kvs/:key", deleteKey)
+	return e
+}
+
+// EXPIRE stores the expiry time with the value, INCR keeps it and SET clears it
+func TestRedisExpire(t *testing.T) {
+	handler := startLocalNode(t)
+	address, _ := net.ResolveTCPAddr("tcp", SOCKET_ADDRESS)
+	s := &redisSession{frontendSession: frontendSession{local: address, remote: address, handler: handler}}
+	expires := func() int64 {
+		KVSmutex.Lock()
+		defer KVSmutex.Unlock()
+		return KVStore["a"].Expires
+	}
+
+	if reply := s.expire("a", "10"); reply != 0 {
+		t.Errorf("EXPIRE of a missing key returned %v", reply)
+	}
+	s.set("a", "1")
+	before := time.Now()
+	if reply := s.expire("a", "10"); reply != 1 {
+		t.Fatalf("EXPIRE returned %v", reply)
+	}
+	if got := expires(); got < before.Add(10*time.Second).UnixMilli() || got > time.Now().Add(10*time.Second).UnixMilli() {
+		t.Errorf("a expires at %d, want 10s from %d", got, before.UnixMilli())
+	}
+	set := expires()
+	if reply := s.incr("a"); reply != 2 {
+		t.Fatalf("INCR returned %v", reply)
+	}
+	if got := expires(); got != set {
+		t.Errorf("INCR changed the expiry time of a from %d to %d", set, got)
+	}
+	if reply := s.get("a"); reply != "2" {
+		t.Errorf("GET returned %v after INCR", reply)
+	}
+	s.set("a", "3")
+	if got := expires(); got != 0 {
+		t.Errorf("SET left a expiring at %d", got)
+	}
+
+	// A key whose expiry time has passed is missing, even before it is swept
+	s.expire("a", "10")
+	KVSmutex.Lock()
+	value := KVStore["a"]
+	value.Expires = time.Now().Add(-time.Second).UnixMilli()
+	KVStore["a"] = value
+	KVSmutex.Unlock()
+	if reply := s.get("a"); reply != nil {
+		t.Errorf("GET of expired a returned %v", reply)
+	}
+	if reply := s.del("a"); reply != 0 {
+		t.Errorf("DEL of expired a returned %v", reply)
+	}
+	if reply := s.incr("a"); reply != 1 {
+		t.Errorf("INCR of expired a returned %v", reply)
+	}
+	if got := expires(); got != 0 {
+		t.Errorf("INCR of expired a kept its expiry time %d", got)
+	}
+
+	if reply := s.expire("a", "0"); reply != 1 {
+		t.Errorf("EXPIRE with no time left returned %v", reply)
+	}
+	if reply := s.get("a"); reply != nil {
+		t.Errorf("GET returned %v after EXPIRE with no time left", reply)
+	}
+}
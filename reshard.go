@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Set while a reshard is between its prepare and commit or abort phases
+var RESHARDING bool
+
+// Partitions whose keys are fenced while a partition move is in progress
+// Nil unless the current job only moves some partitions
+var FENCED_PARTITIONS map[int]bool
+
+// Shard map being installed by the current reshard
+var PENDING_SHARDS map[string][]string
+
+// ID of the reshard job that set the fence
+var RESHARD_JOB string
+
+// Keys received for the pending shard map that this node did not store before
+var RESHARD_RECEIVED = make(map[string]bool)
+
+// Keys this node sent to each new shard in the last transfer phase
+var RESHARD_SENT = make(map[string]int)
+
+// Protects RESHARDING, FENCED_PARTITIONS, PENDING_SHARDS, RESHARD_JOB, RESHARD_RECEIVED and RESHARD_SENT
+// Client writes hold the read lock while they are applied
+var reshardMutex sync.RWMutex
+
+// Number of replication requests sent by broadcast that have not completed yet
+var pendingSends atomic.Int64
+
+// Sequence numbers of the replication requests that have not completed yet
+// Lets a drain wait for the requests sent before a fence, and not for the ones sent after it
+var inflightSends = make(map[uint64]bool)
+
+// Sequence number of the last replication request sent
+var lastSendSeq uint64
+
+// Protects inflightSends and lastSendSeq
+var inflightSendsMutex sync.Mutex
+
+// Define JSON body for reshard requests
+type Reshard_Request struct {
+	ShardCount int `json:"shard-count"`
+}
+
+// Define JSON body returned by every node for each reshard phase
+type Reshard_Phase_Result struct {
+	Result   string         `json:"result"`
+	KeysSent map[string]int `json:"keys-sent,omitempty"`
+}
+
+// Define JSON body for /shard/kvs-bulk requests
+type Bulk_Update_Request struct {
+	Entries     map[string]Value `json:"entries"`
+	FromRepilca string           `json:"from-replica,omitempty"`
+	// Vector clock of the write fence of an import, empty otherwise
+	// Imported values are stored once every write of the cut is applied, over the versions they replace
+	ImportCut string `json:"import-cut,omitempty"`
+}
+
+// The phases of a reshard, run on every node in the order of reshardSequence
+// A failure in any phase before commit aborts the reshard
+var reshardPhases = map[string]func(job Reshard_Job) error{
+	"prepare":  prepareReshard,
+	"drain":    drainReplication,
+	"transfer": transferForReshard,
+	"commit":   commitReshard,
+	"release":  releaseReshard,
+	"abort":    abortReshard,
+	"record":   recordReshard,
+}
+
+// Order in which the phases of a reshard are run
+var reshardSequence = []string{"prepare", "drain", "transfer", "commit", "release"}
+
+// Returns true while a reshard or partition move is in progress
+func reshardInProgress() bool {
+	reshardMutex.RLock()
+	defer reshardMutex.RUnlock()
+	return RESHARD_JOB != ""
+}
+
+// Returns true if client writes to key are fenced by the current reshard
+// Called with reshardMutex held
+func writeFenced(key string) bool {
+	return RESHARDING || FENCED_PARTITIONS != nil && FENCED_PARTITIONS[partitionOf(key)]
+}
+
+// PUT /shard/reshard
+// JSON body {"shard-count": <INTEGER>}
+// Trigger a reshard into <INTEGER> shards
+func reshard(c echo.Context) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+
+	var input Reshard_Request
+	jsonErr := json.Unmarshal(body, &input)
+	if jsonErr != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+
+	// Changing the shard map from a minority partition would diverge from the majority
+	if isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; resharding is disabled"})
+	}
+	if reshardInProgress() {
+		reshardMutex.RLock()
+		jobID := RESHARD_JOB
+		reshardMutex.RUnlock()
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A reshard is already in progress", "job-id": jobID})
+	}
+	targetNumShards := input.ShardCount
+	// Check if there are enough nodes to provide fault tolerance with the requested shard count
+	if !validShardCount(targetNumShards) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Not enough nodes to provide fault tolerance with requested shard count"})
+	}
+
+	// Ranges are split, and weighted partitions picked, by the keys they hold
+	var sizes map[string]map[string]int
+	if CONFIG.Partitioner == partitionerRange || len(SHARD_WEIGHTS) > 0 {
+		if sizes, err = fetchAllKeySizes(); err != nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		}
+	}
+	job, err := planReshard(targetNumShards, sizes)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := runReshard(&job, 0); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Reshard " + job.State + ": " + err.Error(), "job-id": job.ID})
+	}
+	// Return success
+	return c.JSON(http.StatusOK, map[string]string{"result": "resharded", "job-id": job.ID})
+}
+
+// Check if the number of shards is valid for the current view
+func validShardCount(targetNumShards int) bool {
+	numNodes := len(CURRENT_VIEW)
+	currNumShards := len(HASH_RING.GetMembers())
+	return targetNumShards >= 1 && (targetNumShards <= currNumShards || numNodes/targetNumShards >= CONFIG.MinNodesPerShard)
+}
+
+// Returns the shard map for a reshard into targetNumShards shards
+// Nodes stay in their current shard where possible and are spread over failure domains
+func planShards(targetNumShards int) map[string][]string {
+	viewMutex.Lock()
+	nodes := append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	return assignNodesToShards(targetNumShards, nodes, SHARDS, fetchFailureDomains(nodes))
+}
+
+// Ask every node for its failure domain label
+// Nodes that do not answer are treated as unlabeled
+func fetchFailureDomains(nodes []string) map[string]string {
+	domains := make(map[string]string)
+	var domainsMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, address := range nodes {
+		if address == SOCKET_ADDRESS {
+			domains[address] = CONFIG.FailureDomain
+			continue
+		}
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			client := peerClient(time.Duration(CONFIG.SendToAnyTimeout))
+			resp, err := client.Get(fmt.Sprintf("http://%s/admin/config", address))
+			if err != nil {
+				return
+			}
+			defer drainAndClose(resp.Body)
+			var cfg struct {
+				FailureDomain string `json:"failure-domain"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+				return
+			}
+			domainsMutex.Lock()
+			domains[address] = cfg.FailureDomain
+			domainsMutex.Unlock()
+		}(address)
+	}
+	wg.Wait()
+	return domains
+}
+
+// Returns the job that reshards into targetNumShards shards
+// sizes holds the keys of every current shard and may be nil with unweighted hash partitioning
+func planReshard(targetNumShards int, sizes map[string]map[string]int) (Reshard_Job, error) {
+	if err := checkRingCapacity(RING_CONFIG, targetNumShards); err != nil {
+		return Reshard_Job{}, err
+	}
+	shards := planShards(targetNumShards)
+	job := newReshardJob(targetNumShards, shards)
+	if CONFIG.Partitioner == partitionerRange {
+		job.Ranges = planRanges(shards, sizes)
+	} else if len(job.Weights) > 0 {
+		// The new ring assigns partitions evenly again
+		job.Overrides = weightedOverrides(createHashRing(shards), shards, job.Weights, job.Overrides, partitionKeyCounts(sizes))
+	}
+	return job, nil
+}
+
+// Returns the size of every key of every shard, by shard id
+func fetchAllKeySizes() (map[string]map[string]int, error) {
+	sizes := make(map[string]map[string]int)
+	for shardid := range SHARDS {
+		shardSizes, err := fetchShardKeySizes(shardid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get keys of %s: %v", shardid, err)
+		}
+		sizes[shardid] = shardSizes
+	}
+	return sizes, nil
+}
+
+// Define JSON body for a single shard-to-shard migration in a reshard plan
+type Reshard_Migration struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Keys  int    `json:"keys"`
+	Bytes int    `json:"bytes"`
+}
+
+// GET /shard/reshard-plan?shard-count=<INTEGER>
+// Reports what a reshard into <INTEGER> shards would do without applying it
+func getReshardPlan(c echo.Context) error {
+	targetNumShards, err := strconv.Atoi(c.QueryParam("shard-count"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid shard count"})
+	}
+	if !validShardCount(targetNumShards) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Not enough nodes to provide fault tolerance with requested shard count"})
+	}
+	allSizes, err := fetchAllKeySizes()
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	}
+	job, err := planReshard(targetNumShards, allSizes)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	newShards, newRanges, newOverrides := job.Shards, job.Ranges, job.Overrides
+	newRing := createHashRing(newShards)
+
+	// Count keys and bytes per pair of current and new shard
+	keyCounts := make(map[string]int)
+	for shardid := range newShards {
+		keyCounts[shardid] = 0
+	}
+	migrations := make(map[[2]string]*Reshard_Migration)
+	keysMoving, bytesMoving := 0, 0
+	for shardid, sizes := range allSizes {
+		for key, size := range sizes {
+			target := locateShardIn(newRing, newRanges, newOverrides, key)
+			keyCounts[target]++
+			if target == shardid {
+				continue
+			}
+			pair := [2]string{shardid, target}
+			if migrations[pair] == nil {
+				migrations[pair] = &Reshard_Migration{From: shardid, To: target}
+			}
+			migrations[pair].Keys++
+			migrations[pair].Bytes += size
+			keysMoving++
+			bytesMoving += size
+		}
+	}
+	migrationList := make([]Reshard_Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		migrationList = append(migrationList, *migration)
+	}
+	sort.Slice(migrationList, func(i, j int) bool {
+		if migrationList[i].From != migrationList[j].From {
+			return migrationList[i].From < migrationList[j].From
+		}
+		return migrationList[i].To < migrationList[j].To
+	})
+
+	plan := map[string]interface{}{
+		"shard-count":  targetNumShards,
+		"shards":       newShards,
+		"key-counts":   keyCounts,
+		"migrations":   migrationList,
+		"keys-moving":  keysMoving,
+		"bytes-moving": bytesMoving,
+	}
+	if newRanges != nil {
+		plan["ranges"] = newRanges
+	}
+	return c.JSON(http.StatusOK, plan)
+}
+
+// Returns the size of every key stored by a shard, asking one of its members if needed
+func fetchShardKeySizes(shardid string) (map[string]int, error) {
+	if shardid == MY_SHARD_ID {
+		return localKeySizes(), nil
+	}
+	resp, err := sendToAny("GET", "shard/key-sizes/"+shardid, nil, SHARDS[shardid])
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp.Body)
+	var body map[string]map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("error decoding key sizes: %v", err)
+	}
+	return body["key-sizes"], nil
+}
+
+// Drive every node through the reshard phases, starting with reshardSequence[from]
+// Keys are only deleted from their old shard once every transfer was acknowledged
+func runReshard(job *Reshard_Job, from int) error {
+	if !startCoordinating(job.ID) {
+		return fmt.Errorf("job is already being coordinated by this node")
+	}
+	defer stopCoordinating()
+	// Time the whole reshard, labelled with how it ended
+	defer func(start time.Time) {
+		reshardDuration.WithLabelValues(job.State).Observe(time.Since(start).Seconds())
+	}(time.Now())
+	job.Coordinator = SOCKET_ADDRESS
+	job.State = reshardStateRunning
+	job.Error = ""
+
+	for _, name := range reshardSequence[from:] {
+		if name == "commit" && metadataEnabled() {
+			// Record the new shard map before anyone starts using it
+			_, err := updateClusterConfig(func(cfg *Cluster_Config) bool {
+				cfg.ShardCount = job.ShardCount
+				cfg.Shards = job.Shards
+				cfg.Ranges = job.Ranges
+				cfg.Overrides = job.Overrides
+				cfg.Weights = job.Weights
+				return true
+			})
+			if err != nil {
+				job.Error = fmt.Sprintf("failed to commit new shard map: %v", err)
+				rollbackReshard(job)
+				return fmt.Errorf("%s", job.Error)
+			}
+		}
+		if err := runReshardPhase(name, job); err != nil {
+			job.Error = fmt.Sprintf("%s phase failed: %v", name, err)
+			// Once a node has committed, the reshard can only be resumed
+			if reshardPhaseIndex(name) < reshardPhaseIndex("commit") {
+				rollbackReshard(job)
+			} else {
+				job.State = reshardStateFailed
+				runReshardPhase("record", job)
+			}
+			return fmt.Errorf("%s", job.Error)
+		}
+	}
+	job.State = reshardStateCompleted
+	runReshardPhase("record", job)
+	return nil
+}
+
+// Abort the reshard on every node and record the outcome
+func rollbackReshard(job *Reshard_Job) error {
+	err := runReshardPhase("abort", job)
+	job.State = reshardStateAborted
+	runReshardPhase("record", job)
+	return err
+}
+
+// Run one phase on every node of the job in parallel, including this one
+// Every node records the job before running the phase
+func runReshardPhase(name string, job *Reshard_Job) error {
+	defer func(start time.Time) {
+		reshardPhaseDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}(time.Now())
+	// Recording the job does not start a new phase
+	if name != "record" {
+		job.Phase = name
+		job.resetProgress()
+	}
+	job.Updated = time.Now()
+	nodes := job.liveNodes()
+	jsonBytes, _ := json.Marshal(job)
+	results := make(map[string]Reshard_Phase_Result)
+	errs := make(map[string]error)
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, address := range nodes {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			var result Reshard_Phase_Result
+			var err error
+			if address == SOCKET_ADDRESS {
+				result, err = runLocalReshardPhase(name, *job)
+			} else {
+				var body []byte
+				body, err = sendAndAck("PUT", address, "shard/reshard/"+name, jsonBytes)
+				if err == nil {
+					err = json.Unmarshal(body, &result)
+				}
+			}
+			resultsMutex.Lock()
+			if err != nil {
+				errs[address] = err
+			} else {
+				results[address] = result
+			}
+			resultsMutex.Unlock()
+		}(address)
+	}
+	wg.Wait()
+	if name != "record" {
+		job.recordProgress(results)
+	}
+	saveReshardJob(*job)
+	for address, err := range errs {
+		return fmt.Errorf("%s: %v", address, err)
+	}
+	return nil
+}
+
+// Record the job and run one of its phases on this node
+func runLocalReshardPhase(name string, job Reshard_Job) (Reshard_Phase_Result, error) {
+	saveReshardJob(job)
+	if err := reshardPhases[name](job); err != nil {
+		return Reshard_Phase_Result{}, err
+	}
+	result := Reshard_Phase_Result{Result: name}
+	if name == "transfer" {
+		reshardMutex.RLock()
+		result.KeysSent = RESHARD_SENT
+		reshardMutex.RUnlock()
+	}
+	return result, nil
+}
+
+// PUT /shard/reshard/<phase>
+// Private endpoint used by the reshard coordinator
+func reshardPhase(c echo.Context) error {
+	name := c.Param("phase")
+	if _, ok := reshardPhases[name]; !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown reshard phase"})
+	}
+	var job Reshard_Job
+	if err := c.Bind(&job); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	result, err := runLocalReshardPhase(name, job)
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// Fence client writes and remember the shard map to install
+// A job that moves partitions only fences the keys of those partitions
+// Preparing again for the same job is a no-op so that a resumed job can repeat it
+func prepareReshard(job Reshard_Job) error {
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	if RESHARD_JOB != "" {
+		if RESHARD_JOB == job.ID {
+			return nil
+		}
+		return fmt.Errorf("another reshard is in progress")
+	}
+	if BACKUP_FENCE != "" {
+		return fmt.Errorf("a backup or restore is in progress")
+	}
+	if len(job.Partitions) > 0 {
+		FENCED_PARTITIONS = make(map[int]bool)
+		for _, partID := range job.Partitions {
+			FENCED_PARTITIONS[partID] = true
+		}
+	} else {
+		RESHARDING = true
+	}
+	RESHARD_JOB = job.ID
+	PENDING_SHARDS = job.Shards
+	RESHARD_RECEIVED = make(map[string]bool)
+	return nil
+}
+
+// Wait until every write accepted before the fence has been replicated
+// Writes to partitions that are not fenced keep replicating meanwhile
+func drainReplication(job Reshard_Job) error {
+	deadline := time.Now().Add(time.Duration(CONFIG.ReshardTimeout))
+	inflightSendsMutex.Lock()
+	fenced := lastSendSeq
+	inflightSendsMutex.Unlock()
+	for {
+		pending := sendsPendingUntil(fenced)
+		if pending == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d replication requests still pending", pending)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Track a replication request until the returned function is called
+func trackSend() func() {
+	pendingSends.Add(1)
+	inflightSendsMutex.Lock()
+	lastSendSeq++
+	seq := lastSendSeq
+	inflightSends[seq] = true
+	inflightSendsMutex.Unlock()
+	return func() {
+		inflightSendsMutex.Lock()
+		delete(inflightSends, seq)
+		inflightSendsMutex.Unlock()
+		pendingSends.Add(-1)
+	}
+}
+
+// Returns the number of replication requests up to sequence number seq that have not completed
+func sendsPendingUntil(seq uint64) int {
+	inflightSendsMutex.Lock()
+	defer inflightSendsMutex.Unlock()
+	pending := 0
+	for s := range inflightSends {
+		if s <= seq {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Send every key to the members of the shard it belongs to under the new map
+// Nodes that left the view are skipped so that a resumed job can finish without them
+func transferForReshard(job Reshard_Job) error {
+	newRing := createHashRing(job.Shards)
+	newRanges := jobRanges(job)
+	// Members of my current shard already store every key I have
+	sameShard := SHARDS[MY_SHARD_ID]
+
+	KVSmutex.Lock()
+	batches := make(map[string]map[string]Value)
+	sent := make(map[string]int)
+	for key, value := range KVStore {
+		// Keys outside the moved partitions stay where they are
+		if len(job.Partitions) > 0 && !containsPartition(job.Partitions, partitionOf(key)) {
+			continue
+		}
+		shardid := locateShardIn(newRing, newRanges, job.Overrides, key)
+		moved := false
+		for _, address := range job.Shards[shardid] {
+			if address == SOCKET_ADDRESS || contains(sameShard, address) || !contains(CURRENT_VIEW, address) {
+				continue
+			}
+			if batches[address] == nil {
+				batches[address] = make(map[string]Value)
+			}
+			batches[address][key] = value
+			moved = true
+		}
+		if moved {
+			sent[shardid]++
+		}
+	}
+	KVSmutex.Unlock()
+
+	for address, entries := range batches {
+		if err := sendInBulk(address, entries, ""); err != nil {
+			return fmt.Errorf("transfer to %s failed: %v", address, err)
+		}
+	}
+	reshardMutex.Lock()
+	RESHARD_SENT = sent
+	reshardMutex.Unlock()
+	return nil
+}
+
+// Returns the range map the job installs, deriving one if the job has none
+func jobRanges(job Reshard_Job) []Key_Range {
+	if CONFIG.Partitioner != partitionerRange || job.Ranges != nil {
+		return job.Ranges
+	}
+	return initialRanges(job.Shards)
+}
+
+// Install the new shard map and drop the keys that moved away
+func commitReshard(job Reshard_Job) error {
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	SHARDS = job.Shards
+	RANGES = jobRanges(job)
+	PARTITION_OVERRIDES = pruneOverrides(job.Overrides, job.Shards)
+	SHARD_WEIGHTS = pruneWeights(job.Weights, job.Shards)
+	// Update my shard id in MY_SHARD_ID
+	updateMyShardID()
+	// Update Hash Ring
+	rebuildRouting()
+	// Every transfer was acknowledged, so keys outside my shard can go
+	KVSmutex.Lock()
+	for key := range KVStore {
+		if locateShard(key) != MY_SHARD_ID {
+			delete(KVStore, key)
+		}
+	}
+	KVSmutex.Unlock()
+	// Nodes missing from the view at this point are no longer part of the cluster
+	setAgreedView(CURRENT_VIEW)
+	PENDING_SHARDS = nil
+	RESHARD_RECEIVED = make(map[string]bool)
+	return nil
+}
+
+// Lift the write fence once every node has committed
+func releaseReshard(job Reshard_Job) error {
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	if RESHARD_JOB == job.ID {
+		RESHARDING = false
+		FENCED_PARTITIONS = nil
+		RESHARD_JOB = ""
+	}
+	return nil
+}
+
+// Keep the old shard map and drop keys received for the new one
+func abortReshard(job Reshard_Job) error {
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	// Nothing to undo on a node that never prepared this job
+	if RESHARD_JOB != job.ID {
+		return nil
+	}
+	KVSmutex.Lock()
+	for key := range RESHARD_RECEIVED {
+		delete(KVStore, key)
+	}
+	KVSmutex.Unlock()
+	RESHARDING = false
+	FENCED_PARTITIONS = nil
+	RESHARD_JOB = ""
+	PENDING_SHARDS = nil
+	RESHARD_RECEIVED = make(map[string]bool)
+	return nil
+}
+
+// Only record the job, e.g. once it completed or was aborted
+func recordReshard(job Reshard_Job) error {
+	return nil
+}
+
+// PUT /shard/kvs-bulk
+// Private endpoint that stores a batch of key-values moved from another shard
+func updateKvsInBulk(c echo.Context) error {
+	var input Bulk_Update_Request
+	if err := c.Bind(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	if input.ImportCut != "" {
+		cut, err := NewVClockFromString(input.ImportCut)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid metadata format"})
+		}
+		// Wait for the replication of writes accepted before the fence, which the import must replace
+		deadline := time.Now().Add(time.Duration(CONFIG.BackupTimeout))
+		for !clockCovers(cut) {
+			if time.Now().After(deadline) {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Replication did not reach the import cut in time"})
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	reshardMutex.Lock()
+	KVSmutex.Lock()
+	for key, value := range input.Entries {
+		current, existed := KVStore[key]
+		if !existed && RESHARD_JOB != "" {
+			RESHARD_RECEIVED[key] = true
+		}
+		if input.ImportCut != "" {
+			value.Version = importVersion(current.Version)
+		}
+		KVStore[key] = value
+	}
+	KVSmutex.Unlock()
+	reshardMutex.Unlock()
+	return c.JSON(http.StatusOK, map[string]int{"stored": len(input.Entries)})
+}
+
+// Send entries to a node in batches, each of which must be acknowledged
+// importCut is the vector clock of the write fence of an import, and empty otherwise
+func sendInBulk(address string, entries map[string]Value, importCut string) error {
+	batch := make(map[string]Value)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		jsonBytes, err := json.Marshal(Bulk_Update_Request{Entries: batch, FromRepilca: SOCKET_ADDRESS, ImportCut: importCut})
+		if err != nil {
+			return err
+		}
+		batch = make(map[string]Value)
+		_, err = sendAndAck("PUT", address, "shard/kvs-bulk", jsonBytes)
+		return err
+	}
+	for key, value := range entries {
+		batch[key] = value
+		if len(batch) >= CONFIG.ReshardBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// Send a request to one node and return an error unless it answers 200
+// Returns the body of the response
+func sendAndAck(method string, address string, endpoint string, jsonData []byte) ([]byte, error) {
+	client := peerClient(time.Duration(CONFIG.ReshardTimeout))
+	url := fmt.Sprintf("http://%s/%s", address, endpoint)
+	request, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp.Body)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received status %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// Send a request to every node of nodes but this one, each of which must acknowledge it
+// Returns the nodes that did not
+func sendAndAckAll(method string, endpoint string, jsonData []byte, nodes []string) []string {
+	missed := []string{}
+	for _, address := range nodes {
+		if address == SOCKET_ADDRESS {
+			continue
+		}
+		if _, err := sendAndAck(method, address, endpoint, jsonData); err != nil {
+			fmt.Printf("%s did not apply %s: %v\n", address, endpoint, err)
+			missed = append(missed, address)
+		}
+	}
+	return missed
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"webservice/client"
+)
+
+// Send a reshard into shardCount shards to node and return its reply
+func requestReshard(t *testing.T, node string, shardCount int) (int, map[string]string) {
+	body, _ := json.Marshal(Reshard_Request{ShardCount: shardCount})
+	req, _ := http.NewRequest("PUT", "http://"+node+"/shard/reshard", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("reshard request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var reply map[string]string
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return resp.StatusCode, reply
+}
+
+// Wait until no node has replication requests left to send, as reported on /metrics
+func waitForReplication(t *testing.T, nodes []string) {
+	deadline := time.Now().Add(30 * time.Second)
+	for _, node := range nodes {
+		for {
+			resp, err := http.Get("http://" + node + "/metrics")
+			if err != nil {
+				t.Fatalf("failed to read metrics of %s: %v", node, err)
+			}
+			metrics, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if strings.Contains(string(metrics), "\nkvs_replication_queue_depth 0\n") {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("replication from %s did not finish", node)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// Get key from node itself, retrying while it has not seen the writes in causal yet
+func getFromNode(t *testing.T, node string, key string, causal string) (int, map[string]interface{}) {
+	body, _ := json.Marshal(KVS_GET_DELETE_Request{CausalMetaData: causal})
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		req, _ := http.NewRequest("GET", "http://"+node+"/kvs/"+url.PathEscape(key), bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s from %s failed: %v", key, node, err)
+		}
+		var reply map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&reply)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || time.Now().After(deadline) {
+			return resp.StatusCode, reply
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Writes keep being acknowledged while a reshard moves keys between shards,
+// and every acknowledged write is found on every member of the shard that owns its key afterwards
+func TestReshardKeepsAcknowledgedWrites(t *testing.T) {
+	cluster := startCluster(t, 6, 2)
+	ctx := context.Background()
+	kvs, err := client.New(cluster.nodes, &client.Options{MaxRetries: 100, MaxBackoff: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every writer owns its keys, so the last acknowledged value of a key is the one it must have
+	const writers = 4
+	var mutex sync.Mutex
+	acknowledged := make(map[string]string)
+	sessions := make([]*client.Session, writers)
+	var stop atomic.Bool
+	var duringReshard atomic.Int64
+	var resharding atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		sessions[w] = kvs.NewSession()
+		wg.Add(1)
+		go func(w int, session *client.Session) {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				// Mostly new keys, and now and then an update of an earlier one
+				key := fmt.Sprintf("w%d-k%d", w, i)
+				if i%5 == 4 {
+					key = fmt.Sprintf("w%d-k%d", w, i/2)
+				}
+				value := fmt.Sprintf("w%d-v%d", w, i)
+				if _, err := session.Put(ctx, key, value); err != nil {
+					// Not acknowledged, so it may or may not have been applied
+					mutex.Lock()
+					delete(acknowledged, key)
+					mutex.Unlock()
+					t.Logf("write of %s not acknowledged: %v", key, err)
+					continue
+				}
+				mutex.Lock()
+				acknowledged[key] = value
+				mutex.Unlock()
+				if resharding.Load() {
+					duringReshard.Add(1)
+				}
+			}
+		}(w, sessions[w])
+	}
+
+	// Let some keys build up before they are moved
+	time.Sleep(time.Second)
+	resharding.Store(true)
+	status, reply := requestReshard(t, cluster.nodes[0], 3)
+	resharding.Store(false)
+	if status != http.StatusOK {
+		stop.Store(true)
+		wg.Wait()
+		t.Fatalf("reshard failed with %d: %v", status, reply)
+	}
+	// Keep writing to the new shard map for a while
+	time.Sleep(500 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+
+	shards, err := kvs.Shards(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 3 {
+		t.Fatalf("expected 3 shards after the reshard, got %v", shards)
+	}
+	if duringReshard.Load() == 0 {
+		t.Errorf("no write was acknowledged while the reshard ran")
+	}
+	t.Logf("%d keys written, %d writes acknowledged during the reshard", len(acknowledged), duringReshard.Load())
+	waitForReplication(t, cluster.nodes)
+
+	// The causal metadata of every writer, so that reads wait for replication to catch up
+	reader := kvs.NewSession()
+	for _, session := range sessions {
+		if err := reader.Merge(session.CausalMetadata()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	causal := reader.CausalMetadata()
+	for key, want := range acknowledged {
+		value, err := reader.Get(ctx, key)
+		if err != nil {
+			t.Errorf("acknowledged key %s: %v", key, err)
+			continue
+		}
+		if value.Data != want {
+			t.Errorf("acknowledged key %s is %v, want %s", key, value.Data, want)
+			continue
+		}
+		// The key must be on every replica of its new shard, not only the one that answered
+		for _, node := range shards[value.ShardID] {
+			status, reply := getFromNode(t, node, key, causal)
+			if status != http.StatusOK || reply["value"] != want {
+				t.Errorf("acknowledged key %s is missing from %s of %s: %d %v", key, node, value.ShardID, status, reply)
+			}
+		}
+	}
+}
+
+// A reshard plan changes nothing, and the reshard it describes moves the keys it reports
+func TestReshardPlanMatchesReshard(t *testing.T) {
+	cluster := startCluster(t, 6, 2)
+	node := cluster.nodes[0]
+	const keys = 40
+	for i := 0; i < keys; i++ {
+		if status, reply := kvsRequest(t, "PUT", node, fmt.Sprintf("key%d", i), KVS_PUT_Request{Data: "v"}); status != http.StatusCreated {
+			t.Fatalf("PUT returned %d: %v", status, reply)
+		}
+	}
+	waitForReplication(t, cluster.nodes)
+
+	if status, reply := nodeRequest(t, "GET", node, "shard/reshard-plan?shard-count=4", nil); status != http.StatusBadRequest {
+		t.Errorf("plan for more shards than the nodes can fill returned %d: %v", status, reply)
+	}
+	status, plan := nodeRequest(t, "GET", node, "shard/reshard-plan?shard-count=3", nil)
+	if status != http.StatusOK {
+		t.Fatalf("plan returned %d: %v", status, plan)
+	}
+	planned := plan["key-counts"].(map[string]interface{})
+	total, moving := 0.0, 0.0
+	for _, count := range planned {
+		total += count.(float64)
+	}
+	for _, migration := range plan["migrations"].([]interface{}) {
+		moving += migration.(map[string]interface{})["keys"].(float64)
+	}
+	if len(planned) != 3 || total != keys || moving != plan["keys-moving"] {
+		t.Fatalf("plan places %v of %d keys on %d shards and moves %v of %v", total, keys, len(planned), moving, plan["keys-moving"])
+	}
+	_, ids := nodeRequest(t, "GET", node, "shard/ids", nil)
+	if len(ids["shard-ids"].([]interface{})) != 2 {
+		t.Fatalf("planning changed the shards to %v", ids["shard-ids"])
+	}
+
+	if status, reply := requestReshard(t, node, 3); status != http.StatusOK {
+		t.Fatalf("reshard failed with %d: %v", status, reply)
+	}
+	for shardid, count := range planned {
+		_, reply := nodeRequest(t, "GET", node, "shard/key-count/"+shardid, nil)
+		if reply["shard-key-count"] != count {
+			t.Errorf("%s has %v keys, the plan said %v", shardid, reply["shard-key-count"], count)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// States of a reshard job
+const (
+	reshardStateRunning   = "running"
+	reshardStateCompleted = "completed"
+	reshardStateAborted   = "aborted"
+	reshardStateFailed    = "failed"
+)
+
+// Every reshard job this node took part in, by job id
+var RESHARD_JOBS = make(map[string]Reshard_Job)
+
+// ID of the job this node is currently coordinating, if any
+var coordinatingJob string
+
+// Protects RESHARD_JOBS and coordinatingJob
+var reshardJobsMutex sync.Mutex
+
+// Define a reshard job; a copy is sent to every node with each phase
+type Reshard_Job struct {
+	ID          string                       `json:"id"`
+	Coordinator string                       `json:"coordinator"`
+	ShardCount  int                          `json:"shard-count"`
+	Shards      map[string][]string          `json:"shards"`
+	Ranges      []Key_Range                  `json:"ranges,omitempty"`
+	Overrides   map[int]string               `json:"overrides,omitempty"`
+	Weights     map[string]float64           `json:"weights,omitempty"`
+	OldShards   map[string][]string          `json:"old-shards"`
+	Nodes       []string                     `json:"nodes"`
+	Phase       string                       `json:"phase"`
+	State       string                       `json:"state"`
+	Error       string                       `json:"error,omitempty"`
+	Progress    map[string]*Reshard_Progress `json:"progress"`
+	Started     time.Time                    `json:"started"`
+	Updated     time.Time                    `json:"updated"`
+	// Partitions moved by the job; only their keys are fenced, or every key if empty
+	Partitions []int `json:"partitions,omitempty"`
+}
+
+// Progress of the current phase for one shard of the new shard map
+type Reshard_Progress struct {
+	Members   []string `json:"members"`
+	Completed []string `json:"completed"`
+	KeysSent  int      `json:"keys-sent"`
+}
+
+// Create a job that moves the cluster from the current shard map to shards
+func newReshardJob(shardCount int, shards map[string][]string) Reshard_Job {
+	viewMutex.Lock()
+	nodes := append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	now := time.Now()
+	job := Reshard_Job{
+		ID:          fmt.Sprintf("reshard-%x", now.UnixNano()),
+		Coordinator: SOCKET_ADDRESS,
+		ShardCount:  shardCount,
+		Shards:      shards,
+		Overrides:   pruneOverrides(PARTITION_OVERRIDES, shards),
+		Weights:     pruneWeights(SHARD_WEIGHTS, shards),
+		OldShards:   SHARDS,
+		Nodes:       nodes,
+		State:       reshardStateRunning,
+		Started:     now,
+		Updated:     now,
+	}
+	job.resetProgress()
+	return job
+}
+
+// Returns the position of a phase in reshardSequence, or -1
+func reshardPhaseIndex(name string) int {
+	for i, phase := range reshardSequence {
+		if phase == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the nodes of the job that are still in the view
+func (job *Reshard_Job) liveNodes() []string {
+	viewMutex.Lock()
+	defer viewMutex.Unlock()
+	nodes := make([]string, 0, len(job.Nodes))
+	for _, address := range job.Nodes {
+		if contains(CURRENT_VIEW, address) {
+			nodes = append(nodes, address)
+		}
+	}
+	return nodes
+}
+
+// Forget which nodes completed the previous phase
+func (job *Reshard_Job) resetProgress() {
+	if job.Progress == nil {
+		job.Progress = make(map[string]*Reshard_Progress)
+	}
+	for shardid, members := range job.Shards {
+		if job.Progress[shardid] == nil {
+			job.Progress[shardid] = &Reshard_Progress{Members: members}
+		}
+	}
+	for _, progress := range job.Progress {
+		progress.Completed = []string{}
+		if job.Phase == "transfer" {
+			progress.KeysSent = 0
+		}
+	}
+}
+
+// Record which nodes completed the current phase and how many keys they sent
+func (job *Reshard_Job) recordProgress(results map[string]Reshard_Phase_Result) {
+	for address, result := range results {
+		if progress, ok := job.Progress[shardOfNode(job.Shards, address)]; ok {
+			progress.Completed = append(progress.Completed, address)
+		}
+		for shardid, count := range result.KeysSent {
+			if progress, ok := job.Progress[shardid]; ok {
+				progress.KeysSent += count
+			}
+		}
+	}
+}
+
+// Mark this node as the coordinator of a job
+// Returns false if it already coordinates one
+func startCoordinating(id string) bool {
+	reshardJobsMutex.Lock()
+	defer reshardJobsMutex.Unlock()
+	if coordinatingJob != "" {
+		return false
+	}
+	coordinatingJob = id
+	return true
+}
+
+func stopCoordinating() {
+	reshardJobsMutex.Lock()
+	defer reshardJobsMutex.Unlock()
+	coordinatingJob = ""
+}
+
+// Store a copy of the job and persist every job to CONFIG.DataDir
+func saveReshardJob(job Reshard_Job) {
+	jsonBytes, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	var stored Reshard_Job
+	json.Unmarshal(jsonBytes, &stored)
+
+	reshardJobsMutex.Lock()
+	defer reshardJobsMutex.Unlock()
+	RESHARD_JOBS[job.ID] = stored
+	if CONFIG.DataDir == "" {
+		return
+	}
+	jsonBytes, err = json.Marshal(RESHARD_JOBS)
+	if err != nil {
+		return
+	}
+	path := filepath.Join(CONFIG.DataDir, "reshard-jobs.json")
+	if err := os.WriteFile(path+".tmp", jsonBytes, 0644); err != nil {
+		fmt.Printf("Failed to persist reshard jobs: %v\n", err)
+		return
+	}
+	os.Rename(path+".tmp", path)
+}
+
+// Load the jobs persisted in CONFIG.DataDir if present
+func loadReshardJobs() {
+	if CONFIG.DataDir == "" {
+		return
+	}
+	jsonBytes, err := os.ReadFile(filepath.Join(CONFIG.DataDir, "reshard-jobs.json"))
+	if err != nil {
+		return
+	}
+	reshardJobsMutex.Lock()
+	defer reshardJobsMutex.Unlock()
+	if err := json.Unmarshal(jsonBytes, &RESHARD_JOBS); err != nil {
+		fmt.Printf("Failed to load reshard jobs: %v\n", err)
+	}
+}
+
+// Returns this node's copy of a job
+func localReshardJob(id string) (Reshard_Job, bool) {
+	reshardJobsMutex.Lock()
+	defer reshardJobsMutex.Unlock()
+	job, ok := RESHARD_JOBS[id]
+	return job, ok
+}
+
+// Fetch another node's copy of a job
+func fetchReshardJob(address string, id string) (Reshard_Job, error) {
+	var job Reshard_Job
+	client := peerClient(time.Duration(CONFIG.SendToAnyTimeout))
+	resp, err := client.Get(fmt.Sprintf("http://%s/shard/reshard/%s?local=true", address, id))
+	if err != nil {
+		return job, err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return job, fmt.Errorf("received status %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	return job, err
+}
+
+// Returns the most advanced copy of a job among the nodes of the view
+// A node may have missed the last phase message if the coordinator crashed while sending it
+func latestReshardJob(id string) (Reshard_Job, bool) {
+	latest, found := localReshardJob(id)
+	viewMutex.Lock()
+	nodes := append([]string{}, CURRENT_VIEW...)
+	viewMutex.Unlock()
+	for _, address := range nodes {
+		if address == SOCKET_ADDRESS {
+			continue
+		}
+		job, err := fetchReshardJob(address, id)
+		if err != nil {
+			continue
+		}
+		if !found || reshardJobAhead(job, latest) {
+			latest, found = job, true
+		}
+	}
+	return latest, found
+}
+
+// Returns true if a has progressed further than b
+func reshardJobAhead(a Reshard_Job, b Reshard_Job) bool {
+	// Finished jobs are never behind
+	if (a.State == reshardStateRunning) != (b.State == reshardStateRunning) {
+		return b.State == reshardStateRunning
+	}
+	if a.Phase == "abort" || b.Phase == "abort" {
+		return a.Phase == "abort" && b.Phase != "abort"
+	}
+	if reshardPhaseIndex(a.Phase) != reshardPhaseIndex(b.Phase) {
+		return reshardPhaseIndex(a.Phase) > reshardPhaseIndex(b.Phase)
+	}
+	return a.Updated.After(b.Updated)
+}
+
+// GET /shard/reshard/<job-id>
+// Returns the phase, state and per-shard progress of a reshard job
+func getReshardJob(c echo.Context) error {
+	id := c.Param("id")
+	job, ok := localReshardJob(id)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Reshard job not found"})
+	}
+	// The coordinator has the progress of the phase that is running
+	if c.QueryParam("local") == "" && job.State == reshardStateRunning && job.Coordinator != SOCKET_ADDRESS && contains(CURRENT_VIEW, job.Coordinator) {
+		if latest, err := fetchReshardJob(job.Coordinator, id); err == nil {
+			job = latest
+		}
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// Returns the job to resume or roll back, or an error response
+func takeOverReshardJob(c echo.Context) (Reshard_Job, error) {
+	job, ok := latestReshardJob(c.Param("id"))
+	if !ok {
+		return job, c.JSON(http.StatusNotFound, map[string]string{"error": "Reshard job not found"})
+	}
+	if job.State == reshardStateCompleted || job.State == reshardStateAborted {
+		return job, c.JSON(http.StatusConflict, map[string]string{"error": "Reshard job already " + job.State})
+	}
+	// A running job is only taken over once its coordinator left the view
+	if job.State == reshardStateRunning && job.Coordinator != SOCKET_ADDRESS && contains(CURRENT_VIEW, job.Coordinator) {
+		return job, c.JSON(http.StatusConflict, map[string]string{"error": "Reshard job is still coordinated by " + job.Coordinator})
+	}
+	return job, nil
+}
+
+// PUT /shard/reshard/<job-id>/resume
+// Continue an interrupted reshard job from the last phase it reached
+func resumeReshardJob(c echo.Context) error {
+	job, err := takeOverReshardJob(c)
+	if err != nil || c.Response().Committed {
+		return err
+	}
+	// The previous coordinator may have started an abort already
+	if job.Phase == "abort" {
+		return rollbackReshardJob(c)
+	}
+	from := reshardPhaseIndex(job.Phase)
+	if from < 0 {
+		from = 0
+	}
+	if err := runReshard(&job, from); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Reshard " + job.State + ": " + err.Error(), "job-id": job.ID})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"result": "resharded", "job-id": job.ID})
+}
+
+// PUT /shard/reshard/<job-id>/rollback
+// Abort an interrupted reshard job that has not committed yet
+func rollbackReshardJob(c echo.Context) error {
+	job, err := takeOverReshardJob(c)
+	if err != nil || c.Response().Committed {
+		return err
+	}
+	// Some nodes may already have dropped the keys that moved away
+	if reshardPhaseIndex(job.Phase) >= reshardPhaseIndex("commit") {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Reshard job already committed; resume it instead", "job-id": job.ID})
+	}
+	if !startCoordinating(job.ID) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "This node is already coordinating a reshard"})
+	}
+	defer stopCoordinating()
+	job.Coordinator = SOCKET_ADDRESS
+	if err := rollbackReshard(&job); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Rollback failed: " + err.Error(), "job-id": job.ID})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"result": "rolled back", "job-id": job.ID})
+}
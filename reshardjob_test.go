@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReshardJobAhead(t *testing.T) {
+	now := time.Now()
+	job := func(state string, phase string, updated time.Time) Reshard_Job {
+		return Reshard_Job{State: state, Phase: phase, Updated: updated}
+	}
+	tests := []struct {
+		name string
+		a, b Reshard_Job
+		want bool
+	}{
+		{"later phase", job(reshardStateRunning, "transfer", now), job(reshardStateRunning, "drain", now), true},
+		{"earlier phase", job(reshardStateRunning, "drain", now), job(reshardStateRunning, "commit", now), false},
+		{"finished over running", job(reshardStateCompleted, "release", now), job(reshardStateRunning, "release", now), true},
+		{"running behind finished", job(reshardStateRunning, "release", now.Add(time.Second)), job(reshardStateFailed, "commit", now), false},
+		{"abort over any phase", job(reshardStateRunning, "abort", now), job(reshardStateRunning, "transfer", now), true},
+		{"any phase behind abort", job(reshardStateRunning, "transfer", now), job(reshardStateRunning, "abort", now), false},
+		{"same phase, updated later", job(reshardStateRunning, "transfer", now.Add(time.Second)), job(reshardStateRunning, "transfer", now), true},
+	}
+	for _, test := range tests {
+		if got := reshardJobAhead(test.a, test.b); got != test.want {
+			t.Errorf("%s: reshardJobAhead = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// Jobs are reloaded from data-dir, so that an interrupted one can be resumed after a restart
+func TestReshardJobsSurviveRestart(t *testing.T) {
+	CONFIG = defaultConfig()
+	CONFIG.DataDir = t.TempDir()
+	reshardJobsMutex.Lock()
+	RESHARD_JOBS = make(map[string]Reshard_Job)
+	reshardJobsMutex.Unlock()
+	job := Reshard_Job{ID: "reshard-1", ShardCount: 3, Phase: "transfer", State: reshardStateRunning,
+		Progress: map[string]*Reshard_Progress{"shard0": {Members: []string{"a"}, KeysSent: 7}}}
+	saveReshardJob(job)
+
+	reshardJobsMutex.Lock()
+	RESHARD_JOBS = make(map[string]Reshard_Job)
+	reshardJobsMutex.Unlock()
+	loadReshardJobs()
+	loaded, ok := localReshardJob("reshard-1")
+	if !ok || loaded.Phase != "transfer" || loaded.State != reshardStateRunning || loaded.Progress["shard0"].KeysSent != 7 {
+		t.Errorf("reloaded job is %+v", loaded)
+	}
+}
+
+// Every node records a finished reshard, which can then be neither resumed nor rolled back
+func TestReshardJobIsRecorded(t *testing.T) {
+	cluster := startCluster(t, 6, 2)
+	status, reply := requestReshard(t, cluster.nodes[0], 3)
+	if status != http.StatusOK || reply["job-id"] == "" {
+		t.Fatalf("reshard returned %d: %v", status, reply)
+	}
+	id := reply["job-id"]
+	for _, address := range cluster.nodes {
+		status, job := nodeRequest(t, "GET", address, "shard/reshard/"+id, nil)
+		if status != http.StatusOK || job["state"] != reshardStateCompleted || job["phase"] != "release" {
+			t.Errorf("job on %s is %d: %v %v", address, status, job["state"], job["phase"])
+		}
+	}
+	for _, action := range []string{"resume", "rollback"} {
+		if status, reply := nodeRequest(t, "PUT", cluster.nodes[1], "shard/reshard/"+id+"/"+action, nil); status != http.StatusConflict {
+			t.Errorf("%s of the finished job returned %d: %v", action, status, reply)
+		}
+	}
+	if status, _ := nodeRequest(t, "GET", cluster.nodes[1], "shard/reshard/reshard-0", nil); status != http.StatusNotFound {
+		t.Errorf("unknown job returned %d", status)
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/buraksezer/consistent"
 	"github.com/cespare/xxhash"
@@ -20,6 +23,20 @@ var HASH_RING *consistent.Consistent
 // Define a lock to protext concurrent access to KVStore
 var KVSmutex = &sync.Mutex{}
 
+// Define the parameters used to build the hash ring
+var RING_CONFIG = Ring_Config{
+	PartitionCount:    11,
+	ReplicationFactor: 5,
+	Load:              1.10,
+}
+
+// Ring_Config holds the parameters of the consistent hash ring
+type Ring_Config struct {
+	PartitionCount    int     `json:"partition-count"`
+	ReplicationFactor int     `json:"replication-factor"`
+	Load              float64 `json:"load"`
+}
+
 type myMember string
 
 func (m myMember) String() string {
@@ -37,22 +54,35 @@ func (h hasher) Sum64(data []byte) uint64 {
 	return xxhash.Sum64(data)
 }
 
-// Creates a new hash ring
-func createHashRing() *consistent.Consistent {
+// Creates a new hash ring for the given shard map
+func createHashRing(shards map[string][]string) *consistent.Consistent {
 	// Create a new consistent instance
 	cfg := consistent.Config{
-		PartitionCount:    11,
-		ReplicationFactor: 5,
-		Load:              1.10,
+		PartitionCount:    RING_CONFIG.PartitionCount,
+		ReplicationFactor: RING_CONFIG.ReplicationFactor,
+		Load:              RING_CONFIG.Load,
 		Hasher:            hasher{},
 	}
 	hashRing := consistent.New(nil, cfg)
-	for key := range SHARDS {
+	for key := range shards {
 		hashRing.Add(myMember(key))
 	}
 	return hashRing
 }
 
+// Returns an error unless a hash ring built with ring can place its partitions on shardCount shards
+// Mirrors the load limit of consistent, which panics with "not enough room to distribute partitions"
+func checkRingCapacity(ring Ring_Config, shardCount int) error {
+	if shardCount < 1 {
+		return nil
+	}
+	perShard := math.Ceil(float64(ring.PartitionCount/shardCount) * ring.Load)
+	if perShard*float64(shardCount) < float64(ring.PartitionCount) {
+		return fmt.Errorf("%d partitions with load %.2f cannot be distributed over %d shards", ring.PartitionCount, ring.Load, shardCount)
+	}
+	return nil
+}
+
 // Define a structure to parse the request body.
 type addNodeRequest struct {
 	SocketAddress string `json:"socket-address"`
@@ -71,9 +101,34 @@ func getAllShardIds(c echo.Context) error {
 	for shardID := range SHARDS {
 		shardIDs = append(shardIDs, shardID)
 	}
+	// Range partitioning also reports which keys each shard owns
+	if CONFIG.Partitioner == partitionerRange {
+		return c.JSON(http.StatusOK, map[string]interface{}{"shard-ids": shardIDs, "ranges": RANGES})
+	}
 	return c.JSON(http.StatusOK, map[string][]string{"shard-ids": shardIDs})
 }
 
+// Define JSON body of /shard/routing responses
+type Routing_State struct {
+	Partitioner string              `json:"partitioner"`
+	Shards      map[string][]string `json:"shards"`
+	Ring        Ring_Config         `json:"ring"`
+	Overrides   map[int]string      `json:"overrides,omitempty"`
+	Ranges      []Key_Range         `json:"ranges,omitempty"`
+}
+
+// GET /shard/routing
+// Returns what a client needs to find the shard of a key by itself, see locateShardIn
+func getRouting(c echo.Context) error {
+	return c.JSON(http.StatusOK, Routing_State{
+		Partitioner: CONFIG.Partitioner,
+		Shards:      SHARDS,
+		Ring:        RING_CONFIG,
+		Overrides:   PARTITION_OVERRIDES,
+		Ranges:      RANGES,
+	})
+}
+
 // GET /shard/node-shard-id
 // Returns the shard identifier of this node
 func getMyShardId(c echo.Context) error {
@@ -117,6 +172,38 @@ func getShardKeyCount(c echo.Context) error {
 	return forwardRequest(c, chosenNode, "shard/key-count/"+shardID, nil)
 }
 
+// GET /shard/key-sizes/<ID>
+// Returns the size in bytes of every key-value pair stored by the indicated shard
+func getShardKeySizes(c echo.Context) error {
+	shardID := c.Param("id")
+	// Check if the shard exists
+	if _, exists := SHARDS[shardID]; !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Shard ID not found"})
+	}
+	// Forward the request to a node in the shard
+	if shardID != MY_SHARD_ID {
+		return forwardRequest(c, choseNodeFromShard(shardID), "shard/key-sizes/"+shardID, nil)
+	}
+	return c.JSON(http.StatusOK, map[string]map[string]int{"key-sizes": localKeySizes()})
+}
+
+// Returns the size in bytes of every key-value pair in KVStore
+func localKeySizes() map[string]int {
+	KVSmutex.Lock()
+	defer KVSmutex.Unlock()
+	sizes := make(map[string]int, len(KVStore))
+	now := time.Now()
+	for key, value := range KVStore {
+		// Listings leave out keys that are waiting to be swept
+		if value.expired(now) {
+			continue
+		}
+		jsonBytes, _ := json.Marshal(value)
+		sizes[key] = len(key) + len(jsonBytes)
+	}
+	return sizes
+}
+
 // PUT /shard/add-member/<ID>
 // JSON body {"socket-address": <IP:PORT>}
 // Assign the node <IP:PORT> to the shard <ID>
@@ -135,6 +222,9 @@ func addNodeToShard(c echo.Context) error {
 	if jsonErr != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
 	}
+	if input.FromRepilca == "" && isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; shard changes are disabled"})
+	}
 	if input.SocketAddress != SOCKET_ADDRESS {
 		// Check if the shard exists
 		if _, exists := SHARDS[shardID]; !exists {
@@ -147,6 +237,10 @@ func addNodeToShard(c echo.Context) error {
 			println("Node not in current view")
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Node not in current view"})
 		}
+		// A node belongs to a single shard, moving it is a separate operation
+		if current := shardOfNode(SHARDS, input.SocketAddress); current != "" && current != shardID {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Node is already a member of " + current + "; use /shard/move-member/" + shardID})
+		}
 	} else {
 		// If I am the node that is being added, sync myself with the shard I am assigned to
 		// Get the list of members in the shard that I am assigned to
@@ -169,18 +263,36 @@ func addNodeToShard(c echo.Context) error {
 		// Add list of members to the shard
 		SHARDS[shardID] = members["shard-members"]
 		// Sync with members in the shard
-		syncWithShard(shardID)
+		if err := syncWithShard(shardID); err != nil {
+			// The shard has no data yet if none of its members answered
+			initializeEmptyNode()
+		}
 		// Update MY_SHARD_ID
 		MY_SHARD_ID = shardID
 		// Update my Hash Ring
-		HASH_RING = createHashRing()
+		rebuildRouting()
 
 	}
 	// Add the node to the shard
-	SHARDS[shardID] = append(SHARDS[shardID], input.SocketAddress)
+	if !contains(SHARDS[shardID], input.SocketAddress) {
+		SHARDS[shardID] = append(SHARDS[shardID], input.SocketAddress)
+	}
 
 	// If the request is not from anotehr replica, then broadcast the new addition to all other nodes
 	if input.FromRepilca == "" {
+		// Record the new member in the metadata service
+		if metadataEnabled() {
+			_, err := updateClusterConfig(func(cfg *Cluster_Config) bool {
+				if contains(cfg.Shards[shardID], input.SocketAddress) {
+					return false
+				}
+				cfg.Shards[shardID] = append(cfg.Shards[shardID], input.SocketAddress)
+				return true
+			})
+			if err != nil {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Failed to commit new shard member"})
+			}
+		}
 		// Create JSON payload to be sent to other nodes
 		payload := map[string]string{"socket-address": input.SocketAddress, "from-replica": SOCKET_ADDRESS}
 		jsonBytes, err := json.Marshal(payload)
@@ -188,119 +300,154 @@ func addNodeToShard(c echo.Context) error {
 			return c.JSON(http.StatusInternalServerError, "Failed to convert JSON payload to string")
 		}
 		// Broadcast the new addition to all other nodes
-		broadcast("PUT", "shard/add-member/"+shardID, jsonBytes, CURRENT_VIEW)
+		broadcast(c.Request().Context(), "PUT", "shard/add-member/"+shardID, jsonBytes, CURRENT_VIEW)
 	}
 
 	// Return a success response.
 	return c.JSON(http.StatusOK, map[string]string{"result": "Node added to shard"})
 }
 
-// Define private endpoint for updating kvs for resharding
-// PUT /shard/kvs-update/<key>
-func updateKvsForResharding(c echo.Context) error {
-	// Store key value
-	key := c.Param("key")
-	// Read JSON from request body
+// PUT /shard/move-member/<ID>
+// JSON body {"socket-address": <IP:PORT>}
+// Move the node <IP:PORT> from its current shard to the shard <ID>
+func moveNodeToShard(c echo.Context) error {
+	shardID := c.Param("id")
 	body, err := io.ReadAll(c.Request().Body)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
 	}
-	// Unmarshal JSON
-	var input KVS_PUT_Request
-	jsonErr := json.Unmarshal(body, &input)
-	if jsonErr != nil {
+	var input addNodeRequest
+	if err := json.Unmarshal(body, &input); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
 	}
-	// Lock before accessing the KVStore
-	KVSmutex.Lock()
-	// Update or create key-value mapping
-	KVStore[key] = Value{input.Data, input.Type}
-	// Unlock after accessing the KVStore
-	KVSmutex.Unlock()
-	// Return success
-	return c.JSON(http.StatusOK, map[string]string{"result": "updated"})
-}
-
-// Define JSON body for kvs GET and DELETE requests
-type Reshard_Request struct {
-	ShardCount  int    `json:"shard-count"`
-	FromRepilca string `json:"from-replica,omitempty"`
-}
+	source := shardOfNode(SHARDS, input.SocketAddress)
 
-// PUT /shard/reshard
-// JSON body {"shard-count": <INTEGER>}
-// Trigger a reshard into <INTEGER> shards
-func reshard(c echo.Context) error {
-	body, err := io.ReadAll(c.Request().Body)
+	// Another node already checked and recorded the move
+	if input.FromRepilca != "" {
+		moveNodeLocally(input.SocketAddress, shardID)
+		if input.SocketAddress == SOCKET_ADDRESS {
+			if err := joinShardAfterMove(shardID); err != nil {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			}
+		}
+		return c.JSON(http.StatusOK, map[string]string{"result": "moved", "from": source, "to": shardID})
+	}
 
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	if isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; shard changes are disabled"})
+	}
+	if reshardInProgress() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A reshard is already in progress"})
+	}
+	if _, exists := SHARDS[shardID]; !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Shard ID not found"})
+	}
+	if !contains(CURRENT_VIEW, input.SocketAddress) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Node not in current view"})
+	}
+	if source == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Node is not a member of any shard; use /shard/add-member/" + shardID})
+	}
+	if source == shardID {
+		return c.JSON(http.StatusOK, map[string]string{"result": "already a member", "from": source, "to": shardID})
+	}
+	// The source shard must keep enough members to provide fault tolerance
+	if len(SHARDS[source])-1 < CONFIG.MinNodesPerShard {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Not enough nodes would be left in " + source})
+	}
+	// Record the move in the metadata service
+	if metadataEnabled() {
+		_, err := updateClusterConfig(func(cfg *Cluster_Config) bool {
+			from := shardOfNode(cfg.Shards, input.SocketAddress)
+			if from == shardID {
+				return false
+			}
+			if from != "" {
+				cfg.Shards[from] = removeFromList(cfg.Shards[from], input.SocketAddress)
+			}
+			cfg.Shards[shardID] = append(cfg.Shards[shardID], input.SocketAddress)
+			return true
+		})
+		if err != nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Failed to commit shard move"})
+		}
 	}
 
-	var input Reshard_Request
-	jsonErr := json.Unmarshal(body, &input)
-	if jsonErr != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	moveNodeLocally(input.SocketAddress, shardID)
+	input.FromRepilca = SOCKET_ADDRESS
+	jsonBytes, _ := json.Marshal(input)
+	// Members of the destination must know about the node before it syncs with them
+	others := make([]string, 0, len(CURRENT_VIEW))
+	for _, address := range CURRENT_VIEW {
+		if address != input.SocketAddress {
+			others = append(others, address)
+		}
+	}
+	missed := sendAndAckAll("PUT", "shard/move-member/"+shardID, jsonBytes, others)
+	if input.SocketAddress == SOCKET_ADDRESS {
+		if err := joinShardAfterMove(shardID); err != nil {
+			missed = append(missed, SOCKET_ADDRESS)
+		}
+	} else {
+		missed = append(missed, sendAndAckAll("PUT", "shard/move-member/"+shardID, jsonBytes, []string{input.SocketAddress})...)
 	}
+	if len(missed) > 0 {
+		return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{"error": "The move was not applied on every node", "from": source, "to": shardID, "missed": missed})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"result": "moved", "from": source, "to": shardID})
+}
 
-	numNodes := len(CURRENT_VIEW)
-	currNumShards := len(HASH_RING.GetMembers())
-	targetNumShards := input.ShardCount
-	// Check if the number of shards is valid
-	if targetNumShards < 1 || (targetNumShards > currNumShards && numNodes/targetNumShards < 2) {
-		// Check if there are enough nodes to provide fault tolerance with the requested shard count
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Not enough nodes to provide fault tolerance with requested shard count"})
+// Take address out of its shard and add it to shardID
+func moveNodeLocally(address string, shardID string) {
+	if from := shardOfNode(SHARDS, address); from != "" && from != shardID {
+		SHARDS[from] = removeFromList(SHARDS[from], address)
+	}
+	if !contains(SHARDS[shardID], address) {
+		SHARDS[shardID] = append(SHARDS[shardID], address)
 	}
-	// Distribute nodes into shards
-	distributeNodesIntoShards(targetNumShards, CURRENT_VIEW)
-	// Update my shard id in MY_SHARD_ID
 	updateMyShardID()
-	// Update Hash Ring
-	HASH_RING = createHashRing()
-	// Go through each key and see if it needs to be moved to a different shard
-	// Lock before accessing the KVStore
-	//KVSmutex.Lock()
-
-	//time.Sleep(time.Second)
-	kvsCopy := make(map[string]Value)
-	viewMutex.Lock() // Lock before reading CURRENT_VIEW
-	for key, value := range KVStore {
-		kvsCopy[key] = value
-	}
-	viewMutex.Unlock()
-	// Create a slice list to store the keys that need to be deleted
-	keysToDelete := make([]string, 0)
-
-	for key, value := range kvsCopy {
-		// Check if the key belongs to the shard
-		keyByte := []byte(key)
-		shardid := HASH_RING.LocateKey(keyByte).String()
-		// Forward a private PUT KVS request to the appropriate shard
-		payload := map[string]interface{}{"value": value.Data, "causal-metadata": nil, "from-replica": SOCKET_ADDRESS}
-		jsonBytes, _ := json.Marshal(payload)
-		// Forward the request to the appropriate shard
-		broadcast("PUT", "shard/kvs-update/"+key, jsonBytes, SHARDS[shardid])
-		// Delete the shard from my KVStore
-		if shardid != MY_SHARD_ID {
-			keysToDelete = append(keysToDelete, key)
+}
+
+// Called on the moved node: replace the data of the old shard with the data of the new one
+// The data of the old shard is kept if no member of the new one answers
+func joinShardAfterMove(shardID string) error {
+	// Writes I sent from my old shard are counted at my position by every node,
+	// so my next write must continue from the highest tick I reached
+	var myTicks uint64
+	vectorClockMutex.Lock()
+	if MY_VECTOR_CLOCK != nil {
+		myTicks, _ = MY_VECTOR_CLOCK.FindTicks(SOCKET_ADDRESS)
+	}
+	vectorClockMutex.Unlock()
+	shards := SHARDS
+	err := syncWithShard(shardID)
+	// Keep the shard map that already has the move applied
+	SHARDS = shards
+	if err != nil {
+		return fmt.Errorf("failed to sync with %s: %v", shardID, err)
+	}
+	vectorClockMutex.Lock()
+	if syncedTicks, _ := MY_VECTOR_CLOCK.FindTicks(SOCKET_ADDRESS); syncedTicks < myTicks {
+		MY_VECTOR_CLOCK.Set(SOCKET_ADDRESS, myTicks)
+	}
+	for _, address := range CURRENT_VIEW {
+		if _, ok := MY_VECTOR_CLOCK.FindTicks(address); !ok {
+			MY_VECTOR_CLOCK.Set(address, 0)
 		}
 	}
-	// Unlock after accessing the KVStore
-	//KVSmutex.Unlock()
-	// If request is not from another node, broadcast reshard to all nodes
-	if input.FromRepilca == "" {
-		input.FromRepilca = SOCKET_ADDRESS
-		jsonBytes, _ := json.Marshal(input)
-		broadcastTest("PUT", "shard/reshard", jsonBytes, CURRENT_VIEW)
-	}
-	// Delete the keys that are not in my shard
-	for _, key := range keysToDelete {
-		// Lock before accessing the KVStore
-		KVSmutex.Lock()
-		delete(KVStore, key)
-		// Unlock after accessing the KVStore
-		KVSmutex.Unlock()
-	}
-	// Return success
-	return c.JSON(http.StatusOK, map[string]string{"result": "resharded"})
+	vectorClockMutex.Unlock()
+	MY_SHARD_ID = shardID
+	fmt.Printf("Moved to %s\n", shardID)
+	return nil
+}
+
+// Returns list without address
+func removeFromList(list []string, address string) []string {
+	removed := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != address {
+			removed = append(removed, item)
+		}
+	}
+	return removed
 }
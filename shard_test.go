@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/DistributedClocks/GoVector/govec/vclock"
+)
+
+// Send a JSON request to node and decode its reply
+func nodeRequest(t *testing.T, method string, node string, endpoint string, body interface{}) (int, map[string]interface{}) {
+	var reader *bytes.Reader
+	if body != nil {
+		jsonBytes, _ := json.Marshal(body)
+		reader = bytes.NewReader(jsonBytes)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, _ := http.NewRequest(method, "http://"+node+"/"+endpoint, reader)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s /%s on %s failed: %v", method, endpoint, node, err)
+	}
+	defer resp.Body.Close()
+	var reply map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return resp.StatusCode, reply
+}
+
+// A moved node takes the data of its new shard, and every node knows about the move
+func TestMoveNodeToShard(t *testing.T) {
+	cluster := startCluster(t, 5, 2)
+	node := cluster.nodes[0]
+	for i := 0; i < 20; i++ {
+		if status, reply := kvsRequest(t, "PUT", node, fmt.Sprintf("key%d", i), KVS_PUT_Request{Data: "v"}); status != http.StatusCreated {
+			t.Fatalf("PUT returned %d: %v", status, reply)
+		}
+	}
+	waitForReplication(t, cluster.nodes)
+
+	// Move a member of the larger shard to the smaller one
+	members := make(map[string][]interface{})
+	for _, shardid := range []string{"shard0", "shard1"} {
+		_, reply := nodeRequest(t, "GET", node, "shard/members/"+shardid, nil)
+		members[shardid], _ = reply["shard-members"].([]interface{})
+	}
+	from, to := "shard0", "shard1"
+	if len(members[from]) < len(members[to]) {
+		from, to = to, from
+	}
+	moved := members[from][0].(string)
+	status, reply := nodeRequest(t, "PUT", node, "shard/move-member/"+to, map[string]string{"socket-address": moved})
+	if status != http.StatusOK || reply["result"] != "moved" {
+		t.Fatalf("move returned %d: %v", status, reply)
+	}
+
+	for _, address := range cluster.nodes {
+		_, reply := nodeRequest(t, "GET", address, "shard/members/"+to, nil)
+		if !containsValue(reply["shard-members"], moved) {
+			t.Errorf("%s does not list %s as a member of %s: %v", address, moved, to, reply)
+		}
+	}
+	_, reply = nodeRequest(t, "GET", moved, "shard/node-shard-id", nil)
+	if reply["node-shard-id"] != to {
+		t.Errorf("moved node reports shard %v, want %s", reply["node-shard-id"], to)
+	}
+	// The moved node holds the keys of its new shard, as the other members do
+	_, want := nodeRequest(t, "GET", members[to][0].(string), "shard/key-count/"+to, nil)
+	_, got := nodeRequest(t, "GET", moved, "shard/key-count/"+to, nil)
+	if got["shard-key-count"] != want["shard-key-count"] {
+		t.Errorf("moved node has %v keys, other members of %s have %v", got["shard-key-count"], to, want["shard-key-count"])
+	}
+}
+
+// Returns true if list is a JSON array holding value
+func containsValue(list interface{}, value string) bool {
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// A moved node that cannot reach its new shard keeps its data and vector clock
+func TestJoinShardAfterMoveKeepsStateWhenSyncFails(t *testing.T) {
+	CONFIG = defaultConfig()
+	useTransport(t, transportHTTP)
+	SOCKET_ADDRESS = "127.0.0.1:2"
+	// Nothing listens on port 1
+	SHARDS = map[string][]string{"shard1": {SOCKET_ADDRESS}, "shard2": {"127.0.0.1:1"}}
+	KVSmutex.Lock()
+	KVStore = map[string]Value{"a": {Data: "1", Type: "string"}}
+	KVSmutex.Unlock()
+	vectorClockMutex.Lock()
+	MY_VECTOR_CLOCK = vclock.New()
+	MY_VECTOR_CLOCK.Set(SOCKET_ADDRESS, 3)
+	vectorClockMutex.Unlock()
+
+	if err := joinShardAfterMove("shard2"); err == nil {
+		t.Fatal("joining a shard no member of which answers succeeded")
+	}
+	if _, ok := KVStore["a"]; !ok {
+		t.Error("data of the old shard was dropped")
+	}
+	vectorClockMutex.Lock()
+	defer vectorClockMutex.Unlock()
+	if ticks, _ := MY_VECTOR_CLOCK.FindTicks(SOCKET_ADDRESS); ticks != 3 {
+		t.Errorf("own position is %d after the failed sync, want 3", ticks)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/buraksezer/consistent"
+	"github.com/labstack/echo/v4"
+)
+
+// Define JSON body for /shard/split requests
+type Split_Shard_Request struct {
+	NewMembers []string `json:"new-members"`
+}
+
+// Define JSON body for /shard/merge requests
+type Merge_Shards_Request struct {
+	ShardID string `json:"shard-id"`
+}
+
+// Returns the id for a shard split off parent: <parent>.1, <parent>.2, ...
+// Dotted ids never clash with the shard<N> ids of a full reshard
+func childShardID(parent string, shards map[string][]string) string {
+	for i := 1; ; i++ {
+		shardid := fmt.Sprintf("%s.%d", parent, i)
+		if _, exists := shards[shardid]; !exists {
+			return shardid
+		}
+	}
+}
+
+// Returns the overrides that make ring assign every partition to owners[partID]
+func pinnedOverrides(ring *consistent.Consistent, owners map[int]string) map[int]string {
+	overrides := make(map[int]string)
+	for partID, shardid := range owners {
+		if ring.GetPartitionOwner(partID).String() != shardid {
+			overrides[partID] = shardid
+		}
+	}
+	return overrides
+}
+
+// Returns the owner of every partition under the current hash ring and overrides
+func currentPartitionOwners() map[int]string {
+	owners := make(map[int]string)
+	for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+		owners[partID] = partitionOwner(partID)
+	}
+	return owners
+}
+
+// Split the members of parent and the new nodes into two shards
+// The new shard takes the new nodes first, then members of parent until both halves are even
+func splitMembers(members []string, newMembers []string) ([]string, []string) {
+	total := len(members) + len(newMembers)
+	child := append([]string{}, newMembers...)
+	kept := append([]string{}, members...)
+	for len(child) < total/2 && len(kept) > 0 {
+		child = append(child, kept[len(kept)-1])
+		kept = kept[:len(kept)-1]
+	}
+	return kept, child
+}
+
+// Returns the job that splits parent into parent and child
+// Only keys of parent move; every other partition or range keeps its shard
+func planSplit(parent string, child string, newMembers []string, sizes map[string]int) (Reshard_Job, error) {
+	if err := checkRingCapacity(RING_CONFIG, len(SHARDS)+1); err != nil {
+		return Reshard_Job{}, err
+	}
+	shards := make(map[string][]string)
+	for shardid, members := range SHARDS {
+		shards[shardid] = members
+	}
+	shards[parent], shards[child] = splitMembers(SHARDS[parent], newMembers)
+	job := newReshardJob(len(shards), shards)
+
+	if CONFIG.Partitioner == partitionerRange {
+		// Give the child the upper half of the fullest range of parent
+		ranges := append([]Key_Range{}, RANGES...)
+		keys := keysPerRange(ranges, map[string]map[string]int{parent: sizes})
+		fullest := -1
+		for i := range ranges {
+			if ranges[i].Shard == parent && (fullest < 0 || len(keys[i]) > len(keys[fullest])) {
+				fullest = i
+			}
+		}
+		if fullest >= 0 {
+			if at := splitPoint(ranges, fullest, keys[fullest]); at != "" {
+				ranges = splitRange(ranges, fullest, at, child)
+			}
+		}
+		job.Ranges = ranges
+		return job, nil
+	}
+
+	// Hand the partitions of parent over one by one, fullest first, to the side holding fewer keys
+	owners := currentPartitionOwners()
+	partKeys := make(map[int]int)
+	for key := range sizes {
+		partKeys[partitionOf(key)]++
+	}
+	var parts []int
+	for partID, shardid := range owners {
+		if shardid == parent {
+			parts = append(parts, partID)
+		}
+	}
+	sort.Ints(parts)
+	sort.SliceStable(parts, func(i, j int) bool { return partKeys[parts[i]] > partKeys[parts[j]] })
+	keysOf := map[string]int{}
+	partsOf := map[string]int{}
+	for _, partID := range parts {
+		side := parent
+		if keysOf[child] < keysOf[parent] || (keysOf[child] == keysOf[parent] && partsOf[child] < partsOf[parent]) {
+			side = child
+		}
+		owners[partID] = side
+		keysOf[side] += partKeys[partID]
+		partsOf[side]++
+	}
+	// The new ring would move partitions of every shard, so pin them where they are
+	job.Overrides = pinnedOverrides(createHashRing(shards), owners)
+	return job, nil
+}
+
+// Returns the job that merges the shard other into into
+// Only keys of other move; every other partition or range keeps its shard
+func planMerge(into string, other string) Reshard_Job {
+	shards := make(map[string][]string)
+	for shardid, members := range SHARDS {
+		if shardid != other {
+			shards[shardid] = members
+		}
+	}
+	shards[into] = append(append([]string{}, SHARDS[into]...), SHARDS[other]...)
+	job := newReshardJob(len(shards), shards)
+
+	if CONFIG.Partitioner == partitionerRange {
+		ranges := append([]Key_Range{}, RANGES...)
+		for i := range ranges {
+			if ranges[i].Shard == other {
+				ranges[i].Shard = into
+			}
+		}
+		job.Ranges = coalesceRanges(ranges)
+		return job
+	}
+
+	owners := currentPartitionOwners()
+	for partID, shardid := range owners {
+		if shardid == other {
+			owners[partID] = into
+		}
+	}
+	job.Overrides = pinnedOverrides(createHashRing(shards), owners)
+	return job
+}
+
+// Returns an error response if the shard map cannot be changed right now
+func checkShardChangeAllowed(c echo.Context) error {
+	if isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; shard changes are disabled"})
+	}
+	if reshardInProgress() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A reshard is already in progress"})
+	}
+	return nil
+}
+
+// PUT /shard/split/<ID>
+// JSON body {"new-members": [<IP:PORT>, ...]}
+// Split the shard <ID> in two using its members and the given nodes that are in no shard yet
+func splitShard(c echo.Context) error {
+	parent := c.Param("id")
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+	var input Split_Shard_Request
+	if err := json.Unmarshal(body, &input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	if err := checkShardChangeAllowed(c); err != nil || c.Response().Committed {
+		return err
+	}
+	if _, exists := SHARDS[parent]; !exists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Shard ID not found"})
+	}
+	for _, address := range input.NewMembers {
+		if !contains(CURRENT_VIEW, address) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Node " + address + " not in current view"})
+		}
+		if current := shardOfNode(SHARDS, address); current != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Node " + address + " is already a member of " + current})
+		}
+	}
+	// Both halves must provide fault tolerance on their own
+	if len(SHARDS[parent])+len(input.NewMembers) < 2*CONFIG.MinNodesPerShard {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Not enough nodes to provide fault tolerance in both shards"})
+	}
+
+	sizes, err := fetchShardKeySizes(parent)
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	}
+	child := childShardID(parent, SHARDS)
+	job, err := planSplit(parent, child, input.NewMembers, sizes)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := runReshard(&job, 0); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Split " + job.State + ": " + err.Error(), "job-id": job.ID})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"result": "split", "job-id": job.ID, "shard-id": child, "shards": job.Shards})
+}
+
+// PUT /shard/merge/<ID>
+// JSON body {"shard-id": <ID2>}
+// Merge the shard <ID2> and its members into the shard <ID>
+func mergeShards(c echo.Context) error {
+	into := c.Param("id")
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+	var input Merge_Shards_Request
+	if err := json.Unmarshal(body, &input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	if err := checkShardChangeAllowed(c); err != nil || c.Response().Committed {
+		return err
+	}
+	_, intoExists := SHARDS[into]
+	_, otherExists := SHARDS[input.ShardID]
+	if !intoExists || !otherExists {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Shard ID not found"})
+	}
+	if into == input.ShardID {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cannot merge a shard into itself"})
+	}
+
+	job := planMerge(into, input.ShardID)
+	if err := runReshard(&job, 0); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Merge " + job.State + ": " + err.Error(), "job-id": job.ID})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"result": "merged", "job-id": job.ID, "shards": job.Shards})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Use a hash ring over shards with no overrides or weights
+func useShards(shards map[string][]string) {
+	CONFIG = defaultConfig()
+	SHARDS = shards
+	RING_CONFIG = Ring_Config{PartitionCount: CONFIG.PartitionCount, ReplicationFactor: CONFIG.ReplicationFactor, Load: CONFIG.Load}
+	PARTITION_OVERRIDES = make(map[int]string)
+	SHARD_WEIGHTS = make(map[string]float64)
+	HASH_RING = createHashRing(SHARDS)
+}
+
+// Returns the owner of every partition once job is applied
+func jobPartitionOwners(job Reshard_Job) map[int]string {
+	ring := createHashRing(job.Shards)
+	owners := make(map[int]string)
+	for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+		if shardid, ok := job.Overrides[partID]; ok {
+			owners[partID] = shardid
+		} else {
+			owners[partID] = ring.GetPartitionOwner(partID).String()
+		}
+	}
+	return owners
+}
+
+func TestChildShardID(t *testing.T) {
+	shards := map[string][]string{"shard0": nil, "shard0.1": nil, "shard1": nil}
+	if shardid := childShardID("shard0", shards); shardid != "shard0.2" {
+		t.Errorf("child of shard0 is %s", shardid)
+	}
+	if shardid := childShardID("shard1", shards); shardid != "shard1.1" {
+		t.Errorf("child of shard1 is %s", shardid)
+	}
+}
+
+func TestSplitMembers(t *testing.T) {
+	tests := []struct {
+		members, newMembers, kept, child []string
+	}{
+		{[]string{"a", "b"}, []string{"c", "d"}, []string{"a", "b"}, []string{"c", "d"}},
+		{[]string{"a", "b", "c", "d"}, nil, []string{"a", "b"}, []string{"d", "c"}},
+		{[]string{"a", "b", "c"}, []string{"d"}, []string{"a", "b"}, []string{"d", "c"}},
+	}
+	for _, test := range tests {
+		kept, child := splitMembers(test.members, test.newMembers)
+		if !reflect.DeepEqual(kept, test.kept) || !reflect.DeepEqual(child, test.child) {
+			t.Errorf("splitMembers(%v, %v) = %v, %v, want %v, %v", test.members, test.newMembers, kept, child, test.kept, test.child)
+		}
+	}
+}
+
+func TestPlanSplit(t *testing.T) {
+	useShards(map[string][]string{"shard0": {"a", "b"}, "shard1": {"c", "d"}})
+	sizes := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		if key := fmt.Sprintf("key%d", i); partitionOwner(partitionOf(key)) == "shard0" {
+			sizes[key] = 1
+		}
+	}
+	before := currentPartitionOwners()
+
+	job, err := planSplit("shard0", "shard0.1", []string{"e"}, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(job.Shards) != 3 || len(job.Shards["shard0"])+len(job.Shards["shard0.1"]) != 3 {
+		t.Fatalf("split shards are %v", job.Shards)
+	}
+	after := jobPartitionOwners(job)
+	keysOf := make(map[string]int)
+	for key := range sizes {
+		keysOf[after[partitionOf(key)]]++
+	}
+	for partID, shardid := range after {
+		if before[partID] == "shard1" && shardid != "shard1" {
+			t.Errorf("partition %d of shard1 moves to %s", partID, shardid)
+		}
+		if before[partID] == "shard0" && shardid != "shard0" && shardid != "shard0.1" {
+			t.Errorf("partition %d of shard0 moves to %s", partID, shardid)
+		}
+	}
+	if keysOf["shard0"] == 0 || keysOf["shard0.1"] == 0 {
+		t.Errorf("keys of shard0 are split %v", keysOf)
+	}
+}
+
+func TestPlanMerge(t *testing.T) {
+	useShards(map[string][]string{"shard0": {"a"}, "shard1": {"b"}, "shard2": {"c"}})
+	before := currentPartitionOwners()
+
+	job := planMerge("shard0", "shard1")
+	if want := map[string][]string{"shard0": {"a", "b"}, "shard2": {"c"}}; !reflect.DeepEqual(job.Shards, want) {
+		t.Fatalf("merged shards are %v", job.Shards)
+	}
+	for partID, shardid := range jobPartitionOwners(job) {
+		want := before[partID]
+		if want == "shard1" {
+			want = "shard0"
+		}
+		if shardid != want {
+			t.Errorf("partition %d of %s moves to %s", partID, before[partID], shardid)
+		}
+	}
+}
+
+func TestPlanMergeRanges(t *testing.T) {
+	useShards(map[string][]string{"shard0": {"a"}, "shard1": {"b"}})
+	CONFIG.Partitioner = partitionerRange
+	RANGES = []Key_Range{{Start: "", End: "h", Shard: "shard0"}, {Start: "h", End: "p", Shard: "shard1"}, {Start: "p", End: "", Shard: "shard0"}}
+
+	job := planMerge("shard0", "shard1")
+	if want := []Key_Range{{Start: "", End: "", Shard: "shard0"}}; !reflect.DeepEqual(job.Ranges, want) {
+		t.Errorf("merged ranges are %v", job.Ranges)
+	}
+}
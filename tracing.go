@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/DistributedClocks/GoVector/govec/vclock"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer of every span started by this node
+// Spans are dropped unless trace-output is set, but trace context is still passed on
+var TRACER = otel.Tracer("webservice")
+
+// W3C trace context headers carried by every request between nodes
+var TRACE_PROPAGATOR = propagation.TraceContext{}
+
+// Export spans to CONFIG.TraceOutput: stdout or a file that spans are appended to
+func initTracing() error {
+	otel.SetTextMapPropagator(TRACE_PROPAGATOR)
+	if CONFIG.TraceOutput == "" {
+		return nil
+	}
+	var out io.Writer = os.Stdout
+	if CONFIG.TraceOutput != "stdout" {
+		file, err := os.OpenFile(CONFIG.TraceOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(out))
+	if err != nil {
+		return err
+	}
+	// Spans are written as they end so that none are lost when the node is killed
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "kvs"),
+			attribute.String("service.instance.id", SOCKET_ADDRESS),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+// Start a span for every request, continuing the trace of the node that sent it
+func tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := TRACE_PROPAGATOR.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		// Heartbeats and scrapes are not part of any trace
+		if !trace.SpanContextFromContext(ctx).IsValid() && (c.Path() == "/view" && req.Method == http.MethodGet || c.Path() == "/metrics") {
+			return next(c)
+		}
+		ctx, span := TRACER.Start(ctx, req.Method+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", req.Method),
+				attribute.String("http.route", c.Path()),
+				attribute.String("http.target", req.RequestURI),
+				attribute.String("net.peer.addr", req.RemoteAddr),
+				attribute.String("kvs.node", SOCKET_ADDRESS),
+			))
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+		err := next(c)
+		status := c.Response().Status
+		if httpErr, ok := err.(*echo.HTTPError); ok {
+			status = httpErr.Code
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
+
+// Transport that passes the trace of a request on to the node it is sent to
+// Requests that are not part of a trace, like heartbeats, are sent as they are
+type tracingTransport struct {
+	Transport
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		return t.Transport.RoundTrip(req)
+	}
+	ctx, span := TRACER.Start(req.Context(), req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.String()),
+			attribute.String("net.peer.name", req.URL.Host),
+		))
+	defer span.End()
+	// The request must not be changed, so the headers go on a copy
+	req = req.Clone(ctx)
+	TRACE_PROPAGATOR.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+// Start a span that is part of the trace of the request in c
+func startSpan(c echo.Context, name string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := TRACER.Start(c.Request().Context(), name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// Record where the request for key is served on the span of the request
+func traceRoute(c echo.Context, key string, shardid string) {
+	trace.SpanFromContext(c.Request().Context()).SetAttributes(
+		attribute.String("kvs.key", key),
+		attribute.String("kvs.shard-id", shardid),
+		attribute.Bool("kvs.local", shardid == MY_SHARD_ID),
+	)
+}
+
+// Record a check of the causal dependencies of a request from sender (client or replica)
+// Both vector clocks are recorded so that a trace shows what the request was waiting for
+// Called with vectorClockMutex held
+func traceCausalCheck(c echo.Context, sender string, senderVC vclock.VClock, deliverable bool) {
+	span := startSpan(c, "causal-wait",
+		attribute.String("kvs.sender", sender),
+		attribute.String("kvs.vc.sender", senderVC.ReturnVCString()),
+		attribute.String("kvs.vc.receiver", MY_VECTOR_CLOCK.ReturnVCString()),
+		attribute.Bool("kvs.deliverable", deliverable),
+	)
+	if !deliverable {
+		span.SetStatus(codes.Error, "causal dependencies not satisfied")
+	}
+	span.End()
+}
+
+// Record the retry of a replication request on the span it is part of
+func traceRetry(ctx context.Context, address string, attempt int) {
+	trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+		attribute.String("net.peer.name", address),
+		attribute.Int("kvs.attempt", attempt),
+	))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Record the spans started until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := TRACER
+	TRACER = provider.Tracer("webservice")
+	t.Cleanup(func() { TRACER = previous })
+	return recorder
+}
+
+// Returns the ended span called name, failing the test if there is not exactly one
+func spanNamed(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	var found []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			found = append(found, span)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("found %d spans called %s", len(found), name)
+	}
+	return found[0]
+}
+
+// A request forwarded to another node continues the trace of the client request
+func TestTracePropagation(t *testing.T) {
+	CONFIG = defaultConfig()
+	useTransport(t, transportHTTP)
+	recorder := recordSpans(t)
+	e := echo.New()
+	e.Use(tracingMiddleware)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	e.GET("/kvs/:key", func(c echo.Context) error {
+		request, _ := http.NewRequestWithContext(c.Request().Context(), "GET", server.URL+"/shard/key-sizes/shard0", nil)
+		response, err := peerClient(5 * time.Second).Do(request)
+		if err != nil {
+			return err
+		}
+		drainAndClose(response.Body)
+		return c.JSON(response.StatusCode, map[string]string{})
+	})
+	e.GET("/shard/key-sizes/:id", func(c echo.Context) error {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "unavailable"})
+	})
+	e.GET("/view", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]string{})
+	})
+
+	for _, path := range []string{"/kvs/a", "/view"} {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	// Heartbeats are not traced, so the three spans are those of the client request
+	if spans := recorder.Ended(); len(spans) != 3 {
+		t.Fatalf("recorded %d spans", len(spans))
+	}
+	client := spanNamed(t, recorder, "GET /kvs/:key")
+	forward := spanNamed(t, recorder, "GET /shard/key-sizes/shard0")
+	peer := spanNamed(t, recorder, "GET /shard/key-sizes/:id")
+	if forward.Parent().SpanID() != client.SpanContext().SpanID() || peer.Parent().SpanID() != forward.SpanContext().SpanID() {
+		t.Error("spans of the forwarded request are not children of the client request")
+	}
+	if !peer.Parent().IsRemote() || peer.SpanContext().TraceID() != client.SpanContext().TraceID() {
+		t.Error("the peer did not continue the trace it was sent")
+	}
+	for _, span := range []sdktrace.ReadOnlySpan{client, forward, peer} {
+		if span.Status().Code != codes.Error {
+			t.Errorf("span %s of a 503 has status %v", span.Name(), span.Status().Code)
+		}
+	}
+}
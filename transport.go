@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Protocols used between nodes
+const (
+	transportBinary = "binary"
+	transportHTTP   = "http"
+)
+
+// Sent first on every binary connection so that it can share the port of the HTTP API
+const rpcPreamble = "KVSRPC/2"
+
+// Largest frame accepted from a peer
+const rpcMaxFrame = 256 << 20
+
+// Time a new connection gets to show whether it speaks HTTP or the binary protocol
+const rpcSniffTimeout = 10 * time.Second
+
+// Most bytes read from an unread response body so that its connection can be reused
+const drainLimit = 64 << 10
+
+// Transport carries requests from this node to other nodes
+// Clients always talk HTTP to a node; only node-to-node traffic goes through a Transport
+type Transport interface {
+	http.RoundTripper
+	// Close every connection to other nodes
+	Close()
+}
+
+// Transport used for every request sent to another node, picked by CONFIG.Transport
+var PEER_TRANSPORT Transport
+
+// Create the transport called name
+func newTransport(name string) Transport {
+	dialer := &net.Dialer{Timeout: time.Duration(CONFIG.SendToAnyTimeout), KeepAlive: time.Duration(CONFIG.PeerKeepAlive)}
+	var transport Transport = &binaryTransport{dialer: dialer, conns: make(map[string]*rpcConn)}
+	if name == transportHTTP {
+		// One pool shared by every request, bounded per peer so that replication
+		// under load reuses connections instead of exhausting ports
+		transport = httpTransport{&http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: CONFIG.PeerMaxConns,
+			MaxConnsPerHost:     CONFIG.PeerMaxConns,
+			IdleConnTimeout:     time.Duration(CONFIG.PeerIdleTimeout),
+		}}
+	}
+	// Requests carry the trace they are part of to the other node
+	return tracingTransport{transport}
+}
+
+// Read what is left of a response body, up to drainLimit, and close it
+// A body closed before it was read to the end cannot give its connection back to the pool
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, drainLimit))
+	body.Close()
+}
+
+// Returns a client that sends requests to other nodes through PEER_TRANSPORT
+// A timeout of 0 means no timeout
+func peerClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: PEER_TRANSPORT}
+}
+
+// Plain HTTP/1.1 between nodes, as used by clients
+type httpTransport struct {
+	*http.Transport
+}
+
+func (t httpTransport) Close() {
+	t.CloseIdleConnections()
+}
+
+// Length-prefixed binary frames over one persistent connection per peer
+// Requests are multiplexed by id, so a slow request does not hold up the others
+//
+// Every frame is a 4 byte big-endian length followed by the payload
+// Request payload:  id (8 bytes) | method length (2) | method | path length (2) | path | headers | body
+// Response payload: id (8 bytes) | status (2) | body
+// Headers are a count (2) followed by that many name and value strings, each with a 2 byte length
+// Only the first value of every header is sent
+type binaryTransport struct {
+	dialer *net.Dialer
+	mutex  sync.Mutex
+	conns  map[string]*rpcConn
+}
+
+// A connection to one peer and the requests waiting for an answer on it
+type rpcConn struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	pending    map[uint64]chan rpcResponse
+	nextID     uint64
+	err        error
+}
+
+// Answer to a request sent over a binary connection
+type rpcResponse struct {
+	status int
+	body   []byte
+	err    error
+}
+
+func (t *binaryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := t.connTo(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	status, respBody, err := conn.call(req.Context(), req.Method, req.URL.RequestURI(), req.Header, body)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+func (t *binaryTransport) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for address, conn := range t.conns {
+		conn.fail(fmt.Errorf("transport closed"))
+		delete(t.conns, address)
+	}
+}
+
+// Returns the open connection to address, dialing a new one if there is none
+func (t *binaryTransport) connTo(ctx context.Context, address string) (*rpcConn, error) {
+	t.mutex.Lock()
+	conn, ok := t.conns[address]
+	t.mutex.Unlock()
+	if ok && conn.alive() {
+		return conn, nil
+	}
+
+	raw, err := t.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := raw.Write([]byte(rpcPreamble)); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	conn = &rpcConn{conn: raw, pending: make(map[uint64]chan rpcResponse)}
+	go conn.readResponses()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// Another request may have connected in the meantime
+	if existing, ok := t.conns[address]; ok && existing.alive() {
+		conn.fail(fmt.Errorf("duplicate connection"))
+		return existing, nil
+	}
+	t.conns[address] = conn
+	return conn, nil
+}
+
+// Returns false once the connection failed
+func (rc *rpcConn) alive() bool {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.err == nil
+}
+
+// Close the connection and fail every request waiting on it
+func (rc *rpcConn) fail(err error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if rc.err != nil {
+		return
+	}
+	rc.err = err
+	rc.conn.Close()
+	for id, ch := range rc.pending {
+		ch <- rpcResponse{err: err}
+		delete(rc.pending, id)
+	}
+}
+
+// Send a request and wait for its answer or for ctx to be done
+func (rc *rpcConn) call(ctx context.Context, method string, path string, header http.Header, body []byte) (int, []byte, error) {
+	ch := make(chan rpcResponse, 1)
+	rc.mutex.Lock()
+	if rc.err != nil {
+		rc.mutex.Unlock()
+		return 0, nil, rc.err
+	}
+	rc.nextID++
+	id := rc.nextID
+	rc.pending[id] = ch
+	rc.mutex.Unlock()
+
+	payload := make([]byte, 0, 14+len(method)+len(path)+len(body))
+	payload = binary.BigEndian.AppendUint64(payload, id)
+	payload = appendRPCString(payload, method)
+	payload = appendRPCString(payload, path)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(header)))
+	for name := range header {
+		payload = appendRPCString(payload, name)
+		payload = appendRPCString(payload, header.Get(name))
+	}
+	payload = append(payload, body...)
+
+	rc.writeMutex.Lock()
+	deadline, _ := ctx.Deadline()
+	rc.conn.SetWriteDeadline(deadline)
+	err := writeFrame(rc.conn, payload)
+	rc.writeMutex.Unlock()
+	if err != nil {
+		// A partly written frame leaves the connection unusable
+		rc.fail(err)
+		return 0, nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp.status, resp.body, resp.err
+	case <-ctx.Done():
+		rc.mutex.Lock()
+		delete(rc.pending, id)
+		rc.mutex.Unlock()
+		return 0, nil, ctx.Err()
+	}
+}
+
+// Hand every response to the request waiting for it until the connection fails
+func (rc *rpcConn) readResponses() {
+	reader := bufio.NewReader(rc.conn)
+	for {
+		payload, err := readFrame(reader)
+		if err != nil {
+			rc.fail(err)
+			return
+		}
+		if len(payload) < 10 {
+			rc.fail(fmt.Errorf("short response frame"))
+			return
+		}
+		id := binary.BigEndian.Uint64(payload)
+		resp := rpcResponse{status: int(binary.BigEndian.Uint16(payload[8:])), body: payload[10:]}
+		rc.mutex.Lock()
+		// The request may have timed out already
+		if ch, ok := rc.pending[id]; ok {
+			ch <- resp
+			delete(rc.pending, id)
+		}
+		rc.mutex.Unlock()
+	}
+}
+
+// Write a length-prefixed frame in a single write
+func writeFrame(w io.Writer, payload []byte) error {
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// Read a length-prefixed frame
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > rpcMaxFrame {
+		return nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	_, err := io.ReadFull(r, payload)
+	return payload, err
+}
+
+// Listener for the HTTP API that serves binary connections itself
+// Connections starting with rpcPreamble are answered by handler; every other one is returned by Accept
+type rpcListener struct {
+	net.Listener
+	handler http.Handler
+	conns   chan net.Conn
+	err     error
+}
+
+// Listen on address and serve binary connections with handler
+func newRPCListener(address string, handler http.Handler) (*rpcListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &rpcListener{Listener: listener, handler: handler, conns: make(chan net.Conn)}
+	go l.acceptAll()
+	return l, nil
+}
+
+func (l *rpcListener) acceptAll() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.conns)
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+// Returns the next HTTP connection
+func (l *rpcListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, l.err
+	}
+	return conn, nil
+}
+
+// Look at the first bytes of a connection to decide who serves it
+func (l *rpcListener) route(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(rpcSniffTimeout))
+	preamble, err := reader.Peek(len(rpcPreamble))
+	conn.SetReadDeadline(time.Time{})
+	if err == nil && string(preamble) == rpcPreamble {
+		reader.Discard(len(rpcPreamble))
+		serveRPCConn(conn, reader, l.handler)
+		return
+	}
+	// Whatever was read already is replayed to the HTTP server
+	defer func() { recover() }()
+	l.conns <- &peekedConn{Conn: conn, reader: reader}
+}
+
+// Connection whose first bytes were already buffered
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Answer the requests of a binary connection until it closes
+// Requests are handled concurrently and answered as they complete
+func serveRPCConn(conn net.Conn, reader *bufio.Reader, handler http.Handler) {
+	defer conn.Close()
+	var writeMutex sync.Mutex
+	for {
+		payload, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		// Handlers run through serveLocally, which answers 500 if they panic
+		go func(payload []byte) {
+			id, status, body := handleRPCRequest(conn, payload, handler)
+			resp := make([]byte, 0, 10+len(body))
+			resp = binary.BigEndian.AppendUint64(resp, id)
+			resp = binary.BigEndian.AppendUint16(resp, uint16(status))
+			resp = append(resp, body...)
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			if err := writeFrame(conn, resp); err != nil {
+				conn.Close()
+			}
+		}(payload)
+	}
+}
+
+// Run the request in payload through handler as if it came over HTTP
+func handleRPCRequest(conn net.Conn, payload []byte, handler http.Handler) (uint64, int, []byte) {
+	if len(payload) < 10 {
+		return 0, http.StatusBadRequest, nil
+	}
+	id := binary.BigEndian.Uint64(payload)
+	rest := payload[8:]
+	method, rest, ok := readRPCString(rest)
+	if !ok {
+		return id, http.StatusBadRequest, nil
+	}
+	path, rest, ok := readRPCString(rest)
+	if !ok {
+		return id, http.StatusBadRequest, nil
+	}
+	header, body, ok := readRPCHeader(rest)
+	if !ok {
+		return id, http.StatusBadRequest, nil
+	}
+	status, respBody := serveLocally(handler, conn.LocalAddr(), conn.RemoteAddr(), method, path, header, body)
+	return id, status, respBody
+}
+
+// Run a request through handler in-process and return its status and body
+// local and remote are the addresses of the connection the request came in on; header may be nil
+func serveLocally(handler http.Handler, local net.Addr, remote net.Addr, method string, path string, header http.Header, body []byte) (status int, respBody []byte) {
+	// A panicking handler fails only its own request, as it does behind net/http
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic serving %s %s: %v\n%s", method, path, r, debug.Stack())
+			status, respBody = http.StatusInternalServerError, []byte(`{"error":"Internal server error"}`)
+		}
+	}()
+	req, err := http.NewRequest(method, "http://"+local.String()+path, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+	req.RemoteAddr = remote.String()
+	// Set like it is for requests read by the HTTP server, for the request logger
+	req.RequestURI = path
+	req.Header.Set("Content-Type", "application/json")
+	w := &rpcResponseWriter{header: make(http.Header)}
+	handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.status, w.body.Bytes()
+}
+
+// Returns the string with a 2 byte length prefix at the start of b, and what follows it
+func readRPCString(b []byte) (string, []byte, bool) {
+	if len(b) < 2 {
+		return "", nil, false
+	}
+	size := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+size {
+		return "", nil, false
+	}
+	return string(b[2 : 2+size]), b[2+size:], true
+}
+
+// Append s with a 2 byte length prefix
+func appendRPCString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// Returns the headers at the start of b, and what follows them
+func readRPCHeader(b []byte) (http.Header, []byte, bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	count := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	header := make(http.Header, count)
+	for i := 0; i < count; i++ {
+		var name, value string
+		var ok bool
+		if name, b, ok = readRPCString(b); !ok {
+			return nil, nil, false
+		}
+		if value, b, ok = readRPCString(b); !ok {
+			return nil, nil, false
+		}
+		header.Set(name, value)
+	}
+	return header, b, true
+}
+
+// Collects the response of a handler to a binary request
+type rpcResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *rpcResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rpcResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *rpcResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Start a node on a free port that acknowledges every replication request, and return its address
+func startReplica(tb testing.TB) string {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result":"replaced"}`))
+	})
+	listener, err := newRPCListener("127.0.0.1:0", handler)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	tb.Cleanup(func() {
+		server.Close()
+		listener.Close()
+	})
+	return listener.Addr().String()
+}
+
+// Use the transport called name for requests to other nodes until the benchmark ends
+func useTransport(tb testing.TB, name string) {
+	previous := PEER_TRANSPORT
+	PEER_TRANSPORT = newTransport(name)
+	tb.Cleanup(func() {
+		PEER_TRANSPORT.Close()
+		PEER_TRANSPORT = previous
+	})
+}
+
+// Body of a replicated PUT, as sent by putKey
+func replicationBody() []byte {
+	body, _ := json.Marshal(KVS_PUT_Request{
+		Data:           "some value of a typical size for a key-value store",
+		CausalMetaData: `{"127.0.0.1:9001":1042, "127.0.0.1:9002":1038, "127.0.0.1:9003":997}`,
+		FromRepilca:    "127.0.0.1:9001",
+		Version:        7,
+	})
+	return body
+}
+
+// Replicated writes sent one after the other to a single replica with send
+func BenchmarkSend(b *testing.B) {
+	for _, name := range []string{transportHTTP, transportBinary} {
+		b.Run(name, func(b *testing.B) {
+			useTransport(b, name)
+			url := fmt.Sprintf("http://%s/kvs/key", startReplica(b))
+			body := replicationBody()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				request, _ := http.NewRequest("PUT", url, bytes.NewReader(body))
+				send(request)
+			}
+		})
+	}
+}
+
+// Replicated writes sent concurrently to a single replica with send, as under client load
+func BenchmarkSendParallel(b *testing.B) {
+	for _, name := range []string{transportHTTP, transportBinary} {
+		b.Run(name, func(b *testing.B) {
+			useTransport(b, name)
+			url := fmt.Sprintf("http://%s/kvs/key", startReplica(b))
+			body := replicationBody()
+			b.SetBytes(int64(len(body)))
+			b.SetParallelism(4 * runtime.GOMAXPROCS(0))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					request, _ := http.NewRequest("PUT", url, bytes.NewReader(body))
+					send(request)
+				}
+			})
+		})
+	}
+}
+
+// Replicated writes broadcast to every other member of a shard of three, waiting until all were acknowledged
+func BenchmarkBroadcast(b *testing.B) {
+	for _, name := range []string{transportHTTP, transportBinary} {
+		b.Run(name, func(b *testing.B) {
+			useTransport(b, name)
+			nodes := []string{startReplica(b), startReplica(b)}
+			body := replicationBody()
+			b.SetBytes(int64(len(body) * len(nodes)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := broadcast(context.Background(), "PUT", "kvs/key", body, nodes); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// Sends are asynchronous, so the benchmark ends once the last one completed
+			for pendingSends.Load() > 0 {
+				time.Sleep(100 * time.Microsecond)
+			}
+		})
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	for _, payload := range []string{"", "payload"} {
+		if err := writeFrame(&buf, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := bufio.NewReader(&buf)
+	for _, want := range []string{"", "payload"} {
+		if payload, err := readFrame(reader); err != nil || string(payload) != want {
+			t.Errorf("read frame %q, %v, want %q", payload, err, want)
+		}
+	}
+	if _, err := readFrame(reader); err != io.EOF {
+		t.Errorf("reading past the last frame returned %v", err)
+	}
+
+	writeFrame(&buf, []byte("payload"))
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(buf.Bytes()[:6]))); err == nil {
+		t.Error("read a truncated frame")
+	}
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("reading an oversized frame returned %v", err)
+	}
+}
+
+func TestRPCHeader(t *testing.T) {
+	b := binary.BigEndian.AppendUint16(nil, 2)
+	b = appendRPCString(b, "Content-Type")
+	b = appendRPCString(b, "application/json")
+	b = appendRPCString(b, "Traceparent")
+	b = appendRPCString(b, "00-01")
+	b = append(b, "body"...)
+
+	header, rest, ok := readRPCHeader(b)
+	if !ok || header.Get("Content-Type") != "application/json" || header.Get("Traceparent") != "00-01" || string(rest) != "body" {
+		t.Errorf("read header %v and body %q, %v", header, rest, ok)
+	}
+	for size := 0; size < len(b)-len("body"); size++ {
+		if _, _, ok := readRPCHeader(b[:size]); ok {
+			t.Errorf("read a header cut off after %d bytes", size)
+		}
+	}
+}
+
+// Binary and HTTP requests to the same port reach the same handler
+func TestBinaryTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("handler failed")
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("X-Test"), body)
+	})
+	listener, err := newRPCListener("127.0.0.1:0", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+		listener.Close()
+	})
+	address := listener.Addr().String()
+
+	for _, name := range []string{transportBinary, transportHTTP} {
+		useTransport(t, name)
+		request, _ := http.NewRequest("PUT", "http://"+address+"/kvs/key?x=1", strings.NewReader("value"))
+		request.Header.Set("X-Test", "header")
+		response, err := peerClient(5 * time.Second).Do(request)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusCreated || string(body) != "PUT /kvs/key?x=1 header value" {
+			t.Errorf("%s: answered %d %q", name, response.StatusCode, body)
+		}
+	}
+
+	// A panic fails the request but not the connection
+	useTransport(t, transportBinary)
+	client := peerClient(5 * time.Second)
+	response, err := client.Get("http://" + address + "/panic")
+	if err != nil || response.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("a panicking handler answered %v, %v", response, err)
+	}
+	response.Body.Close()
+	if response, err = client.Get("http://" + address + "/after"); err != nil || response.StatusCode != http.StatusCreated {
+		t.Fatalf("the request after a panic got %v, %v", response, err)
+	}
+	response.Body.Close()
+}
+
+// Replication reuses a bounded number of connections to every peer
+func TestSendReusesConnections(t *testing.T) {
+	CONFIG = defaultConfig()
+	CONFIG.PeerMaxConns = 2
+	useTransport(t, transportHTTP)
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		// More than is read by send, which has to drain it
+		w.Write(bytes.Repeat([]byte("x"), 16<<10))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	body := replicationBody()
+	for i := 0; i < 10; i++ {
+		request, _ := http.NewRequest("PUT", server.URL+"/kvs/key", bytes.NewReader(body))
+		send(request)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("sequential sends opened %d connections", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request, _ := http.NewRequest("PUT", server.URL+"/kvs/key", bytes.NewReader(body))
+			send(request)
+		}()
+	}
+	wg.Wait()
+	if n := conns.Load(); n > int32(CONFIG.PeerMaxConns) {
+		t.Errorf("concurrent sends opened %d connections, more than peer-max-conns", n)
+	}
+}
@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/DistributedClocks/GoVector/govec/vclock"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Builds a new vector clock object given a string
@@ -49,10 +54,10 @@ func removeFromView(address string) {
 
 // Periodically check if a replica is still alive
 func heartbeat() {
-	client := &http.Client{Timeout: 5 * time.Second}
-	time.Sleep(time.Second)
+	client := peerClient(time.Duration(CONFIG.HeartbeatTimeout))
+	time.Sleep(time.Duration(CONFIG.HeartbeatInterval))
 	for {
-		time.Sleep(time.Second)
+		time.Sleep(time.Duration(CONFIG.HeartbeatInterval))
 		viewMutex.Lock() // Lock before reading CURRENT_VIEW
 		currentViewSnapshot := make([]string, len(CURRENT_VIEW))
 		copy(currentViewSnapshot, CURRENT_VIEW) // Create a copy to iterate over
@@ -65,39 +70,95 @@ func heartbeat() {
 			resp, err := client.Get(fmt.Sprintf("http://%s/view", address))
 			if err != nil || resp.StatusCode != http.StatusOK {
 				fmt.Printf("Replica at %s is down. Removing from current view.\n", address)
+				heartbeatFailures.WithLabelValues(address).Inc()
 				removeFromView(address) // Safely remove the address
 				// broadcast delete views
-				payload := map[string]string{"socket-address": address}
-				jsonPayload, _ := json.Marshal(payload)
-				broadcast("DELETE", "view", jsonPayload, CURRENT_VIEW)
+				jsonPayload, _ := json.Marshal(View_Request{SocketAdress: address, FromRepilca: SOCKET_ADDRESS})
+				broadcast(context.Background(), "DELETE", "view", jsonPayload, CURRENT_VIEW)
 			}
 			if resp != nil {
-				resp.Body.Close()
+				drainAndClose(resp.Body)
 			}
 		}
+		// Look for nodes that came back and check if I am in a minority partition
+		checkPartition(client)
 	}
 }
 
 // Send http requests till success or replica is down
+// A replica takes the writes of a node only in order, so a request that was given up on would
+// block every later one: transport errors are retried for as long as the replica is in the view
 func send(request *http.Request) {
-	client := &http.Client{Timeout: 1 * time.Second}
-	for {
-		resp, err := client.Do(request)
+	client := peerClient(0)
+	backoff := time.Duration(CONFIG.SendRetryInterval)
+	rejections := 0
+	for attempt := 1; ; attempt++ {
+		// The body was consumed by the previous attempt, so rewind it before retrying
+		if request.GetBody != nil {
+			request.Body, _ = request.GetBody()
+		}
+		// Every attempt gets its own deadline, but stays part of the trace of the request
+		ctx, cancel := context.WithTimeout(request.Context(), time.Duration(CONFIG.SendTimeout))
+		resp, err := client.Do(request.WithContext(ctx))
 		if err != nil {
+			cancel()
 			// Replica is down
+			if !inView(request.URL.Host) {
+				replicationFailures.Inc()
+				return
+			}
+			// Back off while the replica is unreachable, up to send-max-backoff
+			replicationRetries.Inc()
+			traceRetry(request.Context(), request.URL.Host, attempt)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, time.Duration(CONFIG.SendMaxBackoff))
+			continue
+		}
+		status := resp.StatusCode
+		drainAndClose(resp.Body)
+		cancel()
+		if status != 503 {
 			return
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 503 {
+		// The replica already waited for the writes this one depends on,
+		// so one that keeps being rejected waits for a write that is not coming
+		rejections++
+		if rejections > CONFIG.SendMaxRetries {
+			fmt.Printf("Giving up on %s %s after %d rejections\n", request.Method, request.URL, rejections)
+			replicationFailures.Inc()
 			return
 		}
-		// Sleep for 1 second and then try again
-		time.Sleep(time.Second)
+		// Sleep for the retry interval and then try again
+		backoff = time.Duration(CONFIG.SendRetryInterval)
+		replicationRetries.Inc()
+		traceRetry(request.Context(), request.URL.Host, attempt)
+		time.Sleep(time.Duration(CONFIG.SendRetryInterval))
 	}
 }
 
+// Returns true if address is in the current view
+func inView(address string) bool {
+	viewMutex.Lock()
+	defer viewMutex.Unlock()
+	return contains(CURRENT_VIEW, address)
+}
+
 // Broadcast a Request to all other replicas in the system asyncronously
-func broadcast(method string, endpoint string, jsonData []byte, nodes []string) error {
+// The requests are part of the trace in ctx, but outlive it
+func broadcast(ctx context.Context, method string, endpoint string, jsonData []byte, nodes []string) error {
+	ctx, span := TRACER.Start(context.WithoutCancel(ctx), "replicate", trace.WithAttributes(
+		attribute.String("http.method", method),
+		attribute.String("kvs.endpoint", endpoint),
+		attribute.StringSlice("kvs.nodes", nodes),
+	))
+	// The span ends once every replica answered or is given up on
+	var sends sync.WaitGroup
+	defer func() {
+		go func() {
+			sends.Wait()
+			span.End()
+		}()
+	}()
 	// Broadcast request to all replicas
 	for _, address := range nodes {
 		// Dont broacast to yoruself
@@ -107,21 +168,27 @@ func broadcast(method string, endpoint string, jsonData []byte, nodes []string)
 		// Create the url using the current address
 		url := fmt.Sprintf("http://%s/%s", address, endpoint)
 		// Build the http request
-		request, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
-		request.RemoteAddr = address
+		request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(jsonData))
 		if err != nil {
 			return err
 		}
+		request.RemoteAddr = address
 		// Send request to current replica
-		// Print the request
-		go send(request)
+		// Track the request so a reshard can wait for replication to finish
+		done := trackSend()
+		sends.Add(1)
+		go func() {
+			defer done()
+			defer sends.Done()
+			send(request)
+		}()
 	}
 	return nil
 }
 
 // Given a list of address, try to send a request to one of them
 func sendToAny(method string, endpoint string, jsonData []byte, nodes []string) (*http.Response, error) {
-	client := &http.Client{Timeout: 1 * time.Second}
+	client := peerClient(time.Duration(CONFIG.SendToAnyTimeout))
 	// Broadcast request to all replicas
 	for _, address := range nodes {
 		// Dont send to yourself
@@ -137,11 +204,14 @@ func sendToAny(method string, endpoint string, jsonData []byte, nodes []string)
 		}
 		// Send request to current address
 		resp, err := client.Do(request)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			drainAndClose(resp.Body)
 			continue
 		}
-		return resp, err
+		return resp, nil
 	}
 	// Return error as we couln't send to any node
 	return nil, fmt.Errorf("no nodes to send to")
@@ -188,33 +258,160 @@ func compareReplicasVC(senderVC, recieverVC vclock.VClock, senderPos string) boo
 	return true
 }
 
+// Returns true if the write of senderPos at senderVC was already applied, e.g. when an
+// earlier attempt to send it timed out after the replica took it
+func alreadyApplied(senderVC, recieverVC vclock.VClock, senderPos string) bool {
+	senderTick, _ := senderVC.FindTicks(senderPos)
+	recieverTick, _ := recieverVC.FindTicks(senderPos)
+	return senderTick <= recieverTick
+}
+
+// Signaled whenever a replicated write advances MY_VECTOR_CLOCK
+var vectorClockAdvanced = sync.NewCond(&vectorClockMutex)
+
+// Waits for the writes a replicated write depends on, for up to half the send timeout so
+// that the sender gets an answer before its attempt times out; a backlog of writes from a
+// node is then applied as soon as each one arrives instead of once per retry round
+// Called with vectorClockMutex held
+func awaitDeliverable(senderVC vclock.VClock, senderPos string) bool {
+	deadline := time.Now().Add(time.Duration(CONFIG.SendTimeout) / 2)
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		vectorClockMutex.Lock()
+		vectorClockAdvanced.Broadcast()
+		vectorClockMutex.Unlock()
+	})
+	defer timer.Stop()
+	for !compareReplicasVC(senderVC, MY_VECTOR_CLOCK, senderPos) {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		vectorClockAdvanced.Wait()
+	}
+	return true
+}
+
+// Advance the sender's position in MY_VECTOR_CLOCK to the one in senderVC
+func mergeSenderPosition(senderVC vclock.VClock, senderPos string) {
+	senderTick, _ := senderVC.FindTicks(senderPos)
+	vectorClockMutex.Lock()
+	defer vectorClockMutex.Unlock()
+	myTick, _ := MY_VECTOR_CLOCK.FindTicks(senderPos)
+	if senderTick > myTick {
+		MY_VECTOR_CLOCK.Set(senderPos, senderTick)
+		vectorClockAdvanced.Broadcast()
+	}
+}
+
 // Given a shard count and a list of nodes,
 // distribute the nodes in the current view into shards
-func distributeNodesIntoShards(shardCount int, nodes []string) {
-	// Clear the SHARDS map
-	SHARDS = make(map[string][]string)
-	// Delegate all nodes in current view to SHARDS map
-	nodesPerShard := len(nodes) / shardCount
-	remainder := len(nodes) % shardCount
-	// Create shardCount shardids in the SHARDS map
-	for i := 0; i < shardCount; i++ {
-		shardid := fmt.Sprintf("shard%d", i)
-		// Assign len(nodes)/SHARD_COUNT nodes to each shard
-		for j := 0; j < nodesPerShard; j++ {
-			SHARDS[shardid] = append(SHARDS[shardid], nodes[nodesPerShard*i+j])
+func distributeNodesIntoShards(shardCount int, nodes []string) map[string][]string {
+	return assignNodesToShards(shardCount, nodes, nil, nil)
+}
+
+// Assign nodes to shardCount shards, moving as few nodes as possible out of the shards in current
+// Shard sizes differ by at most one, and nodes placed in a new shard are spread over
+// the failure domains in domains (address -> label) when labels are given
+func assignNodesToShards(shardCount int, nodes []string, current map[string][]string, domains map[string]string) map[string][]string {
+	shards := make(map[string][]string)
+	// Members of the current shards that are still in the list of nodes
+	kept := make(map[string][]string)
+	for shardid, members := range current {
+		for _, address := range members {
+			if contains(nodes, address) {
+				kept[shardid] = append(kept[shardid], address)
+			}
 		}
 	}
-	// Distribute the remainder nodes to the first few shards
-	for i := 0; i < remainder; i++ {
+	// Current shards keep their ids, whatever their form (e.g. shard1.1 after a split)
+	// When there are fewer shards, the ones that keep the most members stay
+	shardIDs := sortedShardIDs(current)
+	sort.SliceStable(shardIDs, func(i, j int) bool {
+		return len(kept[shardIDs[i]]) > len(kept[shardIDs[j]])
+	})
+	if len(shardIDs) > shardCount {
+		shardIDs = shardIDs[:shardCount]
+	}
+	// Only shards that are added get a new id
+	for i := 0; len(shardIDs) < shardCount; i++ {
 		shardid := fmt.Sprintf("shard%d", i)
-		SHARDS[shardid] = append(SHARDS[shardid], nodes[nodesPerShard*shardCount+i])
+		if _, exists := current[shardid]; !exists {
+			shardIDs = append(shardIDs, shardid)
+		}
+	}
+	sort.Strings(shardIDs)
+
+	// Every shard gets len(nodes)/shardCount nodes, and the shards that keep
+	// the most members get one of the remainder nodes
+	capacity := make(map[string]int)
+	bySize := append([]string{}, shardIDs...)
+	sort.SliceStable(bySize, func(i, j int) bool {
+		return len(kept[bySize[i]]) > len(kept[bySize[j]])
+	})
+	for i, shardid := range bySize {
+		capacity[shardid] = len(nodes) / shardCount
+		if i < len(nodes)%shardCount {
+			capacity[shardid]++
+		}
 	}
+
+	// Keep existing pairings up to the capacity of each shard
+	placed := make(map[string]bool)
+	for _, shardid := range shardIDs {
+		for _, address := range kept[shardid] {
+			if len(shards[shardid]) < capacity[shardid] {
+				shards[shardid] = append(shards[shardid], address)
+				placed[address] = true
+			}
+		}
+	}
+
+	// Place the remaining nodes in view order
+	for _, address := range nodes {
+		if placed[address] {
+			continue
+		}
+		best := ""
+		for _, shardid := range shardIDs {
+			if len(shards[shardid]) >= capacity[shardid] {
+				continue
+			}
+			if best == "" || betterShardFor(address, shards[shardid], shards[best], domains) {
+				best = shardid
+			}
+		}
+		shards[best] = append(shards[best], address)
+		placed[address] = true
+	}
+	return shards
+}
+
+// Returns true if address is better placed in the shard with members a than in the one with members b
+// Prefers the shard with fewer nodes in the same failure domain, then the emptier shard
+func betterShardFor(address string, a []string, b []string, domains map[string]string) bool {
+	domain := domains[address]
+	if domain != "" {
+		sameA, sameB := 0, 0
+		for _, member := range a {
+			if domains[member] == domain {
+				sameA++
+			}
+		}
+		for _, member := range b {
+			if domains[member] == domain {
+				sameB++
+			}
+		}
+		if sameA != sameB {
+			return sameA < sameB
+		}
+	}
+	return len(a) < len(b)
 }
 
 func syncMyself(shardCount int) {
 
 	// Distribute all nodes into shards
-	distributeNodesIntoShards(shardCount, CURRENT_VIEW)
+	SHARDS = distributeNodesIntoShards(shardCount, CURRENT_VIEW)
 
 	// Look for a node to sync with
 	for _, address := range SHARDS[MY_SHARD_ID] {
@@ -229,19 +426,19 @@ func syncMyself(shardCount int) {
 	}
 	// If there is no nodes to sync with, initialize Vector Clock and SHARDS
 	// Initialize Vector Clock
+	vectorClockMutex.Lock()
 	MY_VECTOR_CLOCK = vclock.New()
 	for _, address := range CURRENT_VIEW {
 		MY_VECTOR_CLOCK.Set(address, 0)
 	}
+	vectorClockMutex.Unlock()
 
 }
 
 // Makes a request to existing replica to get the current view and vector clock
 // Updates the new replica's state based on the response
 func syncWithNode(targetReplicaAddress string) error {
-	client := &http.Client{
-		Timeout: 1 * time.Second, // Set a timeout to avoid hanging indefinitely
-	}
+	client := peerClient(time.Duration(CONFIG.SendToAnyTimeout)) // Set a timeout to avoid hanging indefinitely
 
 	// Make the URL for the sync endpoint of the target replica
 	reqURL := fmt.Sprintf("http://%s/sync", targetReplicaAddress)
@@ -251,7 +448,7 @@ func syncWithNode(targetReplicaAddress string) error {
 	if err != nil {
 		return fmt.Errorf("failed to fetch state from replica %s: %v", targetReplicaAddress, err)
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	// Check if the response status code indicates success
 	if resp.StatusCode != http.StatusOK {
@@ -283,9 +480,16 @@ func syncWithNode(targetReplicaAddress string) error {
 
 	// Update SHARDS with the new shards
 	SHARDS = newShards
+	if syncData.Ranges != nil {
+		RANGES = syncData.Ranges
+	}
+	PARTITION_OVERRIDES = pruneOverrides(syncData.Overrides, SHARDS)
+	SHARD_WEIGHTS = pruneWeights(syncData.Weights, SHARDS)
 
 	// Directly update MY_VECTOR_CLOCK with the new vector clock
+	vectorClockMutex.Lock()
 	MY_VECTOR_CLOCK = newVClock
+	vectorClockMutex.Unlock()
 
 	// Update KV Store with new KVS
 	KVStore = newKVS
@@ -296,16 +500,35 @@ func syncWithNode(targetReplicaAddress string) error {
 
 // Stores which shard the current node belongs to into MY_SHARD_ID
 func updateMyShardID() {
-	// Look through all shardids in SHARDS values and find to find my SOCKET_ADDRESS
-	for shardid, nodes := range SHARDS {
-		for _, address := range nodes {
-			if address == SOCKET_ADDRESS {
-				MY_SHARD_ID = shardid
-				return
-			}
+	MY_SHARD_ID = shardOfNode(SHARDS, SOCKET_ADDRESS)
+}
+
+// Returns the shard id the given address belongs to, or "" if it has none
+func shardOfNode(shards map[string][]string, address string) string {
+	// Look through all shardids in the shard map to find the address
+	for shardid, nodes := range shards {
+		if contains(nodes, address) {
+			return shardid
 		}
 	}
-	MY_SHARD_ID = ""
+	return ""
+}
+
+// Returns the shard id with the fewest members, or "" if there are no shards
+func smallestShard(shards map[string][]string) string {
+	shardIDs := make([]string, 0, len(shards))
+	for shardid := range shards {
+		shardIDs = append(shardIDs, shardid)
+	}
+	// Sort so that every node breaks ties the same way
+	sort.Strings(shardIDs)
+	smallest := ""
+	for _, shardid := range shardIDs {
+		if smallest == "" || len(shards[shardid]) < len(shards[smallest]) {
+			smallest = shardid
+		}
+	}
+	return smallest
 }
 
 // Chose a random node from the inputted shard id
@@ -315,6 +538,19 @@ func choseNodeFromShard(shardid string) string {
 	return nodes[0]
 }
 
+// Returns the first member of shardid that is in the current view
+// Falls back to the first member if none is, like choseNodeFromShard
+func firstLiveNode(shardid string) string {
+	viewMutex.Lock()
+	defer viewMutex.Unlock()
+	for _, address := range SHARDS[shardid] {
+		if contains(CURRENT_VIEW, address) {
+			return address
+		}
+	}
+	return choseNodeFromShard(shardid)
+}
+
 // Forward the request to specified address
 func forwardRequest(c echo.Context, address string, endpoint string, jsonData []byte) error {
 	// Store HTTP method type (GET, PUT, DELETE)
@@ -322,17 +558,25 @@ func forwardRequest(c echo.Context, address string, endpoint string, jsonData []
 
 	// Create a new request to forward the address
 	url := fmt.Sprintf("http://%s/%s", address, endpoint)
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
+	// Trace the node the request was routed to
+	ctx, span := TRACER.Start(c.Request().Context(), "route", trace.WithAttributes(
+		attribute.String("kvs.endpoint", endpoint),
+		attribute.String("kvs.route.node", address),
+	))
+	defer span.End()
+	// Stop forwarding if the client goes away
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create forwarding request")
 	}
-	// Send the request to the address using an http.Client
-	client := &http.Client{}
+	// Send the request to the address through the node-to-node transport
+	client := peerClient(0)
+	forwardedTotal.WithLabelValues(address).Inc()
 	resp, err := client.Do(req)
 	if err != nil {
 		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Cannot forward request"})
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 	// Forward the response from the Main Instance back to the Client
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -343,23 +587,21 @@ func forwardRequest(c echo.Context, address string, endpoint string, jsonData []
 }
 
 // Syncs the current node's state with one other node in the same shard
+// The state is left as it is if no node of the shard answers
 func syncWithShard(shardId string) error {
 	// Send a GET request to the sync endpoint of a random node in the shard
 	resp, err := sendToAny("GET", "sync", nil, SHARDS[shardId])
+	if err != nil {
+		return fmt.Errorf("no member of %s answered: %v", shardId, err)
+	}
 	// If we successfully got a response from any node in the shard, update the current node's state
-	if err == nil {
-		defer resp.Body.Close()
-		// Parse the response body into a Sync_Data struct
-		var syncData Sync_Data
-		if err := json.NewDecoder(resp.Body).Decode(&syncData); err != nil {
-			return fmt.Errorf("error decoding sync response: %v", err)
-		}
-		updateCurrentNodeState(syncData)
-		return nil
+	defer drainAndClose(resp.Body)
+	// Parse the response body into a Sync_Data struct
+	var syncData Sync_Data
+	if err := json.NewDecoder(resp.Body).Decode(&syncData); err != nil {
+		return fmt.Errorf("error decoding sync response: %v", err)
 	}
-	// Else initialize node with empty state
-	initializeEmptyNode()
-	return nil
+	return updateCurrentNodeState(syncData)
 }
 
 // Initialize the current node with an empty state
@@ -367,36 +609,49 @@ func initializeEmptyNode() {
 	// Initialize the KV store
 	KVStore = make(map[string]Value)
 	// Initialize the vector clock
+	vectorClockMutex.Lock()
 	MY_VECTOR_CLOCK = vclock.New()
 	for _, address := range CURRENT_VIEW {
 		MY_VECTOR_CLOCK.Set(address, 0)
 	}
+	vectorClockMutex.Unlock()
 }
 
 // Update the current node's state with the received sync data
+// Nothing is changed unless all of it can be parsed
 func updateCurrentNodeState(syncData Sync_Data) error {
-	// Updating KVS
 	var newKVS map[string]Value
 	err := json.Unmarshal([]byte(syncData.KvsSync), &newKVS)
 	if err != nil {
 		return fmt.Errorf("error updating KVStore from string: %v", err)
 	}
-	KVStore = newKVS // Update the KVStore with the new data
-
-	// Updating VC
 	newVClock, err := NewVClockFromString(syncData.VectorClockStr)
 	if err != nil {
 		return fmt.Errorf("error creating vector clock from string: %v", err)
 	}
-	MY_VECTOR_CLOCK = newVClock // Update the local vector clock with the new data
-
-	// Updating SHARDS
 	var newShards map[string][]string
 	err = json.Unmarshal([]byte(syncData.ShardsString), &newShards)
 	if err != nil {
 		return fmt.Errorf("error updating shards from string: %v", err)
 	}
+
+	// Updating KVS
+	KVSmutex.Lock()
+	KVStore = newKVS // Update the KVStore with the new data
+	KVSmutex.Unlock()
+
+	// Updating VC
+	vectorClockMutex.Lock()
+	MY_VECTOR_CLOCK = newVClock // Update the local vector clock with the new data
+	vectorClockMutex.Unlock()
+
+	// Updating SHARDS
 	SHARDS = newShards // Update the shard information with the new data
+	if syncData.Ranges != nil {
+		RANGES = syncData.Ranges
+	}
+	PARTITION_OVERRIDES = pruneOverrides(syncData.Overrides, SHARDS)
+	SHARD_WEIGHTS = pruneWeights(syncData.Weights, SHARDS)
 
 	return nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DistributedClocks/GoVector/govec/vclock"
+)
+
+// A replicated write that arrives before the one it follows waits for it instead of being rejected
+func TestReplicatedWriteWaitsForEarlierWrite(t *testing.T) {
+	CONFIG = defaultConfig()
+	vectorClockMutex.Lock()
+	MY_VECTOR_CLOCK = vclock.New()
+	MY_VECTOR_CLOCK.Set("a", 0)
+	MY_VECTOR_CLOCK.Set("b", 0)
+	vectorClockMutex.Unlock()
+
+	second := vclock.New()
+	second.Set("a", 2)
+	done := make(chan bool)
+	go func() {
+		vectorClockMutex.Lock()
+		defer vectorClockMutex.Unlock()
+		done <- awaitDeliverable(second, "a")
+	}()
+
+	// The first write of a arrives a little later
+	time.Sleep(50 * time.Millisecond)
+	first := vclock.New()
+	first.Set("a", 1)
+	mergeSenderPosition(first, "a")
+	if !<-done {
+		t.Fatal("second write of a was rejected after the first one arrived")
+	}
+
+	// A write that depends on one that never arrives is rejected within the send timeout
+	third := vclock.New()
+	third.Set("a", 2)
+	third.Set("b", 1)
+	start := time.Now()
+	vectorClockMutex.Lock()
+	deliverable := awaitDeliverable(third, "a")
+	vectorClockMutex.Unlock()
+	if deliverable {
+		t.Fatal("write was delivered before the write of b it depends on")
+	}
+	if waited := time.Since(start); waited >= time.Duration(CONFIG.SendTimeout) {
+		t.Fatalf("waited %v, longer than the send timeout", waited)
+	}
+}
+
+// A write sent again after its first attempt timed out is recognized as applied
+func TestAlreadyApplied(t *testing.T) {
+	mine := vclock.New()
+	mine.Set("a", 3)
+	for tick, applied := range map[uint64]bool{2: true, 3: true, 4: false} {
+		sender := vclock.New()
+		sender.Set("a", tick)
+		if got := alreadyApplied(sender, mine, "a"); got != applied {
+			t.Errorf("alreadyApplied at tick %d = %v, want %v", tick, got, applied)
+		}
+	}
+}
+
+// Returns the number of nodes that are in a different shard in after than in before
+func movedNodes(before map[string][]string, after map[string][]string) int {
+	moved := 0
+	for shardid, members := range after {
+		for _, address := range members {
+			if !contains(before[shardid], address) {
+				moved++
+			}
+		}
+	}
+	return moved
+}
+
+func TestAssignNodesToShards(t *testing.T) {
+	nodes := []string{"n1", "n2", "n3", "n4", "n5", "n6"}
+	current := map[string][]string{"shard0": {"n1", "n2", "n3"}, "shard1": {"n4", "n5", "n6"}}
+	tests := []struct {
+		name       string
+		shardCount int
+		nodes      []string
+		current    map[string][]string
+		want       map[string][]string
+		moved      int
+	}{
+		{"first assignment", 2, nodes, nil, nil, 6},
+		{"same shard count", 2, nodes, current, current, 0},
+		// Only the nodes the new shard needs move
+		{"add a shard", 3, nodes, current, nil, 2},
+		// Only the nodes of the dropped shard move
+		{"drop a shard", 2, nodes, map[string][]string{"shard0": {"n1", "n2"}, "shard1": {"n3", "n4"}, "shard2": {"n5", "n6"}}, nil, 2},
+		// A new node fills the gap of one that left
+		{"replace a node", 2, []string{"n1", "n2", "n3", "n4", "n5", "n7"}, current, map[string][]string{"shard0": {"n1", "n2", "n3"}, "shard1": {"n4", "n5", "n7"}}, 1},
+		// Split shards keep their ids
+		{"split shard ids", 3, append(nodes, "n7"), map[string][]string{"shard0": {"n1", "n2"}, "shard1.0": {"n3", "n4"}, "shard1.1": {"n5", "n6"}}, nil, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shards := assignNodesToShards(test.shardCount, test.nodes, test.current, nil)
+			if len(shards) != test.shardCount {
+				t.Fatalf("got %d shards: %v", len(shards), shards)
+			}
+			placed := 0
+			smallest, largest := len(test.nodes), 0
+			for _, members := range shards {
+				placed += len(members)
+				smallest, largest = min(smallest, len(members)), max(largest, len(members))
+			}
+			if placed != len(test.nodes) || largest-smallest > 1 {
+				t.Errorf("%d of %d nodes placed with shard sizes from %d to %d: %v", placed, len(test.nodes), smallest, largest, shards)
+			}
+			if test.want != nil {
+				for shardid, members := range test.want {
+					if !reflect.DeepEqual(shards[shardid], members) {
+						t.Errorf("%s has %v, want %v", shardid, shards[shardid], members)
+					}
+				}
+			}
+			if moved := movedNodes(test.current, shards); moved != test.moved {
+				t.Errorf("%d nodes moved, want %d: %v", moved, test.moved, shards)
+			}
+		})
+	}
+}
+
+// Nodes are spread over failure domains, so that losing one domain leaves every shard a member
+func TestAssignNodesToShardsSpreadsFailureDomains(t *testing.T) {
+	nodes := []string{"a1", "a2", "b1", "b2"}
+	domains := map[string]string{"a1": "rack-a", "a2": "rack-a", "b1": "rack-b", "b2": "rack-b"}
+	shards := assignNodesToShards(2, nodes, nil, domains)
+	for shardid, members := range shards {
+		if len(members) != 2 || domains[members[0]] == domains[members[1]] {
+			t.Errorf("%s has %v, want one node of each rack", shardid, members)
+		}
+	}
+}
@@ -31,7 +31,10 @@ func putReplicaView(c echo.Context) error {
 		}
 	}
 	CURRENT_VIEW = append(CURRENT_VIEW, viewRequest.SocketAdress)
+	vectorClockMutex.Lock()
 	MY_VECTOR_CLOCK.Set(viewRequest.SocketAdress, 0)
+	vectorClockMutex.Unlock()
+	addToAgreedView(viewRequest.SocketAdress)
 	return c.JSON(http.StatusCreated, map[string]string{"result": "added"})
 }
 
@@ -52,6 +55,11 @@ func deleteReplicaView(c echo.Context) error {
 	if err := json.Unmarshal(body, &viewRequest); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
 	}
+	// A node removed by a client has left the cluster, while one removed by the
+	// heartbeat of another node may only be on the other side of a partition
+	if viewRequest.FromRepilca == "" {
+		removeFromAgreedView(viewRequest.SocketAdress)
+	}
 	for i, addr := range CURRENT_VIEW {
 		if addr == viewRequest.SocketAdress {
 			// Remove the address from the view
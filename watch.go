@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Number of changes queued for a watcher before it is dropped for falling behind
+const watchQueueSize = 256
+
+// A write to a key as seen by this node
+type Key_Change struct {
+	Key string
+	// nil for deletes
+	Value *Value
+	// Vector clock of the write
+	CausalMetaData string
+}
+
+// A subscriber to the writes this node sees
+type watcher struct {
+	prefix string
+	// Closed when the watcher is stopped or falls behind
+	changes chan Key_Change
+}
+
+// Watchers of key changes
+var WATCHERS = make(map[*watcher]bool)
+
+// Protects WATCHERS
+var watchersMutex sync.Mutex
+
+// Start watching the changes of keys starting with prefix
+func watchChanges(prefix string) *watcher {
+	w := &watcher{prefix: prefix, changes: make(chan Key_Change, watchQueueSize)}
+	watchersMutex.Lock()
+	WATCHERS[w] = true
+	watchersMutex.Unlock()
+	return w
+}
+
+// Stop sending changes to w
+func stopWatching(w *watcher) {
+	watchersMutex.Lock()
+	defer watchersMutex.Unlock()
+	if WATCHERS[w] {
+		delete(WATCHERS, w)
+		close(w.changes)
+	}
+}
+
+// Send a write to every watcher of its key
+// Every node sees each write once: it is broadcast to the whole view, and nodes
+// of other shards only use it to update their vector clock
+func publishChange(key string, value *Value, causalMetaData string) {
+	watchersMutex.Lock()
+	defer watchersMutex.Unlock()
+	for w := range WATCHERS {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		select {
+		case w.changes <- Key_Change{Key: key, Value: value, CausalMetaData: causalMetaData}:
+		default:
+			// Never hold writes back for a slow watcher
+			delete(WATCHERS, w)
+			close(w.changes)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestPublishChange(t *testing.T) {
+	users := watchChanges("user:")
+	defer stopWatching(users)
+	publishChange("other", nil, "")
+	publishChange("user:1", &Value{Data: "ann"}, "")
+	if change := <-users.changes; change.Key != "user:1" || change.Value.Data != "ann" {
+		t.Errorf("watcher of user: got %v", change)
+	}
+
+	// A watcher that falls behind is dropped instead of holding writes back
+	slow := watchChanges("")
+	for i := 0; i <= watchQueueSize; i++ {
+		publishChange("key", nil, "")
+	}
+	for range slow.changes {
+	}
+	watchersMutex.Lock()
+	dropped := !WATCHERS[slow]
+	watchersMutex.Unlock()
+	if !dropped {
+		t.Error("slow watcher is still registered")
+	}
+	stopWatching(slow)
+}
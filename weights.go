@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/buraksezer/consistent"
+	"github.com/labstack/echo/v4"
+)
+
+// Capacity weight of each shard; shards that are missing have weight 1
+// Replaced as a whole, never modified in place
+var SHARD_WEIGHTS = make(map[string]float64)
+
+// Define JSON body for /admin/shard-weights requests
+type Shard_Weights_Request struct {
+	Weights map[string]float64 `json:"weights"`
+}
+
+// Returns the weight of a shard
+func shardWeight(weights map[string]float64, shardid string) float64 {
+	if weight, ok := weights[shardid]; ok {
+		return weight
+	}
+	return 1
+}
+
+// Drop weights of shards that no longer exist, and weights equal to the default
+func pruneWeights(weights map[string]float64, shards map[string][]string) map[string]float64 {
+	pruned := make(map[string]float64)
+	for shardid, weight := range weights {
+		if _, ok := shards[shardid]; ok && weight != 1 {
+			pruned[shardid] = weight
+		}
+	}
+	return pruned
+}
+
+// Returns the number of partitions every shard should own in proportion to its weight
+func partitionTargets(shards map[string][]string, weights map[string]float64) map[string]int {
+	shardIDs := sortedShardIDs(shards)
+	total := 0.0
+	for _, shardid := range shardIDs {
+		total += shardWeight(weights, shardid)
+	}
+	// Largest remainder method so that the targets add up to the partition count
+	targets := make(map[string]int)
+	remainders := make(map[string]float64)
+	assigned := 0
+	for _, shardid := range shardIDs {
+		exact := float64(RING_CONFIG.PartitionCount) * shardWeight(weights, shardid) / total
+		targets[shardid] = int(math.Floor(exact))
+		remainders[shardid] = exact - math.Floor(exact)
+		assigned += targets[shardid]
+	}
+	sort.SliceStable(shardIDs, func(i, j int) bool { return remainders[shardIDs[i]] > remainders[shardIDs[j]] })
+	for i := 0; i < RING_CONFIG.PartitionCount-assigned; i++ {
+		targets[shardIDs[i%len(shardIDs)]]++
+	}
+	return targets
+}
+
+// Returns overrides that give every shard its weighted number of partitions
+// Only partitions of shards above their target move, those holding the fewest keys first,
+// and a partition goes back to the shard the ring assigns it to whenever that shard needs one
+func weightedOverrides(ring *consistent.Consistent, shards map[string][]string, weights map[string]float64, overrides map[int]string, partKeys map[int]int) map[int]string {
+	targets := partitionTargets(shards, weights)
+	owner := func(partID int) string {
+		if shardid, ok := overrides[partID]; ok {
+			return shardid
+		}
+		return ring.GetPartitionOwner(partID).String()
+	}
+	owned := make(map[string][]int)
+	for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+		owned[owner(partID)] = append(owned[owner(partID)], partID)
+	}
+
+	// Collect the partitions that shards above their target give away
+	var pool []int
+	for _, shardid := range sortedShardIDs(shards) {
+		parts := owned[shardid]
+		sort.SliceStable(parts, func(i, j int) bool { return partKeys[parts[i]] < partKeys[parts[j]] })
+		for len(parts) > targets[shardid] {
+			pool = append(pool, parts[0])
+			parts = parts[1:]
+		}
+		owned[shardid] = parts
+	}
+
+	result := make(map[int]string)
+	for partID, shardid := range overrides {
+		result[partID] = shardid
+	}
+	for _, partID := range pool {
+		target := ""
+		home := ring.GetPartitionOwner(partID).String()
+		if len(owned[home]) < targets[home] {
+			target = home
+		} else {
+			for _, shardid := range sortedShardIDs(shards) {
+				if len(owned[shardid]) >= targets[shardid] {
+					continue
+				}
+				if target == "" || targets[shardid]-len(owned[shardid]) > targets[target]-len(owned[target]) {
+					target = shardid
+				}
+			}
+		}
+		owned[target] = append(owned[target], partID)
+		result[partID] = target
+		if target == home {
+			delete(result, partID)
+		}
+	}
+	return result
+}
+
+// Returns the number of keys in every partition, given the keys of every shard
+func partitionKeyCounts(sizes map[string]map[string]int) map[int]int {
+	partKeys := make(map[int]int)
+	for _, shardSizes := range sizes {
+		for key := range shardSizes {
+			partKeys[partitionOf(key)]++
+		}
+	}
+	return partKeys
+}
+
+// GET /admin/shard-weights
+// Returns the weight of every shard with the number of partitions it owns and should own
+func getShardWeights(c echo.Context) error {
+	weights := make(map[string]float64)
+	owned := make(map[string]int)
+	for shardid := range SHARDS {
+		weights[shardid] = shardWeight(SHARD_WEIGHTS, shardid)
+		owned[shardid] = 0
+	}
+	if CONFIG.Partitioner != partitionerRange && HASH_RING != nil {
+		for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+			owned[partitionOwner(partID)]++
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"weights":    weights,
+		"partitions": owned,
+		"targets":    partitionTargets(SHARDS, SHARD_WEIGHTS),
+	})
+}
+
+// PUT /admin/shard-weights
+// JSON body {"weights": {<ID>: <NUMBER>, ...}}
+// Change the weight of some shards and move the fewest partitions needed to match them
+func putShardWeights(c echo.Context) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+	var input Shard_Weights_Request
+	if err := json.Unmarshal(body, &input); err != nil || len(input.Weights) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON format"})
+	}
+	if CONFIG.Partitioner == partitionerRange {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Shard weights are only supported with hash partitioning"})
+	}
+	if isPartitioned() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Node is in a minority partition; shard changes are disabled"})
+	}
+	if reshardInProgress() {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A reshard is already in progress"})
+	}
+	weights := make(map[string]float64)
+	for shardid, weight := range SHARD_WEIGHTS {
+		weights[shardid] = weight
+	}
+	for shardid, weight := range input.Weights {
+		if _, ok := SHARDS[shardid]; !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Shard ID not found"})
+		}
+		if weight <= 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Weights must be positive"})
+		}
+		weights[shardid] = weight
+	}
+
+	sizes, err := fetchAllKeySizes()
+	if err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	}
+	job := newReshardJob(len(SHARDS), SHARDS)
+	job.Weights = pruneWeights(weights, SHARDS)
+	job.Overrides = weightedOverrides(HASH_RING, SHARDS, weights, PARTITION_OVERRIDES, partitionKeyCounts(sizes))
+	moved := make(map[int]string)
+	for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+		if newOwner := partitionOwnerIn(job.Overrides, partID); newOwner != partitionOwner(partID) {
+			moved[partID] = newOwner
+		}
+	}
+	if err := runReshard(&job, 0); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Reshard " + job.State + ": " + err.Error(), "job-id": job.ID})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"result": "reweighted", "job-id": job.ID, "moved": moved})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPartitionTargets(t *testing.T) {
+	RING_CONFIG = Ring_Config{PartitionCount: 10}
+	shards := map[string][]string{"shard0": {"a"}, "shard1": {"b"}, "shard2": {"c"}}
+	tests := []struct {
+		weights map[string]float64
+		want    map[string]int
+	}{
+		{map[string]float64{}, map[string]int{"shard0": 4, "shard1": 3, "shard2": 3}},
+		{map[string]float64{"shard0": 3}, map[string]int{"shard0": 6, "shard1": 2, "shard2": 2}},
+		{map[string]float64{"shard1": 0.5, "shard2": 2}, map[string]int{"shard0": 3, "shard1": 1, "shard2": 6}},
+	}
+	for _, test := range tests {
+		if got := partitionTargets(shards, test.weights); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("targets for weights %v are %v, want %v", test.weights, got, test.want)
+		}
+	}
+}
+
+func TestWeightedOverrides(t *testing.T) {
+	RING_CONFIG = Ring_Config{PartitionCount: 12, ReplicationFactor: 20, Load: 1.25}
+	shards := map[string][]string{"shard0": {"a"}, "shard1": {"b"}}
+	ring := createHashRing(shards)
+	owned := func(overrides map[int]string) map[string]int {
+		counts := make(map[string]int)
+		for partID := 0; partID < RING_CONFIG.PartitionCount; partID++ {
+			shardid, ok := overrides[partID]
+			if !ok {
+				shardid = ring.GetPartitionOwner(partID).String()
+			}
+			counts[shardid]++
+		}
+		return counts
+	}
+
+	weights := map[string]float64{"shard0": 3}
+	overrides := weightedOverrides(ring, shards, weights, map[int]string{}, map[int]int{})
+	if counts := owned(overrides); counts["shard0"] != 9 || counts["shard1"] != 3 {
+		t.Fatalf("shards own %v partitions with weights %v", counts, weights)
+	}
+	for partID, shardid := range overrides {
+		if ring.GetPartitionOwner(partID).String() == shardid {
+			t.Errorf("partition %d is overridden to the shard the ring gives it", partID)
+		}
+	}
+
+	// Dropping the weight evens the shards out again
+	overrides = weightedOverrides(ring, shards, map[string]float64{}, overrides, map[int]int{})
+	if counts := owned(overrides); counts["shard0"] != 6 || counts["shard1"] != 6 {
+		t.Errorf("shards own %v partitions without weights", counts)
+	}
+}